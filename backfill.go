@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Longest backfill, so the 32 bit millisecond sysUptime of the hosts does
+// not wrap around
+const MAX_BACKFILL_DURATION = 49 * 24 * time.Hour
+
+// Generate the flows of a past time range, ticks are sent Speed times
+// faster than real time or as fast as possible for Speed 0
+type Backfill struct {
+	Start time.Time
+	End   time.Time
+	Speed float64
+
+	realStart time.Time
+}
+
+// Backfill mode from the command line, nil if no start time is provided
+func ParseBackfillArgs(startInput string, endInput string, speed float64) (*Backfill, error) {
+	if startInput == "" {
+		if endInput != "" {
+			return nil, fmt.Errorf("invalid backfill: backfill-end requires backfill-start")
+		}
+		return nil, nil
+	}
+
+	start, err := time.Parse(time.RFC3339, startInput)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse backfill start %s: %v", startInput, err)
+	}
+
+	end := time.Now()
+	if endInput != "" {
+		end, err = time.Parse(time.RFC3339, endInput)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse backfill end %s: %v", endInput, err)
+		}
+	}
+
+	if !end.After(start) {
+		return nil, fmt.Errorf("invalid backfill: end %s is not after start %s", end.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+
+	if end.Sub(start) > MAX_BACKFILL_DURATION {
+		return nil, fmt.Errorf("invalid backfill: longer than %v", MAX_BACKFILL_DURATION)
+	}
+
+	if speed < 0 {
+		return nil, fmt.Errorf("invalid backfill speed %v: must not be negative", speed)
+	}
+
+	return &Backfill{
+		Start: start.Truncate(time.Second),
+		End:   end,
+		Speed: speed,
+	}, nil
+}
+
+// Hosts boot before the start of the backfill, one minute apart like in
+// real time
+func (b *Backfill) InitClock(clock *HostClock) {
+	clock.StartTime += b.Start.UnixNano() - StartTime
+}
+
+// Whether the tick starting at tickMs is past the end of the backfill
+func (b *Backfill) Done(tickMs int64) bool {
+	return tickMs >= b.End.UnixNano()/int64(time.Millisecond)
+}
+
+// Start sending, the ticks are paced from now
+func (b *Backfill) Begin() {
+	b.realStart = time.Now()
+}
+
+// Real time of a tick at the speed of the backfill, 0 if the ticks are
+// sent as fast as possible
+func (b *Backfill) TickDuration() time.Duration {
+	if b.Speed == 0 {
+		return 0
+	}
+
+	return time.Duration(float64(TICK_INTERVAL_MS) / b.Speed * float64(time.Millisecond))
+}
+
+// Wait until the tick is due at the speed of the backfill
+func (b *Backfill) Sleep(absTick int) {
+	if b.Speed == 0 {
+		return
+	}
+
+	due := b.realStart.Add(time.Duration(float64(absTick*TICK_INTERVAL_MS) / b.Speed * float64(time.Millisecond)))
+
+	time.Sleep(time.Until(due))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	BYTES_DIST_CONSTANT  = "constant"
+	BYTES_DIST_UNIFORM   = "uniform"
+	BYTES_DIST_NORMAL    = "normal"
+	BYTES_DIST_LOGNORMAL = "lognormal"
+	BYTES_DIST_PARETO    = "pareto"
+	BYTES_DIST_EMPIRICAL = "empirical"
+)
+
+// Bytes range used when no distribution is configured
+const (
+	DEFAULT_BYTES_MIN = 50
+	DEFAULT_BYTES_MAX = 1049
+)
+
+// Bucket of an empirical histogram, a value between Min and Max is picked
+// with a probability proportional to Weight
+type HistogramBucket struct {
+	Min    int
+	Max    int
+	Weight float64
+}
+
+// Distribution of the bytes value of a flow, which fields are used depends
+// on the type. Min and Max clamp the values of the unbounded distributions
+type ConfigBytesDistribution struct {
+	Type   string  `json:"type"`
+	Value  int     `json:"value"`
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
+	Mu     float64 `json:"mu"`
+	Sigma  float64 `json:"sigma"`
+	Alpha  float64 `json:"alpha"`
+	Scale  float64 `json:"scale"`
+	File   string  `json:"file"`
+
+	// Buckets of the empirical histogram, read from File
+	Buckets     []HistogramBucket `json:"-"`
+	totalWeight float64
+}
+
+func DefaultBytesDistribution() *ConfigBytesDistribution {
+	return &ConfigBytesDistribution{
+		Type: BYTES_DIST_UNIFORM,
+		Min:  DEFAULT_BYTES_MIN,
+		Max:  DEFAULT_BYTES_MAX,
+	}
+}
+
+// Validate the distribution and read the histogram file, relative file
+// names are resolved from the directory of the config file
+func (d *ConfigBytesDistribution) Init(configDir string) error {
+	if d.Min < 0 || d.Max < 0 || (d.Max != 0 && d.Min > d.Max) {
+		return fmt.Errorf("invalid %s bytes distribution: invalid min %d / max %d", d.Type, d.Min, d.Max)
+	}
+
+	switch d.Type {
+	case BYTES_DIST_CONSTANT:
+		if d.Value <= 0 {
+			return fmt.Errorf("invalid constant bytes distribution: value must be greater than 0")
+		}
+	case BYTES_DIST_UNIFORM:
+		if d.Min <= 0 || d.Max == 0 {
+			return fmt.Errorf("invalid uniform bytes distribution: min and max must be greater than 0")
+		}
+	case BYTES_DIST_NORMAL:
+		if d.Mean <= 0 || d.Stddev < 0 {
+			return fmt.Errorf("invalid normal bytes distribution: mean must be greater than 0 and stddev must not be negative")
+		}
+	case BYTES_DIST_LOGNORMAL:
+		if d.Sigma < 0 {
+			return fmt.Errorf("invalid lognormal bytes distribution: sigma must not be negative")
+		}
+	case BYTES_DIST_PARETO:
+		if d.Alpha <= 0 || d.Scale <= 0 {
+			return fmt.Errorf("invalid pareto bytes distribution: alpha and scale must be greater than 0")
+		}
+	case BYTES_DIST_EMPIRICAL:
+		if d.File == "" {
+			return fmt.Errorf("invalid empirical bytes distribution: file not provided")
+		}
+
+		filename := d.File
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(configDir, filename)
+		}
+
+		buckets, err := ReadHistogramFile(filename)
+
+		if err != nil {
+			return err
+		}
+
+		d.Buckets = buckets
+		d.totalWeight = 0
+		for _, bucket := range buckets {
+			d.totalWeight += bucket.Weight
+		}
+	default:
+		return fmt.Errorf("unknown bytes distribution %s", d.Type)
+	}
+
+	return nil
+}
+
+// Read a histogram file, each line has a bytes value or range and a weight:
+//
+//	# bytes weight
+//	64 50
+//	65-1499 30
+//	1500 20
+func ReadHistogramFile(filename string) ([]HistogramBucket, error) {
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open histogram file %s: %v", filename, err)
+	}
+
+	defer file.Close()
+
+	var buckets []HistogramBucket
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' })
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("failed to parse histogram file %s line %d: expected bytes and weight", filename, lineNumber)
+		}
+
+		bucket := HistogramBucket{}
+
+		bytesRange := strings.SplitN(fields[0], "-", 2)
+
+		bucket.Min, err = strconv.Atoi(bytesRange[0])
+
+		if err == nil {
+			bucket.Max = bucket.Min
+			if len(bytesRange) == 2 {
+				bucket.Max, err = strconv.Atoi(bytesRange[1])
+			}
+		}
+
+		if err != nil || bucket.Min <= 0 || bucket.Min > bucket.Max {
+			return nil, fmt.Errorf("failed to parse histogram file %s line %d: invalid bytes %s", filename, lineNumber, fields[0])
+		}
+
+		bucket.Weight, err = strconv.ParseFloat(fields[1], 64)
+
+		if err != nil || bucket.Weight < 0 {
+			return nil, fmt.Errorf("failed to parse histogram file %s line %d: invalid weight %s", filename, lineNumber, fields[1])
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read histogram file %s: %v", filename, err)
+	}
+
+	totalWeight := 0.0
+	for _, bucket := range buckets {
+		totalWeight += bucket.Weight
+	}
+
+	if totalWeight == 0 {
+		return nil, fmt.Errorf("histogram file %s has no buckets with a weight", filename)
+	}
+
+	return buckets, nil
+}
+
+// Pick the bytes value for a tick, only the seeded random generator is used
+// so all generators of a topology pick the same values
+func (d *ConfigBytesDistribution) Gen(randGen *rand.Rand) int {
+	var value float64
+
+	switch d.Type {
+	case BYTES_DIST_CONSTANT:
+		return d.Value
+	case BYTES_DIST_UNIFORM:
+		return d.Min + randGen.Intn(d.Max-d.Min+1)
+	case BYTES_DIST_NORMAL:
+		value = d.Mean + randGen.NormFloat64()*d.Stddev
+	case BYTES_DIST_LOGNORMAL:
+		value = math.Exp(d.Mu + randGen.NormFloat64()*d.Sigma)
+	case BYTES_DIST_PARETO:
+		// Inverse transform sampling, 1 - Float64() is in (0, 1]
+		value = d.Scale / math.Pow(1-randGen.Float64(), 1/d.Alpha)
+	case BYTES_DIST_EMPIRICAL:
+		return d.genEmpirical(randGen)
+	}
+
+	return d.clamp(value)
+}
+
+func (d *ConfigBytesDistribution) genEmpirical(randGen *rand.Rand) int {
+	target := randGen.Float64() * d.totalWeight
+
+	bucket := d.Buckets[len(d.Buckets)-1]
+
+	for _, b := range d.Buckets {
+		if target < b.Weight {
+			bucket = b
+			break
+		}
+		target -= b.Weight
+	}
+
+	if bucket.Min == bucket.Max {
+		return bucket.Min
+	}
+
+	return bucket.Min + randGen.Intn(bucket.Max-bucket.Min+1)
+}
+
+func (d *ConfigBytesDistribution) clamp(value float64) int {
+	min := float64(d.Min)
+	if min < 1 {
+		min = 1
+	}
+
+	max := float64(d.Max)
+	if d.Max == 0 || max > math.MaxInt32 {
+		max = math.MaxInt32
+	}
+
+	value = math.Round(value)
+
+	if value < min || math.IsNaN(value) {
+		return int(min)
+	}
+
+	if value > max {
+		return int(max)
+	}
+
+	return int(value)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+)
+
+type CollectorFlowKey struct {
+	SrcAddr string
+	SrcPort uint16
+	DstAddr string
+	DstPort uint16
+	Proto   int
+}
+
+type CollectorFlowTotal struct {
+	Count int
+	Bytes int
+}
+
+// Received state for a single exporter, identified by its source address
+// and engine id, hosts simulated by one process share the source address.
+// The engine id is the v5 engine id, the v9 source id, the IPFIX
+// observation domain id or the sflow sub agent id
+type CollectorExporterState struct {
+	Addr     string
+	EngineId uint32
+	Packets  int
+	Records  int
+
+	// The sequence numbers of v9 and sflow count packets, so the lost
+	// records of their exporters are lost packets
+	LostRecords     int
+	OutOfOrder      int
+	nextSequence    uint32
+	sequenceStarted bool
+
+	// Flow samples of sflow exporters count as records, with the bytes
+	// scaled by the sampling rate
+	Sampled bool
+	Flows   map[CollectorFlowKey]*CollectorFlowTotal
+
+	// Templates of v9 and IPFIX exporters by template id
+	templates map[uint16]collectorTemplate
+}
+
+type Collector struct {
+	Exporters   map[string]*CollectorExporterState
+	Unsupported int
+	Malformed   int
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		Exporters: map[string]*CollectorExporterState{},
+	}
+}
+
+func collectorExporterKey(addr string, engineId uint32) string {
+	return fmt.Sprintf("%s/%d", addr, engineId)
+}
+
+func (c *Collector) getExporter(addr string, engineId uint32) *CollectorExporterState {
+	key := collectorExporterKey(addr, engineId)
+
+	exporter, ok := c.Exporters[key]
+
+	if !ok {
+		exporter = &CollectorExporterState{
+			Addr:     addr,
+			EngineId: engineId,
+			Flows:    map[CollectorFlowKey]*CollectorFlowTotal{},
+
+			templates: map[uint16]collectorTemplate{},
+		}
+		c.Exporters[key] = exporter
+	}
+
+	return exporter
+}
+
+// Decode a netflow v5, v9, IPFIX or sflow packet and add it to the
+// exporter totals
+func (c *Collector) HandlePacket(addr string, packet []byte) error {
+	if len(packet) < 4 {
+		c.Malformed++
+		return fmt.Errorf("failed to decode header from %s: packet too short", addr)
+	}
+
+	// The version of sflow is 32 bits, the version of netflow 16 bits
+	if binary.BigEndian.Uint32(packet) == SFLOW_VERSION {
+		return c.handleSflowPacket(addr, packet)
+	}
+
+	switch binary.BigEndian.Uint16(packet) {
+	case NETFLOW_V9_VERSION:
+		return c.handleNetflowV9Packet(addr, packet)
+	case IPFIX_VERSION:
+		return c.handleIpfixPacket(addr, packet)
+	}
+
+	return c.handleNetflowV5Packet(addr, packet)
+}
+
+func (c *Collector) handleNetflowV5Packet(addr string, packet []byte) error {
+	reader := bytes.NewReader(packet)
+
+	var header NetflowHeader
+
+	err := binary.Read(reader, binary.BigEndian, &header)
+
+	if err != nil {
+		c.Malformed++
+		return fmt.Errorf("failed to decode header from %s: %v", addr, err)
+	}
+
+	if header.Version != 5 {
+		c.Unsupported++
+		return fmt.Errorf("unsupported netflow version %d from %s", header.Version, addr)
+	}
+
+	exporter := c.getExporter(addr, uint32(header.EngineId))
+	exporter.Packets++
+
+	// The v5 sequence number counts flow records, so the next packet is
+	// expected to start where the records of this one end
+	exporter.trackSequence(header.FlowSequence, header.FlowSequence+uint32(header.FlowCount))
+
+	for i := 0; i < int(header.FlowCount); i++ {
+		var record NetflowPayload
+
+		err := binary.Read(reader, binary.BigEndian, &record)
+
+		if err != nil {
+			c.Malformed++
+			return fmt.Errorf("failed to decode record %d from %s: %v", i, addr, err)
+		}
+
+		key := CollectorFlowKey{
+			SrcAddr: ConvertIntToIp(record.SrcIP).String(),
+			SrcPort: record.SrcPort,
+			DstAddr: ConvertIntToIp(record.DstIP).String(),
+			DstPort: record.DstPort,
+			Proto:   int(record.IpProtocol),
+		}
+
+		exporter.addFlow(key, int(record.NumOctets))
+	}
+
+	return nil
+}
+
+// Count the packets missing before this one, next is the sequence number
+// the next packet is expected to start with
+func (e *CollectorExporterState) trackSequence(sequence uint32, next uint32) {
+	if e.sequenceStarted {
+		diff := int32(sequence - e.nextSequence)
+
+		if diff > 0 {
+			e.LostRecords += int(diff)
+		} else if diff < 0 {
+			e.OutOfOrder++
+		}
+	}
+
+	e.sequenceStarted = true
+	e.nextSequence = next
+}
+
+func (e *CollectorExporterState) addFlow(key CollectorFlowKey, bytes int) {
+	total, ok := e.Flows[key]
+
+	if !ok {
+		total = new(CollectorFlowTotal)
+		e.Flows[key] = total
+	}
+
+	total.Count++
+	total.Bytes += bytes
+	e.Records++
+}
+
+// Receive packets until no packet arrived for idleTimeout or the process
+// is interrupted
+func (c *Collector) Listen(listenAddr string, idleTimeout time.Duration) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+
+	if err != nil {
+		return fmt.Errorf("failed to resolve udp addr %s: %v", listenAddr, err)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp addr %s: %v", listenAddr, err)
+	}
+
+	defer conn.Close()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	go func() {
+		<-interrupt
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	fmt.Println("Listening on " + listenAddr)
+
+	buffer := make([]byte, 65535)
+	received := false
+
+	for {
+		// Wait indefinitely for the first packet, generators sleep before sending
+		if received {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		n, addr, err := conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read from %s: %v", listenAddr, err)
+		}
+
+		received = true
+
+		err = c.HandlePacket(addr.IP.String(), buffer[:n])
+
+		if err != nil && !opts.DisableLogging {
+			fmt.Println(err)
+		}
+	}
+}
+
+func ReadStatsFile(filename string) (OutStats, error) {
+	var outStats OutStats
+
+	byteValue, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return outStats, fmt.Errorf("failed to read stats file %s: %v", filename, err)
+	}
+
+	err = json.Unmarshal(byteValue, &outStats)
+
+	if err != nil {
+		return outStats, fmt.Errorf("failed to parse stats file %s: %v", filename, err)
+	}
+
+	return outStats, nil
+}
+
+// Compare the received flows with the stats files written by the generators
+// and print a report, returns false if anything did not match
+func (c *Collector) Report(statsFiles []string) (bool, error) {
+	passed := true
+	matched := map[string]bool{}
+
+	for _, key := range c.sortedExporters() {
+		exporter := c.Exporters[key]
+
+		fmt.Printf(
+			"exporter %s engine %d: %d packets, %d records, %d lost records, %d out of order packets\n",
+			exporter.Addr,
+			exporter.EngineId,
+			exporter.Packets,
+			exporter.Records,
+			exporter.LostRecords,
+			exporter.OutOfOrder,
+		)
+
+		if exporter.LostRecords > 0 || exporter.OutOfOrder > 0 {
+			passed = false
+		}
+	}
+
+	for _, statsFile := range statsFiles {
+		outStats, err := ReadStatsFile(statsFile)
+
+		if err != nil {
+			return false, err
+		}
+
+		engineId := outStats.SourceId
+		exporter := c.findExporter(outStats.HostIp, engineId, matched)
+
+		if exporter == nil {
+			fmt.Printf("FAIL %s: no packets received from host %s (%s engine %d)\n", statsFile, outStats.HostName, outStats.HostIp, engineId)
+			passed = false
+			continue
+		}
+
+		matched[collectorExporterKey(exporter.Addr, exporter.EngineId)] = true
+
+		if !compareExporterStats(statsFile, outStats, exporter) {
+			passed = false
+		}
+	}
+
+	if c.Unsupported > 0 || c.Malformed > 0 {
+		fmt.Printf("%d unsupported and %d malformed packets\n", c.Unsupported, c.Malformed)
+		passed = false
+	}
+
+	return passed, nil
+}
+
+func compareExporterStats(statsFile string, outStats OutStats, exporter *CollectorExporterState) bool {
+	// Sampled flows only add up to the generated ones on average
+	if exporter.Sampled {
+		fmt.Printf("SKIP %s: exporter %s engine %d sends sampled flows, %d samples received\n", statsFile, exporter.Addr, exporter.EngineId, exporter.Records)
+		return true
+	}
+
+	passed := true
+
+	// Several expanded flows can share a 5-tuple, so the expected totals are
+	// aggregated the same way as the received ones
+	expected := map[CollectorFlowKey]*CollectorFlowTotal{}
+
+	for _, total := range outStats.Total {
+		key := CollectorFlowKey{
+			SrcAddr: total.SrcAddr,
+			SrcPort: total.SrcPort,
+			DstAddr: total.DstAddr,
+			DstPort: total.DstPort,
+			Proto:   total.Proto,
+		}
+
+		if _, ok := expected[key]; !ok {
+			expected[key] = new(CollectorFlowTotal)
+		}
+
+		expected[key].Count += total.Count
+		expected[key].Bytes += total.Bytes
+	}
+
+	for key, want := range expected {
+		got, ok := exporter.Flows[key]
+
+		if !ok {
+			got = new(CollectorFlowTotal)
+		}
+
+		if got.Count != want.Count || got.Bytes != want.Bytes {
+			fmt.Printf(
+				"FAIL %s: %15s %5d -> %15s %5d [%3d] expected %d records %d bytes, received %d records %d bytes\n",
+				statsFile,
+				key.SrcAddr,
+				key.SrcPort,
+				key.DstAddr,
+				key.DstPort,
+				key.Proto,
+				want.Count,
+				want.Bytes,
+				got.Count,
+				got.Bytes,
+			)
+			passed = false
+		}
+	}
+
+	for key, got := range exporter.Flows {
+		if _, ok := expected[key]; !ok {
+			fmt.Printf(
+				"FAIL %s: %15s %5d -> %15s %5d [%3d] unexpected %d records %d bytes\n",
+				statsFile,
+				key.SrcAddr,
+				key.SrcPort,
+				key.DstAddr,
+				key.DstPort,
+				key.Proto,
+				got.Count,
+				got.Bytes,
+			)
+			passed = false
+		}
+	}
+
+	if passed {
+		fmt.Printf("PASS %s: %d flows match exporter %s engine %d\n", statsFile, len(expected), exporter.Addr, exporter.EngineId)
+	}
+
+	return passed
+}
+
+// Exporters are matched to stats files by the host ip and engine id, if
+// the generators do not send from the host ip only the engine id is used
+func (c *Collector) findExporter(hostIp string, engineId uint32, matched map[string]bool) *CollectorExporterState {
+	if exporter, ok := c.Exporters[collectorExporterKey(hostIp, engineId)]; ok {
+		return exporter
+	}
+
+	var candidates []*CollectorExporterState
+
+	for key, exporter := range c.Exporters {
+		if exporter.EngineId == engineId && !matched[key] {
+			candidates = append(candidates, exporter)
+		}
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	return nil
+}
+
+func (c *Collector) sortedExporters() []string {
+	var keys []string
+	for key := range c.Exporters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func RunCollector(listenAddr string, idleTimeout time.Duration, statsFiles []string) error {
+	collector := NewCollector()
+
+	err := collector.Listen(listenAddr, idleTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	passed, err := collector.Report(statsFiles)
+
+	if err != nil {
+		return err
+	}
+
+	if !passed {
+		fmt.Println("FAIL")
+		return fmt.Errorf("collected flows do not match")
+	}
+
+	fmt.Println("PASS")
+
+	return nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// Length of IPFIX fields with a variable length, which are not decoded
+const IPFIX_VARIABLE_LENGTH = 65535
+
+// Template of a v9 or IPFIX exporter, the records of options templates
+// describe the exporter instead of a flow
+type collectorTemplate struct {
+	fields  []NetflowV9TemplateField
+	options bool
+}
+
+func (t collectorTemplate) recordLen() int {
+	length := 0
+	for _, field := range t.fields {
+		length += int(field.Length)
+	}
+	return length
+}
+
+type sflowDatagramHeader struct {
+	SubAgentId     uint32
+	SequenceNumber uint32
+	SysUptime      uint32
+	NumSamples     uint32
+}
+
+func (c *Collector) handleNetflowV9Packet(addr string, packet []byte) error {
+	var header NetflowV9Header
+
+	err := binary.Read(bytes.NewReader(packet), binary.BigEndian, &header)
+
+	if err != nil {
+		c.Malformed++
+		return fmt.Errorf("failed to decode v9 header from %s: %v", addr, err)
+	}
+
+	exporter := c.getExporter(addr, header.SourceId)
+	exporter.Packets++
+
+	// The v9 sequence number counts packets
+	exporter.trackSequence(header.FlowSequence, header.FlowSequence+1)
+
+	_, err = exporter.decodeSets(packet[binary.Size(header):], false)
+
+	if err != nil {
+		c.Malformed++
+		return fmt.Errorf("failed to decode v9 packet from %s: %v", addr, err)
+	}
+
+	return nil
+}
+
+func (c *Collector) handleIpfixPacket(addr string, packet []byte) error {
+	var header IpfixHeader
+
+	err := binary.Read(bytes.NewReader(packet), binary.BigEndian, &header)
+
+	if err == nil && (int(header.Length) < binary.Size(header) || int(header.Length) > len(packet)) {
+		err = fmt.Errorf("invalid message length %d", header.Length)
+	}
+
+	if err != nil {
+		c.Malformed++
+		return fmt.Errorf("failed to decode ipfix header from %s: %v", addr, err)
+	}
+
+	exporter := c.getExporter(addr, header.ObservationDomainId)
+	exporter.Packets++
+
+	records, err := exporter.decodeSets(packet[binary.Size(header):header.Length], true)
+
+	// The IPFIX sequence number counts the flow records
+	exporter.trackSequence(header.SequenceNumber, header.SequenceNumber+uint32(records))
+
+	if err != nil {
+		c.Malformed++
+		return fmt.Errorf("failed to decode ipfix message from %s: %v", addr, err)
+	}
+
+	return nil
+}
+
+// Decode the flowsets of a v9 packet or the sets of an IPFIX message,
+// returns the number of flow records
+func (e *CollectorExporterState) decodeSets(data []byte, ipfix bool) (int, error) {
+	templateSetId := uint16(NFV9_TEMPLATE_SET_ID)
+	optionsSetId := uint16(NFV9_OPTIONS_TEMPLATE_SET_ID)
+
+	if ipfix {
+		templateSetId = IPFIX_TEMPLATE_SET_ID
+		optionsSetId = IPFIX_OPTIONS_TEMPLATE_SET_ID
+	}
+
+	records := 0
+
+	for len(data) >= 4 {
+		setId := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+
+		if length < 4 || length > len(data) {
+			return records, fmt.Errorf("invalid set length %d", length)
+		}
+
+		body := data[4:length]
+		data = data[length:]
+
+		var err error
+
+		switch {
+		case setId == templateSetId:
+			err = e.decodeTemplates(body, ipfix, false)
+		case setId == optionsSetId:
+			err = e.decodeTemplates(body, ipfix, true)
+		case setId >= NFV9_TEMPLATE_ID:
+			// Data sets have the id of their template, from 256
+			var n int
+			n, err = e.decodeDataSet(setId, body)
+			records += n
+		}
+
+		if err != nil {
+			return records, err
+		}
+	}
+
+	return records, nil
+}
+
+// Decode the templates of a template or options template set, the
+// templates replace the previous ones with the same id
+func (e *CollectorExporterState) decodeTemplates(data []byte, ipfix bool, options bool) error {
+	// Sets are padded to a 4 byte boundary
+	for len(data) >= 4 {
+		templateId := binary.BigEndian.Uint16(data)
+		numFields := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+
+		if options {
+			if len(data) < 2 {
+				return fmt.Errorf("options template %d truncated", templateId)
+			}
+
+			// The scope and option lengths of v9 are in bytes, IPFIX has the
+			//  total and scope field counts
+			if !ipfix {
+				numFields = (numFields + int(binary.BigEndian.Uint16(data))) / 4
+			}
+
+			data = data[2:]
+		}
+
+		var fields []NetflowV9TemplateField
+
+		for i := 0; i < numFields; i++ {
+			if len(data) < 4 {
+				return fmt.Errorf("template %d truncated", templateId)
+			}
+
+			field := NetflowV9TemplateField{
+				Type:   binary.BigEndian.Uint16(data),
+				Length: binary.BigEndian.Uint16(data[2:]),
+			}
+			data = data[4:]
+
+			// Enterprise specific IPFIX fields are followed by the enterprise
+			//  number, the bit is kept so they do not match a standard field
+			if ipfix && field.Type&0x8000 != 0 {
+				if len(data) < 4 {
+					return fmt.Errorf("template %d truncated", templateId)
+				}
+
+				data = data[4:]
+			}
+
+			if ipfix && field.Length == IPFIX_VARIABLE_LENGTH {
+				return fmt.Errorf("template %d: variable length fields are not supported", templateId)
+			}
+
+			fields = append(fields, field)
+		}
+
+		e.templates[templateId] = collectorTemplate{fields: fields, options: options}
+	}
+
+	return nil
+}
+
+// Decode the records of a data set, returns the number of flow records
+func (e *CollectorExporterState) decodeDataSet(templateId uint16, data []byte) (int, error) {
+	template, ok := e.templates[templateId]
+
+	if !ok {
+		return 0, fmt.Errorf("no template %d", templateId)
+	}
+
+	recordLen := template.recordLen()
+
+	if recordLen == 0 {
+		return 0, fmt.Errorf("template %d has no fields", templateId)
+	}
+
+	if template.options {
+		return 0, nil
+	}
+
+	records := 0
+
+	// The padding of the set is shorter than a record
+	for ; len(data) >= recordLen; data = data[recordLen:] {
+		key, bytes := decodeTemplateRecord(template.fields, data[:recordLen])
+		e.addFlow(key, bytes)
+		records++
+	}
+
+	return records, nil
+}
+
+// The 5-tuple and bytes of a data record, v9 and IPFIX use the same field
+// ids for them
+func decodeTemplateRecord(fields []NetflowV9TemplateField, data []byte) (CollectorFlowKey, int) {
+	var key CollectorFlowKey
+	bytes := 0
+
+	for _, field := range fields {
+		value := data[:field.Length]
+		data = data[field.Length:]
+
+		switch field.Type {
+		case NFV9_IPV4_SRC_ADDR, NFV9_IPV6_SRC_ADDR:
+			key.SrcAddr = decodeAddr(value)
+		case NFV9_IPV4_DST_ADDR, NFV9_IPV6_DST_ADDR:
+			key.DstAddr = decodeAddr(value)
+		case NFV9_L4_SRC_PORT:
+			key.SrcPort = uint16(decodeUint(value))
+		case NFV9_L4_DST_PORT:
+			key.DstPort = uint16(decodeUint(value))
+		case NFV9_PROTOCOL:
+			key.Proto = int(decodeUint(value))
+		case NFV9_IN_BYTES:
+			bytes = int(decodeUint(value))
+		}
+	}
+
+	return key, bytes
+}
+
+func decodeUint(value []byte) uint64 {
+	var result uint64
+	for _, b := range value {
+		result = result<<8 | uint64(b)
+	}
+	return result
+}
+
+func decodeAddr(value []byte) string {
+	addr, ok := netip.AddrFromSlice(value)
+
+	if !ok {
+		return ""
+	}
+
+	return addr.String()
+}
+
+// Decode the flow samples of a sflow datagram, counter samples are skipped
+func (c *Collector) handleSflowPacket(addr string, packet []byte) error {
+	reader := bytes.NewReader(packet[4:])
+
+	var addrType uint32
+	var header sflowDatagramHeader
+
+	err := binary.Read(reader, binary.BigEndian, &addrType)
+
+	if err == nil {
+		agentAddrLen := int64(4)
+		if addrType == SFLOW_ADDRESS_TYPE_IPV6 {
+			agentAddrLen = 16
+		}
+
+		_, err = reader.Seek(agentAddrLen, io.SeekCurrent)
+	}
+
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &header)
+	}
+
+	if err != nil {
+		c.Malformed++
+		return fmt.Errorf("failed to decode sflow header from %s: %v", addr, err)
+	}
+
+	exporter := c.getExporter(addr, header.SubAgentId)
+	exporter.Packets++
+	exporter.Sampled = true
+
+	// The sflow sequence number counts datagrams
+	exporter.trackSequence(header.SequenceNumber, header.SequenceNumber+1)
+
+	for i := 0; i < int(header.NumSamples); i++ {
+		sample, format, err := readSflowStruct(reader)
+
+		if err == nil && format == SFLOW_FLOW_SAMPLE {
+			err = exporter.decodeSflowFlowSample(sample)
+		}
+
+		if err != nil {
+			c.Malformed++
+			return fmt.Errorf("failed to decode sflow sample %d from %s: %v", i, addr, err)
+		}
+	}
+
+	return nil
+}
+
+// Read the format, length and data of a sample or a flow record
+func readSflowStruct(reader *bytes.Reader) ([]byte, uint32, error) {
+	var format, length uint32
+
+	err := binary.Read(reader, binary.BigEndian, &format)
+
+	if err == nil {
+		err = binary.Read(reader, binary.BigEndian, &length)
+	}
+
+	if err == nil && int(length) > reader.Len() {
+		err = fmt.Errorf("invalid length %d", length)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+
+	return data, format, err
+}
+
+// Add the raw packet headers of a flow sample, a sampled packet stands for
+// sampling rate packets of the same size
+func (e *CollectorExporterState) decodeSflowFlowSample(sample []byte) error {
+	reader := bytes.NewReader(sample)
+
+	var header SflowFlowSampleHeader
+
+	err := binary.Read(reader, binary.BigEndian, &header)
+
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < int(header.NumRecords); i++ {
+		record, format, err := readSflowStruct(reader)
+
+		if err != nil {
+			return err
+		}
+
+		if format != SFLOW_RAW_PACKET_HEADER {
+			continue
+		}
+
+		var rawHeader SflowRawPacketHeader
+
+		err = binary.Read(bytes.NewReader(record), binary.BigEndian, &rawHeader)
+
+		if err != nil {
+			return err
+		}
+
+		headerStart := binary.Size(rawHeader)
+
+		if headerStart+int(rawHeader.HeaderLength) > len(record) {
+			return fmt.Errorf("invalid header length %d", rawHeader.HeaderLength)
+		}
+
+		if rawHeader.HeaderProtocol != SFLOW_HEADER_PROTO_ETH {
+			continue
+		}
+
+		packet, ok := DecodePcapPacket(PcapPacket{
+			LinkType: PCAP_LINKTYPE_ETHER,
+			Data:     record[headerStart : headerStart+int(rawHeader.HeaderLength)],
+		})
+
+		if !ok {
+			continue
+		}
+
+		key := CollectorFlowKey{
+			SrcAddr: packet.SrcAddr.String(),
+			SrcPort: packet.SrcPort,
+			DstAddr: packet.DstAddr.String(),
+			DstPort: packet.DstPort,
+			Proto:   packet.Proto,
+		}
+
+		e.addFlow(key, packet.Bytes*int(header.SamplingRate))
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testFlowRecord(srcAddr string, dstAddr string, srcPort uint16, dstPort uint16, proto uint8, packets uint32, octets uint32) FlowRecord {
+	var record FlowRecord
+
+	record.SetAddrs(srcAddr, dstAddr, "")
+	record.SrcPort = srcPort
+	record.DstPort = dstPort
+	record.IpProtocol = proto
+	record.NumPackets = packets
+	record.NumOctets = octets
+	record.SnmpInIndex = 1
+	record.SnmpOutIndex = 2
+
+	return record
+}
+
+func testClock() *HostClock {
+	clock := NewHostClock(0)
+	clock.SetSimTime(time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC).UnixNano())
+
+	return clock
+}
+
+// Decode the packets with a collector, all packets have to be valid
+func collectPackets(t *testing.T, packets [][]byte) *Collector {
+	t.Helper()
+
+	collector := NewCollector()
+
+	for i, packet := range packets {
+		err := collector.HandlePacket("10.0.0.3", packet)
+
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+
+	return collector
+}
+
+// The exporter of a collector that received the packets of a single host
+func collectedExporter(t *testing.T, collector *Collector, engineId uint32) *CollectorExporterState {
+	t.Helper()
+
+	if len(collector.Exporters) != 1 {
+		t.Fatalf("got %d exporters, want 1", len(collector.Exporters))
+	}
+
+	exporter, ok := collector.Exporters[collectorExporterKey("10.0.0.3", engineId)]
+
+	if !ok {
+		t.Fatalf("no exporter with engine id %d", engineId)
+	}
+
+	return exporter
+}
+
+// Check the flows of the exporter against the records, every record has
+// its own tuple
+func checkCollectedFlows(t *testing.T, exporter *CollectorExporterState, records []FlowRecord) {
+	t.Helper()
+
+	if len(exporter.Flows) != len(records) {
+		t.Errorf("got %d flows, want %d", len(exporter.Flows), len(records))
+	}
+
+	for _, record := range records {
+		key := CollectorFlowKey{
+			SrcAddr: record.SrcAddrString(),
+			SrcPort: record.SrcPort,
+			DstAddr: record.DstAddrString(),
+			DstPort: record.DstPort,
+			Proto:   int(record.IpProtocol),
+		}
+
+		total, ok := exporter.Flows[key]
+
+		if !ok {
+			t.Errorf("flow %+v not received", key)
+			continue
+		}
+
+		if total.Count != 1 || total.Bytes != int(record.NumOctets) {
+			t.Errorf("flow %+v: got %d records %d bytes, want 1 record %d bytes", key, total.Count, total.Bytes, record.NumOctets)
+		}
+	}
+}
+
+func TestCollectorNetflowV5RoundTrip(t *testing.T) {
+	records := []FlowRecord{
+		testFlowRecord("10.1.0.1", "10.2.0.1", 40000, 443, PROTO_TCP, 3, 1500),
+		testFlowRecord("10.1.0.2", "10.2.0.1", 53000, 53, PROTO_UDP, 1, 80),
+	}
+
+	exporter := NewNetflowV5Exporter(testClock(), 7)
+	collector := collectPackets(t, exporter.BuildPackets(records))
+
+	checkCollectedFlows(t, collectedExporter(t, collector, 7), records)
+}
+
+func TestCollectorSequenceGaps(t *testing.T) {
+	tests := []struct {
+		name        string
+		drop        int
+		wantLost    int
+		wantRecords int
+	}{
+		{"all packets", -1, 0, 6},
+		{"first packet lost", 0, 0, 4},
+		{"middle packet lost", 1, 2, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := NewNetflowV5Exporter(testClock(), 1)
+			collector := NewCollector()
+
+			for i := 0; i < 3; i++ {
+				packets := exporter.BuildPackets([]FlowRecord{
+					testFlowRecord("10.1.0.1", "10.2.0.1", 40000, uint16(i), PROTO_TCP, 1, 100),
+					testFlowRecord("10.1.0.2", "10.2.0.1", 40000, uint16(i), PROTO_TCP, 1, 100),
+				})
+
+				if i == test.drop {
+					continue
+				}
+
+				collector.HandlePacket("10.0.0.3", packets[0])
+			}
+
+			state := collectedExporter(t, collector, 1)
+
+			if state.LostRecords != test.wantLost || state.OutOfOrder != 0 {
+				t.Errorf("got %d lost records %d out of order, want %d lost records", state.LostRecords, state.OutOfOrder, test.wantLost)
+			}
+
+			if state.Records != test.wantRecords {
+				t.Errorf("got %d records, want %d", state.Records, test.wantRecords)
+			}
+		})
+	}
+}
+
+func TestCollectorMalformedPackets(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"too short", []byte{0, 5}},
+		{"truncated v5 record", NewNetflowV5Exporter(testClock(), 1).BuildPackets([]FlowRecord{
+			testFlowRecord("10.1.0.1", "10.2.0.1", 40000, 443, PROTO_TCP, 1, 100),
+		})[0][:30]},
+		{"v9 data without template", []byte{0, 9, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 1, 0, 0, 8, 0, 0, 0, 0}},
+		{"ipfix set longer than message", []byte{0, 10, 0, 20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 2, 0, 8}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			collector := NewCollector()
+
+			err := collector.HandlePacket("10.0.0.3", test.packet)
+
+			if err == nil || collector.Malformed != 1 {
+				t.Errorf("got error %v and %d malformed packets, want an error and 1 malformed packet", err, collector.Malformed)
+			}
+		})
+	}
+}
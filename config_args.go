@@ -8,24 +8,46 @@ import (
 )
 
 var opts struct {
-	Help           bool   `short:"h" long:"help" description:"show nflow-generator help"`
-	HostName       string `short:"i" long:"host-name" description:"provide host name to use with config file"`
-	ConfigFile     string `short:"e" long:"config-file" description:"provide config file to describe complex flow generation behavior"`
-	GenGraphFile   string `short:"g" long:"gen-graph-file" description:"generate graph file"`
-	DisableLogging bool   `short:"l" long:"disable-logging" description:"disable logging"`
-	Simulate       bool   `short:"m" long:"simulate" description:"simulate only, do not send to collector"`
-	StatsOutFile   string `short:"o" long:"stats-out-file" description:"write stats to file"`
-	GenComposeFile string `short:"q" long:"gen-compose-file" description:"generate compose file"`
-	GenTargetsFile string `short:"r" long:"gen-targets-file" description:"generate prometheus targets file"`
+	Help           bool    `short:"h" long:"help" description:"show nflow-generator help"`
+	HostName       string  `short:"i" long:"host-name" description:"provide host name to use with config file"`
+	ConfigFile     string  `short:"e" long:"config-file" description:"provide config file to describe complex flow generation behavior"`
+	GenGraphFile   string  `short:"g" long:"gen-graph-file" description:"generate graph file"`
+	DisableLogging bool    `short:"l" long:"disable-logging" description:"disable logging"`
+	Simulate       bool    `short:"m" long:"simulate" description:"simulate only, do not send to collector"`
+	StatsOutFile   string  `short:"o" long:"stats-out-file" description:"write stats to file"`
+	GenComposeFile string  `short:"q" long:"gen-compose-file" description:"generate compose file"`
+	GenTargetsFile string  `short:"r" long:"gen-targets-file" description:"generate prometheus targets file"`
+	Target         string  `short:"t" long:"target" description:"target ip address of the netflow collector, sends random flows without a config file"`
+	Port           int     `short:"p" long:"port" default:"9995" description:"port number of the target netflow collector"`
+	Spike          string  `short:"s" long:"spike" description:"run a second thread generating a spike for the specified protocol"`
+	FalseIndex     bool    `short:"f" long:"false-index" description:"generate false snmp index values of 1 or 2"`
+	FlowCount      int     `short:"c" long:"flow-count" default:"16" description:"number of flows to generate in each iteration"`
+	AllHosts       bool    `short:"a" long:"all-hosts" description:"simulate all hosts of the config file in this process"`
+	SourceMode     string  `long:"source-mode" choice:"bind" choice:"raw" description:"send from the ip of each host, by binding to a local alias or using a raw socket"`
+	ListenAddr     string  `long:"listen" description:"address to listen on in collect mode, defaults to the collector port of the config file"`
+	IdleTimeout    int     `long:"idle-timeout" default:"15" description:"seconds without packets after which collect mode stops"`
+	SnmpListen     string  `long:"snmp-listen" description:"answer SNMPv2c requests for the interfaces of the simulated hosts on this address, e.g. :161"`
+	BackfillStart  string  `long:"backfill-start" description:"generate the flows from this time on (RFC3339) faster than real time, with backdated timestamps"`
+	BackfillEnd    string  `long:"backfill-end" description:"end of the backfill (RFC3339), defaults to now"`
+	BackfillSpeed  float64 `long:"backfill-speed" default:"0" description:"speed-up factor of the backfill, 0 sends as fast as possible"`
+	TargetRate     float64 `long:"target-rate" description:"records per second of all hosts together, split in proportion to their flows, overrides target_rate of the config file"`
+	PcapOut        string  `long:"pcap-out" description:"write the export packets to this pcap file instead of sending them to the collector"`
+	ImportTimeout  int     `long:"import-flow-timeout" default:"60" description:"flow_timeout of the config file written by import-pcap, packets are aggregated in windows of this many seconds"`
+	ImportTop      int     `long:"import-top" description:"keep only this many flows with the most bytes in import-pcap, 0 keeps all"`
+	SnmpCommunity  string  `long:"snmp-community" default:"public" description:"community of the SNMP agent, <community>@<host> selects a host in all hosts mode"`
 }
 
+const COMMAND_COLLECT = "collect"
+
 type ConfigArgs struct {
 	ConfigFile string
 	HostName   string
+	Command    string
+	Args       []string
 }
 
 func ParseConfigArgs() (ConfigArgs, error) {
-	_, err := flags.Parse(&opts)
+	args, err := flags.Parse(&opts)
 
 	if err != nil {
 		return ConfigArgs{}, fmt.Errorf("failed to parse config args: %v", err)
@@ -45,9 +67,19 @@ func ParseConfigArgs() (ConfigArgs, error) {
 		inputHostName = os.Getenv("HOST_NAME")
 	}
 
+	// The first positional argument selects a command, the default is to
+	// generate flows
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+		args = args[1:]
+	}
+
 	return ConfigArgs{
 		ConfigFile: inputConfigFile,
 		HostName:   inputHostName,
+		Command:    command,
+		Args:       args,
 	}, nil
 }
 
@@ -61,16 +93,16 @@ Usage:
 
 Application Options:
   -t, --target= target ip address of the netflow collector
-  -p, --port=   port number of the target netflow collector
+  -p, --port=   port number of the target netflow collector. The default is 9995. (Optional)
   -s, --spike run a second thread generating a spike for the specified protocol
     protocol options are as follows:
         ftp - generates tcp/21
         ssh  - generates tcp/22
-        dns - generates udp/54
+        dns - generates udp/53
         http - generates tcp/80
         https - generates tcp/443
         ntp - generates udp/123
-        snmp - generates ufp/161
+        snmp - generates udp/161
         imaps - generates tcp/993
         mysql - generates tcp/3306
         https_alt - generates tcp/8080
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CONFIG_KEY_INCLUDE   = "include"
+	CONFIG_KEY_TEMPLATES = "templates"
+	CONFIG_KEY_EXTENDS   = "extends"
+)
+
+// Load a JSON or YAML config file with its includes and flow templates,
+// the result is the JSON of a single config file
+func LoadConfigDocument(filename string) ([]byte, error) {
+	doc, err := loadConfigFile(filename, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = expandFlowTemplates(doc)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+
+	// YAML numbers are accepted for the fields that are strings in JSON,
+	//  e.g. dst_port: 443
+	coerceConfigStrings(doc, reflect.TypeOf(ConfigFile{}))
+
+	byteValue, err := json.Marshal(doc)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", filename, err)
+	}
+
+	return byteValue, nil
+}
+
+// Read a config file and merge its includes, parents are the files that
+// include it, to detect include cycles
+func loadConfigFile(filename string, parents []string) (map[string]interface{}, error) {
+	absName, err := filepath.Abs(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file %s: %v", filename, err)
+	}
+
+	if FindIndex(absName, parents) != -1 {
+		return nil, fmt.Errorf("include cycle in config file %s", filename)
+	}
+
+	byteValue, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file %s: %v", filename, err)
+	}
+
+	doc, err := parseConfigDocument(filename, byteValue)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", filename, err)
+	}
+
+	includes, err := configIncludes(doc[CONFIG_KEY_INCLUDE])
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+
+	delete(doc, CONFIG_KEY_INCLUDE)
+
+	// Included files are merged in order, the including file last
+	merged := map[string]interface{}{}
+
+	for _, include := range includes {
+		// Includes are relative to the including file
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+
+		includeDoc, err := loadConfigFile(include, append(parents, absName))
+
+		if err != nil {
+			return nil, err
+		}
+
+		mergeConfigDocuments(merged, includeDoc)
+	}
+
+	mergeConfigDocuments(merged, doc)
+
+	return merged, nil
+}
+
+// Files ending in .yaml or .yml are YAML, all others JSON
+func parseConfigDocument(filename string, byteValue []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	if ext == ".yaml" || ext == ".yml" {
+		err := yaml.Unmarshal(byteValue, &doc)
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(byteValue))
+		decoder.UseNumber()
+
+		err := decoder.Decode(&doc)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// An empty YAML file is an empty config
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	return doc, nil
+}
+
+// The include setting is a file name or a list of file names
+func configIncludes(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		var includes []string
+
+		for _, include := range value {
+			name, ok := include.(string)
+
+			if !ok {
+				return nil, fmt.Errorf("include %v is not a file name", include)
+			}
+
+			includes = append(includes, name)
+		}
+
+		return includes, nil
+	}
+
+	return nil, fmt.Errorf("include %v is not a file name or a list of file names", value)
+}
+
+// Merge the settings of src into dst: lists are appended, maps are merged
+// and other settings of src replace those of dst
+func mergeConfigDocuments(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		switch value := value.(type) {
+		case []interface{}:
+			if list, ok := dst[key].([]interface{}); ok {
+				dst[key] = append(list, value...)
+				continue
+			}
+		case map[string]interface{}:
+			if m, ok := dst[key].(map[string]interface{}); ok {
+				for k, v := range value {
+					m[k] = v
+				}
+				continue
+			}
+		}
+
+		dst[key] = value
+	}
+}
+
+// Replace the flows that extend a template with the settings of the
+// template overridden by the settings of the flow
+func expandFlowTemplates(doc map[string]interface{}) error {
+	templates := map[string]interface{}{}
+
+	if value, ok := doc[CONFIG_KEY_TEMPLATES]; ok {
+		templates, ok = value.(map[string]interface{})
+
+		if !ok {
+			return fmt.Errorf("templates is not a map of flows")
+		}
+	}
+
+	delete(doc, CONFIG_KEY_TEMPLATES)
+
+	flows, _ := doc["flows"].([]interface{})
+
+	for i, value := range flows {
+		flow, ok := value.(map[string]interface{})
+
+		if !ok {
+			continue
+		}
+
+		expanded, err := extendFlowTemplate(flow, templates, nil)
+
+		if err != nil {
+			return fmt.Errorf("flow %d: %v", i, err)
+		}
+
+		flows[i] = expanded
+	}
+
+	return nil
+}
+
+// Settings of a flow after applying its template, templates can extend
+// other templates
+func extendFlowTemplate(flow map[string]interface{}, templates map[string]interface{}, names []string) (map[string]interface{}, error) {
+	value, ok := flow[CONFIG_KEY_EXTENDS]
+
+	if !ok {
+		return flow, nil
+	}
+
+	name, ok := value.(string)
+
+	if !ok {
+		return nil, fmt.Errorf("extends %v is not a template name", value)
+	}
+
+	if FindIndex(name, names) != -1 {
+		return nil, fmt.Errorf("template %s is part of an extends cycle", name)
+	}
+
+	template, ok := templates[name].(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("template %s not found", name)
+	}
+
+	base, err := extendFlowTemplate(template, templates, append(names, name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Settings of the flow replace those of the template as a whole, so
+	//  hops of a flow are not appended to the hops of the template
+	expanded := map[string]interface{}{}
+
+	for k, v := range base {
+		expanded[k] = v
+	}
+
+	for k, v := range flow {
+		expanded[k] = v
+	}
+
+	delete(expanded, CONFIG_KEY_EXTENDS)
+
+	return expanded, nil
+}
+
+// Convert numbers to strings for the fields of the config structs that
+// are strings, following the json tags of the structs
+func coerceConfigStrings(value interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		switch v := value.(type) {
+		case int:
+			return strconv.Itoa(v)
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case json.Number:
+			return v.String()
+		}
+	case reflect.Slice:
+		if list, ok := value.([]interface{}); ok {
+			for i := range list {
+				list[i] = coerceConfigStrings(list[i], t.Elem())
+			}
+		}
+	case reflect.Map:
+		if m, ok := value.(map[string]interface{}); ok {
+			for k := range m {
+				m[k] = coerceConfigStrings(m[k], t.Elem())
+			}
+		}
+	case reflect.Struct:
+		if m, ok := value.(map[string]interface{}); ok {
+			for i := 0; i < t.NumField(); i++ {
+				field := t.Field(i)
+				key := strings.Split(field.Tag.Get("json"), ",")[0]
+
+				if v, ok := m[key]; ok {
+					m[key] = coerceConfigStrings(v, field.Type)
+				}
+			}
+		}
+	}
+
+	return value
+}
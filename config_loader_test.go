@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeConfigDocuments(t *testing.T) {
+	tests := []struct {
+		name string
+		dst  map[string]interface{}
+		src  map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			"lists are appended",
+			map[string]interface{}{"flows": []interface{}{"a"}},
+			map[string]interface{}{"flows": []interface{}{"b", "c"}},
+			map[string]interface{}{"flows": []interface{}{"a", "b", "c"}},
+		},
+		{
+			"maps are merged",
+			map[string]interface{}{"templates": map[string]interface{}{"web": 1, "dns": 2}},
+			map[string]interface{}{"templates": map[string]interface{}{"dns": 3, "ssh": 4}},
+			map[string]interface{}{"templates": map[string]interface{}{"web": 1, "dns": 3, "ssh": 4}},
+		},
+		{
+			"settings are replaced",
+			map[string]interface{}{"seed": 1, "flow_timeout": 60},
+			map[string]interface{}{"seed": 2},
+			map[string]interface{}{"seed": 2, "flow_timeout": 60},
+		},
+		{
+			"new settings are added",
+			map[string]interface{}{},
+			map[string]interface{}{"hosts": []interface{}{"gw1"}},
+			map[string]interface{}{"hosts": []interface{}{"gw1"}},
+		},
+		{
+			"a list replaces another type",
+			map[string]interface{}{"hosts": "gw1"},
+			map[string]interface{}{"hosts": []interface{}{"gw2"}},
+			map[string]interface{}{"hosts": []interface{}{"gw2"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mergeConfigDocuments(test.dst, test.src)
+
+			if !reflect.DeepEqual(test.dst, test.want) {
+				t.Errorf("got %v, want %v", test.dst, test.want)
+			}
+		})
+	}
+}
+
+func TestExtendFlowTemplate(t *testing.T) {
+	templates := map[string]interface{}{
+		"web": map[string]interface{}{
+			"dst_port": "443",
+			"proto":    "tcp",
+			"hops":     []interface{}{"gw1"},
+		},
+		"web-dmz": map[string]interface{}{
+			"extends":  "web",
+			"dst_addr": "10.2.0.0/24",
+		},
+		"loop-a": map[string]interface{}{"extends": "loop-b"},
+		"loop-b": map[string]interface{}{"extends": "loop-a"},
+	}
+
+	tests := []struct {
+		name    string
+		flow    map[string]interface{}
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			"no template",
+			map[string]interface{}{"dst_port": "53"},
+			map[string]interface{}{"dst_port": "53"},
+			"",
+		},
+		{
+			"flow settings replace the template",
+			map[string]interface{}{"extends": "web", "dst_port": "8443", "hops": []interface{}{"gw2"}},
+			map[string]interface{}{"dst_port": "8443", "proto": "tcp", "hops": []interface{}{"gw2"}},
+			"",
+		},
+		{
+			"template extends a template",
+			map[string]interface{}{"extends": "web-dmz", "src_addr": "10.1.0.1"},
+			map[string]interface{}{"dst_port": "443", "proto": "tcp", "hops": []interface{}{"gw1"}, "dst_addr": "10.2.0.0/24", "src_addr": "10.1.0.1"},
+			"",
+		},
+		{"unknown template", map[string]interface{}{"extends": "ssh"}, nil, "template ssh not found"},
+		{"extends cycle", map[string]interface{}{"extends": "loop-a"}, nil, "extends cycle"},
+		{"extends not a name", map[string]interface{}{"extends": 1}, nil, "not a template name"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expanded, err := extendFlowTemplate(test.flow, templates, nil)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if !reflect.DeepEqual(expanded, test.want) {
+				t.Errorf("got %v, want %v", expanded, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDocumentIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"hosts.json": `{"hosts": [{"name": "gw1", "ip": "10.0.0.3"}], "seed": 1}`,
+		"config.yaml": "include: hosts.json\n" +
+			"seed: 2\n" +
+			"templates:\n  web: {dst_port: 443, proto: tcp}\n" +
+			"flows:\n  - {extends: web, src_addr: 10.1.0.1, dst_addr: 10.2.0.1}\n",
+		"loop.yaml": "include: loop.yaml\n",
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byteValue, err := LoadConfigDocument(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	var config ConfigFile
+	if err := json.Unmarshal(byteValue, &config); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	// The including file is merged last, YAML numbers become strings
+	if config.Seed != 2 || len(config.Hosts) != 1 || len(config.Flows) != 1 {
+		t.Fatalf("got seed %d %d hosts %d flows, want seed 2 1 host 1 flow", config.Seed, len(config.Hosts), len(config.Flows))
+	}
+
+	if config.Flows[0].DstPort != "443" || config.Flows[0].Proto != "tcp" {
+		t.Errorf("got dst_port %q proto %q, want the settings of the template", config.Flows[0].DstPort, config.Flows[0].Proto)
+	}
+
+	_, err = LoadConfigDocument(filepath.Join(dir, "loop.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("got error %v, want an include cycle", err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+const (
+	EXPORT_FORMAT_NETFLOW5 = "netflow5"
+	EXPORT_FORMAT_NETFLOW9 = "netflow9"
+	EXPORT_FORMAT_IPFIX    = "ipfix"
+	EXPORT_FORMAT_SFLOW    = "sflow"
+)
+
+const (
+	TRANSPORT_UDP = "udp"
+	TRANSPORT_TCP = "tcp"
+)
+
+// Netflow v5 sampling interval field, the mode is in the top 2 bits and
+// the interval in the lower 14 bits
+const (
+	NFV5_SAMPLING_MODE_DETERMINISTIC = 0x4000
+	NFV5_SAMPLING_INTERVAL_MAX       = 0x3fff
+)
+
+// Encodes a batch of flow records into export packets, sflow splits the
+// samples of a batch into several datagrams
+type Exporter interface {
+	BuildPackets(records []FlowRecord) [][]byte
+}
+
+// Netflow v5 exporter state, one per simulated host
+type NetflowV5Exporter struct {
+	Clock        *HostClock
+	EngineId     uint8
+	SamplingRate int
+
+	// Counter of flow records that have been sent
+	flowSequence uint32
+}
+
+func NewNetflowV5Exporter(clock *HostClock, engineId uint8) *NetflowV5Exporter {
+	return &NetflowV5Exporter{
+		Clock:    clock,
+		EngineId: engineId,
+	}
+}
+
+func (e *NetflowV5Exporter) BuildPacket(records []FlowRecord) []byte {
+	data := new(Netflow)
+
+	// The v5 sequence number is the number of flows sent before this packet
+	data.Header = CreateNFlowHeader(len(records), e.Clock, e.flowSequence, e.EngineId)
+	e.flowSequence += uint32(len(records))
+
+	if e.SamplingRate > 1 {
+		data.Header.SampleInterval = uint16(NFV5_SAMPLING_MODE_DETERMINISTIC | e.SamplingRate)
+	}
+
+	for _, record := range records {
+		data.Records = append(data.Records, record.NetflowPayload)
+	}
+
+	buffer := BuildNFlowPayload(*data)
+
+	return buffer.Bytes()
+}
+
+func (e *NetflowV5Exporter) BuildPackets(records []FlowRecord) [][]byte {
+	return [][]byte{e.BuildPacket(records)}
+}
+
+// Export format of a host, hosts can override the format of the config file
+// so netflow and sflow exporters can be mixed in one topology
+func HostExportFormat(config ConfigFile, hostName string) string {
+	for _, host := range config.Hosts {
+		if host.Name == hostName && host.ExportFormat != "" {
+			return host.ExportFormat
+		}
+	}
+
+	return config.ExportFormat
+}
+
+// Netflow v5 carries the source id of a host as the 8-bit engine id, a
+// configured source id has to fit
+func ValidateHostSourceId(config ConfigFile, hostName string) error {
+	format := HostExportFormat(config, hostName)
+
+	if format != EXPORT_FORMAT_NETFLOW5 && format != "" {
+		return nil
+	}
+
+	for _, host := range config.Hosts {
+		if host.Name == hostName && host.SourceId > math.MaxUint8 {
+			return fmt.Errorf("invalid source id %d: netflow5 engine ids must not be greater than %d", host.SourceId, math.MaxUint8)
+		}
+	}
+
+	return nil
+}
+
+// Engine id the host exports, the default source id of netflow5 hosts
+// wraps at 256 so topologies with more hosts still load
+func HostEngineId(config ConfigFile, hostName string) uint32 {
+	sourceId := FindHostSourceId(config.Hosts, hostName)
+
+	format := HostExportFormat(config, hostName)
+
+	if format == EXPORT_FORMAT_NETFLOW5 || format == "" {
+		return sourceId & math.MaxUint8
+	}
+
+	return sourceId
+}
+
+// Collector port of a host, sflow can be sent to a separate port
+func HostCollectorPort(config ConfigFile, hostName string) int {
+	if HostExportFormat(config, hostName) == EXPORT_FORMAT_SFLOW && config.SflowCollectorPort != 0 {
+		return config.SflowCollectorPort
+	}
+
+	return config.CollectorPort
+}
+
+// Open the connection to the collector using the configured transport
+func InitCollectorConn(config ConfigFile, hostName string, localIp string) (net.Conn, error) {
+	config.CollectorPort = HostCollectorPort(config, hostName)
+
+	switch config.CollectorTransport {
+	case TRANSPORT_UDP:
+		return InitUdpConn(config, localIp)
+	case TRANSPORT_TCP:
+		return InitTcpConn(config, localIp)
+	default:
+		return nil, fmt.Errorf("unknown collector transport %s", config.CollectorTransport)
+	}
+}
+
+func NewExporter(config ConfigFile, hostName string, clock *HostClock) (Exporter, error) {
+	exportFormat := HostExportFormat(config, hostName)
+
+	if config.CollectorTransport == TRANSPORT_TCP && exportFormat != EXPORT_FORMAT_IPFIX {
+		return nil, fmt.Errorf("tcp transport is only supported for ipfix, not %s", exportFormat)
+	}
+
+	samplingRate := FindHostSamplingRate(config.Hosts, hostName)
+
+	switch exportFormat {
+	case EXPORT_FORMAT_NETFLOW5:
+		if samplingRate > NFV5_SAMPLING_INTERVAL_MAX {
+			return nil, fmt.Errorf("sampling rate %d of host %s is too large for %s", samplingRate, hostName, exportFormat)
+		}
+
+		exporter := NewNetflowV5Exporter(clock, uint8(HostEngineId(config, hostName)))
+		exporter.SamplingRate = samplingRate
+
+		return exporter, nil
+	case EXPORT_FORMAT_NETFLOW9:
+		exporter := NewNetflowV9Exporter(
+			clock,
+			FindHostSourceId(config.Hosts, hostName),
+			config.TemplateRefreshPackets,
+			time.Duration(config.TemplateRefreshSeconds)*time.Second,
+		)
+		exporter.SamplingRate = samplingRate
+
+		return exporter, nil
+	case EXPORT_FORMAT_IPFIX:
+		var exporter *IpfixExporter
+
+		// Over TCP the template is only sent once at the start of the session
+		if config.CollectorTransport == TRANSPORT_TCP {
+			exporter = NewIpfixExporter(clock, FindHostSourceId(config.Hosts, hostName), 0, 0)
+		} else {
+			exporter = NewIpfixExporter(
+				clock,
+				FindHostSourceId(config.Hosts, hostName),
+				config.TemplateRefreshPackets,
+				time.Duration(config.TemplateRefreshSeconds)*time.Second,
+			)
+		}
+
+		exporter.SamplingRate = samplingRate
+
+		return exporter, nil
+	case EXPORT_FORMAT_SFLOW:
+		// The sampling rate of the host overrides the sflow sampling rate
+		if samplingRate <= 1 {
+			samplingRate = config.SflowSamplingRate
+		}
+
+		exporter := NewSflowExporter(
+			clock,
+			FindHostIp(config.Hosts, hostName),
+			FindHostSourceId(config.Hosts, hostName),
+			samplingRate,
+			time.Duration(config.SflowCounterSeconds)*time.Second,
+		)
+
+		host, _ := FindHost(config.Hosts, hostName)
+		exporter.InterfaceSpeeds = HostInterfaceSpeeds(host)
+
+		return exporter, nil
+	default:
+		return nil, fmt.Errorf("unknown export format %s", exportFormat)
+	}
+}
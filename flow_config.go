@@ -8,44 +8,87 @@ import (
 )
 
 type ConfigFlow struct {
-	SrcAddr   string
-	SrcPort   uint16
-	DstAddr   string
-	DstPort   uint16
-	Proto     int
-	Bytes     int
-	Hops      []string
-	Count     int
-	Tick      int
-	HostIndex int
+	SrcAddr string
+	SrcPort uint16
+	DstAddr string
+	DstPort uint16
+	Proto   int
+	Bytes   int
+	Hops    []string
+	Count   int
+	Tick    int
+	Fields  FlowFieldRanges
+
+	BytesDistribution *ConfigBytesDistribution
+
+	// Flows with a duration are long-lived flows, see FlowLifecycle
+	Duration  ValueRange
+	Lifecycle FlowLifecycle
+
+	// Address translation of each hop and the resulting tuple at each hop,
+	// both are nil for flows without translation
+	Nat       []HopNat
+	HopTuples []HopTuple
+
+	// Packet loss of each hop and the resulting volume at each hop for the
+	// current tick, both are nil for flows without loss
+	HopDrops   []float64
+	HopVolumes []HopVolume
+
+	// Traffic profile of the flow and whether the profile or the weight
+	// skips the flow in the current tick, nil for flows without a profile
+	Profile     *ConfigTrafficProfile
+	ProfileSkip bool
+
+	// Weight of the flow among the flows of its entry, see ApplyWeight
+	Weighted bool
+	Weight   float64
+	WeightBy string
+
+	// Schedule of flows injected by a scenario, nil for the flows of the
+	// config file
+	Scenario *FlowScenario
+
+	// Reply flows of bidirectional flows follow their forward flow
+	Reply         bool
+	ForwardIndex  int
+	ResponseRatio float64
+
+	// Record field values for the current tick
+	FieldValues FlowFieldValues
 }
 
+// Flow that passes through a host, HostIndex is the position of the host
+// in the hops of the flow
 type EnabledConfigFlow struct {
 	ConfigIndex int
+	HostIndex   int
 }
 
 type ConfigFlowMultiple struct {
-	SrcAddr []string
-	SrcPort []uint16
-	DstAddr []string
-	DstPort []uint16
-	Proto   []int
-	Hops    []string
-	Count   int
-}
-
-func ParseUserIpInput(input string) []string {
-	if strings.Contains(input, "/") {
-		ips, err := GetCidrHosts(input)
-
-		if err != nil {
-			panic(err)
-		}
-
-		return ips
-	} else {
-		return []string{input}
-	}
+	Tuples TupleSpace
+	Hops   []string
+	Count  int
+	Fields FlowFieldRanges
+
+	// Only the first MaxFlows tuples or Sample random tuples are expanded,
+	// the sampled tuples are picked with SampleRandGen
+	MaxFlows      int
+	Sample        int
+	SampleRandGen *rand.Rand
+
+	Weights  []ConfigFlowWeight
+	WeightBy string
+
+	BytesDistribution *ConfigBytesDistribution
+	Duration          ValueRange
+	Bidirectional     bool
+	ResponseRatio     float64
+	Nat               []HopNat
+	HopDrops          []float64
+	ReturnHops        []string
+	ReturnHopDrops    []float64
+	Profile           *ConfigTrafficProfile
 }
 
 func ParseUserProtoInput(input string) []int {
@@ -102,6 +145,16 @@ func ParseUserPortInput(input string) []uint16 {
 	return portSlice
 }
 
+// Protocols whose flows have ports
+func ProtoHasPorts(proto int) bool {
+	switch proto {
+	case PROTO_TCP, PROTO_UDP, PROTO_SCTP:
+		return true
+	}
+
+	return false
+}
+
 func ParseUserFlows(config *ConfigFile) []ConfigFlowMultiple {
 	var multiFlowConfigs []ConfigFlowMultiple
 
@@ -111,49 +164,113 @@ func ParseUserFlows(config *ConfigFile) []ConfigFlowMultiple {
 
 		multiFlowConfig := new(ConfigFlowMultiple)
 
-		multiFlowConfig.SrcAddr = ParseUserIpInput(flow.SrcAddr)
-		multiFlowConfig.DstAddr = ParseUserIpInput(flow.DstAddr)
+		multiFlowConfig.Tuples = TupleSpace{
+			SrcAddr: ParseUserAddrSpace(flow.SrcAddr),
+			DstAddr: ParseUserAddrSpace(flow.DstAddr),
+			SrcPort: ParseUserPortInput(flow.SrcPort),
+			DstPort: ParseUserPortInput(flow.DstPort),
+			Proto:   ParseUserProtoInput(flow.Proto),
+		}
+
+		if flow.MaxFlows < 0 || flow.Sample < 0 {
+			panic(fmt.Errorf("invalid max_flows %d or sample %d: must not be negative", flow.MaxFlows, flow.Sample))
+		}
+
+		multiFlowConfig.Weights = flow.Weights
+		multiFlowConfig.WeightBy = flow.WeightBy
+
+		multiFlowConfig.MaxFlows = flow.MaxFlows
+		multiFlowConfig.Sample = flow.Sample
+
+		if flow.Sample > 0 {
+			multiFlowConfig.SampleRandGen = InitSampleRandGen(*config, i)
+		}
+
+		multiFlowConfig.Hops, multiFlowConfig.Nat, multiFlowConfig.HopDrops = ParseUserHops(flow.Hops)
 
-		multiFlowConfig.SrcPort = ParseUserPortInput(flow.SrcPort)
-		multiFlowConfig.DstPort = ParseUserPortInput(flow.DstPort)
+		if len(flow.ReturnHops) > 0 {
+			var returnNat []HopNat
 
-		multiFlowConfig.Proto = ParseUserProtoInput(flow.Proto)
+			multiFlowConfig.ReturnHops, returnNat, multiFlowConfig.ReturnHopDrops = ParseUserHops(flow.ReturnHops)
 
-		multiFlowConfig.Hops = flow.Hops
+			if returnNat != nil {
+				panic(fmt.Errorf("invalid return_hops: address translation is only supported in hops"))
+			}
+		}
 		multiFlowConfig.Count = flow.Count
 
+		multiFlowConfig.Fields = ParseUserFieldRanges(flow)
+
+		// Prefix masks default to the prefix length of a cidr
+		if !multiFlowConfig.Fields.SrcMask.Set {
+			multiFlowConfig.Fields.SrcMask = ParseUserPrefixMask(flow.SrcAddr)
+		}
+		if !multiFlowConfig.Fields.DstMask.Set {
+			multiFlowConfig.Fields.DstMask = ParseUserPrefixMask(flow.DstAddr)
+		}
+
+		multiFlowConfig.Duration = ParseUserRangeInput("duration", flow.Duration, 0, 1<<31-1)
+
+		multiFlowConfig.Bidirectional = flow.Bidirectional
+		multiFlowConfig.ResponseRatio = flow.ResponseRatio
+
+		if multiFlowConfig.ResponseRatio == 0 {
+			multiFlowConfig.ResponseRatio = 1
+		} else if multiFlowConfig.ResponseRatio < 0 {
+			panic(fmt.Errorf("invalid response_ratio %v: must be greater than 0", flow.ResponseRatio))
+		}
+
+		multiFlowConfig.BytesDistribution = config.BytesDistribution
+		if flow.BytesDistribution != nil {
+			multiFlowConfig.BytesDistribution = flow.BytesDistribution
+		}
+
+		profileName := config.Profile
+		if flow.Profile != "" {
+			profileName = flow.Profile
+		}
+
+		if profileName != "" {
+			multiFlowConfig.Profile = config.Profiles[profileName]
+		}
+
 		multiFlowConfigs = append(multiFlowConfigs, *multiFlowConfig)
 	}
 
 	return multiFlowConfigs
 }
 
-func SeedFlows(flowConfigs []ConfigFlow, randGen *rand.Rand, configArgs ConfigArgs, config ConfigFile) {
+func SeedFlows(flowConfigs []ConfigFlow, randGen *rand.Rand, config ConfigFile) {
 	for i := 0; i < len(flowConfigs); i++ {
 		flowConfig := flowConfigs[i]
 
+		if flowConfig.Reply {
+			flowConfigs[i].SeedReply(flowConfigs[flowConfig.ForwardIndex])
+			flowConfigs[i].SeedReplyNat(flowConfigs[flowConfig.ForwardIndex])
+			continue
+		}
+
 		if flowConfig.SrcAddr == "" {
-			flowConfigs[i].SrcAddr = ConvertIntToIp(randGen.Uint32()).String()
+			flowConfigs[i].SrcAddr = GenRandAddr(randGen, flowConfig.DstAddr)
 		}
 		if flowConfig.DstAddr == "" {
-			flowConfigs[i].DstAddr = ConvertIntToIp(randGen.Uint32()).String()
+			flowConfigs[i].DstAddr = GenRandAddr(randGen, flowConfig.SrcAddr)
 		}
-		if flowConfig.SrcPort == 0 {
+		if flowConfig.Proto == 0 {
+			flowConfigs[i].Proto = 6
+		}
+		// Flows of protocols without ports, like icmp, keep port 0
+		if flowConfig.SrcPort == 0 && ProtoHasPorts(flowConfigs[i].Proto) {
 			flowConfigs[i].SrcPort = uint16(randGen.Intn(65535))
 		}
-		if flowConfig.DstPort == 0 {
+		if flowConfig.DstPort == 0 && ProtoHasPorts(flowConfigs[i].Proto) {
 			flowConfigs[i].DstPort = uint16(randGen.Intn(65535))
 		}
-		if flowConfig.Proto == 0 {
-			flowConfigs[i].Proto = 6
-		}
 		// Bytes are initialized during the sending of the flow
 
 		flowConfigs[i].Tick = randGen.Intn(config.FlowTimeout)
 
-		hostIndex := FindIndex(configArgs.HostName, flowConfig.Hops)
-
-		flowConfigs[i].HostIndex = hostIndex
+		flowConfigs[i].SeedNat(randGen)
 	}
 }
 
@@ -161,23 +278,51 @@ func ExpandMultiFlows(multiFlowConfigs []ConfigFlowMultiple) []ConfigFlow {
 	var expandedFlowConfigs []ConfigFlow
 
 	for i := 0; i < len(multiFlowConfigs); i++ {
-		for _, srcAddr := range multiFlowConfigs[i].SrcAddr {
-			for _, dstAddr := range multiFlowConfigs[i].DstAddr {
-				for _, srcPort := range multiFlowConfigs[i].SrcPort {
-					for _, dstPort := range multiFlowConfigs[i].DstPort {
-						for _, proto := range multiFlowConfigs[i].Proto {
-							flow := new(ConfigFlow)
-							flow.SrcAddr = srcAddr
-							flow.DstAddr = dstAddr
-							flow.SrcPort = srcPort
-							flow.DstPort = dstPort
-							flow.Proto = proto
-							flow.Hops = multiFlowConfigs[i].Hops
-							flow.Count = multiFlowConfigs[i].Count
-							expandedFlowConfigs = append(expandedFlowConfigs, *flow)
-						}
-					}
-				}
+		tuples := multiFlowConfigs[i].Tuples
+
+		// Tuples are computed from their index instead of listing the
+		//  addresses of the cidrs
+		indexes := tuples.Indexes(multiFlowConfigs[i].MaxFlows, multiFlowConfigs[i].Sample, multiFlowConfigs[i].SampleRandGen)
+
+		var weights []float64
+		if len(multiFlowConfigs[i].Weights) > 0 {
+			weights = FlowWeights(multiFlowConfigs[i], indexes)
+		}
+
+		for j, index := range indexes {
+			flow := new(ConfigFlow)
+			flow.SrcAddr = tuples.SrcAddr.At(index[0])
+			flow.DstAddr = tuples.DstAddr.At(index[1])
+			flow.SrcPort = tuples.SrcPort[index[2]]
+			flow.DstPort = tuples.DstPort[index[3]]
+			flow.Proto = tuples.Proto[index[4]]
+			flow.Hops = multiFlowConfigs[i].Hops
+			flow.Count = multiFlowConfigs[i].Count
+			flow.Fields = multiFlowConfigs[i].Fields
+			flow.BytesDistribution = multiFlowConfigs[i].BytesDistribution
+			flow.Duration = multiFlowConfigs[i].Duration
+			flow.Nat = multiFlowConfigs[i].Nat
+			flow.HopDrops = multiFlowConfigs[i].HopDrops
+			flow.Profile = multiFlowConfigs[i].Profile
+
+			// Replies follow the bytes and the skips of their request
+			if weights != nil {
+				flow.Weighted = true
+				flow.Weight = weights[j]
+				flow.WeightBy = multiFlowConfigs[i].WeightBy
+			}
+
+			expandedFlowConfigs = append(expandedFlowConfigs, *flow)
+
+			if multiFlowConfigs[i].Bidirectional {
+				reply := NewReplyFlow(
+					*flow,
+					len(expandedFlowConfigs)-1,
+					multiFlowConfigs[i].ResponseRatio,
+					multiFlowConfigs[i].ReturnHops,
+					multiFlowConfigs[i].ReturnHopDrops,
+				)
+				expandedFlowConfigs = append(expandedFlowConfigs, reply)
 			}
 		}
 	}
@@ -185,15 +330,24 @@ func ExpandMultiFlows(multiFlowConfigs []ConfigFlowMultiple) []ConfigFlow {
 	return expandedFlowConfigs
 }
 
-func FilterEnabledFlows(flowConfigs []ConfigFlow) []EnabledConfigFlow {
+// Flows sent once every flow_timeout, scenarios and long-lived flows are
+// sent on their own schedule
+func (f *ConfigFlow) Periodic() bool {
+	return f.Scenario == nil && !f.Duration.Set
+}
+
+func FilterEnabledFlows(flowConfigs []ConfigFlow, hostName string) []EnabledConfigFlow {
 	var enabledFlows []EnabledConfigFlow
 
 	for i := 0; i < len(flowConfigs); i++ {
 		flowConfig := flowConfigs[i]
 
-		if flowConfig.HostIndex != -1 {
+		hostIndex := FindIndex(hostName, flowConfig.Hops)
+
+		if hostIndex != -1 {
 			enabledFlow := new(EnabledConfigFlow)
 			enabledFlow.ConfigIndex = i
+			enabledFlow.HostIndex = hostIndex
 
 			enabledFlows = append(enabledFlows, *enabledFlow)
 		}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Packets are derived from bytes using this packet size when the packet
+// count of a flow is not configured
+const DEFAULT_MAX_PACKET_SIZE = 1500
+
+// Inclusive range of values for a record field, a new value is picked every
+// tick unless Min == Max
+type ValueRange struct {
+	Set bool
+	Min int
+	Max int
+}
+
+// Configured ranges for the record fields of a flow
+type FlowFieldRanges struct {
+	Packets  ValueRange
+	TcpFlags ValueRange
+	Tos      ValueRange
+	SrcAs    ValueRange
+	DstAs    ValueRange
+	SrcMask  ValueRange
+	DstMask  ValueRange
+}
+
+// Record field values of a flow for the current tick, only the fields that
+// are configured are used, see FlowFieldRanges
+type FlowFieldValues struct {
+	Ranges   FlowFieldRanges
+	Packets  int
+	TcpFlags int
+	Tos      int
+	SrcAs    int
+	DstAs    int
+	SrcMask  int
+	DstMask  int
+}
+
+var tcpFlagNames = map[string]int{
+	"FIN": 0x01,
+	"SYN": 0x02,
+	"RST": 0x04,
+	"PSH": 0x08,
+	"ACK": 0x10,
+	"URG": 0x20,
+	"ECE": 0x40,
+	"CWR": 0x80,
+}
+
+func parseRangeValue(name string, input string) (int, error) {
+	value, err := strconv.ParseInt(strings.TrimSpace(input), 0, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s %s: %v", name, input, err)
+	}
+
+	return int(value), nil
+}
+
+// Parse a value ("10") or range ("10-20") from the config file
+func ParseUserRangeInput(name string, input string, min int, max int) ValueRange {
+	if input == "" {
+		return ValueRange{}
+	}
+
+	valueRange := ValueRange{Set: true}
+
+	var err error
+
+	if parts := strings.SplitN(input, "-", 2); len(parts) == 2 {
+		valueRange.Min, err = parseRangeValue(name, parts[0])
+
+		if err != nil {
+			panic(err)
+		}
+
+		valueRange.Max, err = parseRangeValue(name, parts[1])
+
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		valueRange.Min, err = parseRangeValue(name, input)
+
+		if err != nil {
+			panic(err)
+		}
+
+		valueRange.Max = valueRange.Min
+	}
+
+	if valueRange.Min > valueRange.Max {
+		panic(fmt.Errorf("invalid %s range %s: start is greater than end", name, input))
+	}
+
+	if valueRange.Min < min || valueRange.Max > max {
+		panic(fmt.Errorf("invalid %s %s: must be between %d and %d", name, input, min, max))
+	}
+
+	return valueRange
+}
+
+// Parse tcp flags given as a number, a range or flag names ("SYN|ACK")
+func ParseUserTcpFlagsInput(input string) ValueRange {
+	if input == "" || strings.ContainsAny(input, "0123456789") {
+		return ParseUserRangeInput("tcp_flags", input, 0, 255)
+	}
+
+	flags := 0
+
+	for _, name := range strings.FieldsFunc(input, func(r rune) bool { return r == '|' || r == ',' }) {
+		flag, ok := tcpFlagNames[strings.ToUpper(strings.TrimSpace(name))]
+
+		if !ok {
+			panic(fmt.Errorf("unknown tcp flag %s", name))
+		}
+
+		flags |= flag
+	}
+
+	return ValueRange{Set: true, Min: flags, Max: flags}
+}
+
+func ParseUserFieldRanges(flow ConfigFlowUser) FlowFieldRanges {
+	// Masks are prefix lengths in the address family of the flow
+	maxMask := 32
+	if FlowIsIPv6(flow) {
+		maxMask = 128
+	}
+
+	return FlowFieldRanges{
+		Packets:  ParseUserRangeInput("packets", flow.Packets, 1, 1<<31-1),
+		TcpFlags: ParseUserTcpFlagsInput(flow.TcpFlags),
+		Tos:      ParseUserRangeInput("tos", flow.Tos, 0, 255),
+		SrcAs:    ParseUserRangeInput("src_as", flow.SrcAs, 0, UINT16_MAX),
+		DstAs:    ParseUserRangeInput("dst_as", flow.DstAs, 0, UINT16_MAX),
+		SrcMask:  ParseUserRangeInput("src_mask", flow.SrcMask, 0, maxMask),
+		DstMask:  ParseUserRangeInput("dst_mask", flow.DstMask, 0, maxMask),
+	}
+}
+
+// Prefix length of a cidr as a constant range, unset for plain addresses
+func ParseUserPrefixMask(input string) ValueRange {
+	prefix, err := netip.ParsePrefix(input)
+
+	if err != nil {
+		return ValueRange{}
+	}
+
+	return ValueRange{Set: true, Min: prefix.Bits(), Max: prefix.Bits()}
+}
+
+// Pick the value of a range, the seeded random generator is only used for
+// actual ranges so configs without ranges keep their random sequence
+func (r ValueRange) Gen(randGen *rand.Rand) int {
+	if r.Min == r.Max {
+		return r.Min
+	}
+
+	return r.Min + randGen.Intn(r.Max-r.Min+1)
+}
+
+func GenFlowFieldValues(ranges FlowFieldRanges, randGen *rand.Rand) FlowFieldValues {
+	return FlowFieldValues{
+		Ranges:   ranges,
+		Packets:  ranges.Packets.Gen(randGen),
+		TcpFlags: ranges.TcpFlags.Gen(randGen),
+		Tos:      ranges.Tos.Gen(randGen),
+		SrcAs:    ranges.SrcAs.Gen(randGen),
+		DstAs:    ranges.DstAs.Gen(randGen),
+		SrcMask:  ranges.SrcMask.Gen(randGen),
+		DstMask:  ranges.DstMask.Gen(randGen),
+	}
+}
+
+// Packet count matching a byte count when the packets are not configured
+func DerivePackets(bytes int) int {
+	packets := (bytes + DEFAULT_MAX_PACKET_SIZE - 1) / DEFAULT_MAX_PACKET_SIZE
+
+	if packets < 1 {
+		packets = 1
+	}
+
+	return packets
+}
+
+// Overwrite the record fields that are configured for the flow
+func ApplyFlowFieldValues(payload *NetflowPayload, values FlowFieldValues) {
+	if values.Ranges.Packets.Set {
+		payload.NumPackets = uint32(values.Packets)
+	}
+	if values.Ranges.TcpFlags.Set {
+		payload.TcpFlags = uint8(values.TcpFlags)
+	}
+	if values.Ranges.Tos.Set {
+		payload.IpTos = uint8(values.Tos)
+	}
+	if values.Ranges.SrcAs.Set {
+		payload.SrcAsNumber = uint16(values.SrcAs)
+	}
+	if values.Ranges.DstAs.Set {
+		payload.DstAsNumber = uint16(values.DstAs)
+	}
+	if values.Ranges.SrcMask.Set {
+		payload.SrcPrefixMask = uint8(values.SrcMask)
+	}
+	if values.Ranges.DstMask.Set {
+		payload.DstPrefixMask = uint8(values.DstMask)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Each hop sees the packets of a flow this much later than the previous hop
+const FLOW_HOP_DELAY_MS = 1
+
+// Packets of a long-lived flow that are exported in one record
+type FlowChunk struct {
+	StartMs int64
+	EndMs   int64
+	Bytes   int
+	Packets int
+}
+
+// State of a long-lived flow, a flow with a duration sends packets every
+// tick until the duration has passed and is exported in chunks like a
+// router does: after the active timeout while the flow is active and after
+// the inactive timeout once the flow has ended.
+// The state is advanced once per tick for all flows by every generator so
+// all hops of a flow export the same chunks
+type FlowLifecycle struct {
+	Sessions       int
+	SessionSeconds int
+	Active         bool
+	remainingTicks int
+
+	// Chunk that is not exported yet
+	chunkOpen    bool
+	chunk        FlowChunk
+	lastPacketMs int64
+
+	// Chunk exported in the current tick
+	Exporting bool
+	Export    FlowChunk
+}
+
+// Milliseconds since the unix epoch of a tick, ticks are counted from the
+// aligned start time so all generators use the same timestamps
+func TickUnixMillis(sendStart time.Time, absTick int) int64 {
+	return sendStart.UnixNano()/int64(time.Millisecond) + int64(absTick)*TICK_INTERVAL_MS
+}
+
+func (l *FlowLifecycle) export() {
+	l.Exporting = true
+	l.Export = l.chunk
+	l.chunkOpen = false
+	l.chunk = FlowChunk{}
+}
+
+// All sessions of the flow have ended and have been exported
+func (l *FlowLifecycle) Done(count int) bool {
+	return !l.Active && !l.chunkOpen && count != 0 && l.Sessions >= count
+}
+
+// Advance the state of a long-lived flow by one tick, the bytes and field
+// values of the flow have to be generated for this tick already
+func (f *ConfigFlow) AdvanceLifecycle(tick int, tickMs int64, config ConfigFile, randGen *rand.Rand) {
+	l := &f.Lifecycle
+	l.Exporting = false
+
+	activeTimeoutMs := int64(config.ActiveTimeout) * 1000
+	inactiveTimeoutMs := int64(config.InactiveTimeout) * 1000
+
+	// The last chunk of a session is exported after the inactive timeout
+	if !l.Active && l.chunkOpen && tickMs-l.lastPacketMs >= inactiveTimeoutMs {
+		l.export()
+	}
+
+	// Sessions start at the tick of the flow, once the previous session
+	// has been exported, unless the profile skips the flow
+	if !l.Active && !l.chunkOpen && tick == f.Tick && !f.ProfileSkip && (f.Count == 0 || l.Sessions < f.Count) {
+		l.Active = true
+		l.Sessions++
+		l.SessionSeconds = f.Duration.Gen(randGen)
+		l.remainingTicks = l.SessionSeconds * 1000 / TICK_INTERVAL_MS
+
+		if l.remainingTicks < 1 {
+			l.remainingTicks = 1
+		}
+	}
+
+	if !l.Active {
+		return
+	}
+
+	if !l.chunkOpen {
+		l.chunkOpen = true
+		l.chunk.StartMs = tickMs
+	}
+
+	packets := DerivePackets(f.Bytes)
+	if f.FieldValues.Ranges.Packets.Set {
+		packets = f.FieldValues.Packets
+	}
+
+	l.chunk.Bytes += f.Bytes
+	l.chunk.Packets += packets
+	l.chunk.EndMs = tickMs
+	l.lastPacketMs = tickMs
+
+	l.remainingTicks--
+	if l.remainingTicks == 0 {
+		l.Active = false
+	}
+
+	// Active flows are exported every active timeout
+	if l.chunk.EndMs-l.chunk.StartMs >= activeTimeoutMs {
+		l.export()
+	}
+}
+
+// Packets of a flow sent once per flow_timeout, the flow is seen in the
+// tick interval before the tick, so the record of the last hop ends
+// before the tick
+func TickChunk(tickMs int64, numHops int) FlowChunk {
+	return FlowChunk{
+		StartMs: tickMs - TICK_INTERVAL_MS,
+		EndMs:   tickMs - int64(numHops*FLOW_HOP_DELAY_MS),
+	}
+}
+
+// Set the times of a record from an exported chunk
+func (c FlowChunk) Apply(record *FlowRecord, clock *HostClock, hostIndex int) {
+	delay := int64(hostIndex * FLOW_HOP_DELAY_MS)
+
+	record.SysUptimeStart = clock.UnixMillisToUptime(c.StartMs + delay)
+	record.SysUptimeEnd = clock.UnixMillisToUptime(c.EndMs + delay)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Export format independent flow record
+// IPv4 flows use the address fields of the embedded v5 payload, IPv6 flows
+// set the 16 byte address fields instead and leave the IPv4 ones empty
+type FlowRecord struct {
+	NetflowPayload
+	IsIPv6     bool
+	SrcIP6     [16]byte
+	DstIP6     [16]byte
+	NextHopIP6 [16]byte
+
+	// Translated tuple of records exported by a hop doing address translation
+	Nat            bool
+	PostNatSrcIP   uint32
+	PostNatDstIP   uint32
+	PostNatSrcIP6  [16]byte
+	PostNatDstIP6  [16]byte
+	PostNatSrcPort uint16
+	PostNatDstPort uint16
+}
+
+func (r *FlowRecord) SetAddrs(srcIp string, dstIp string, nextHopIp string) {
+	src := netip.MustParseAddr(srcIp)
+	dst := netip.MustParseAddr(dstIp)
+
+	if src.Is4() {
+		r.SrcIP = IPtoUint32(srcIp)
+		r.DstIP = IPtoUint32(dstIp)
+	} else {
+		r.IsIPv6 = true
+		r.SrcIP6 = src.As16()
+		r.DstIP6 = dst.As16()
+	}
+
+	if nextHopIp == "" {
+		return
+	}
+
+	// The next hop is only reported if it matches the address family of the flow
+	nextHop := netip.MustParseAddr(nextHopIp)
+
+	if nextHop.Is4() && !r.IsIPv6 {
+		r.NextHopIP = IPtoUint32(nextHopIp)
+	} else if nextHop.Is6() && r.IsIPv6 {
+		r.NextHopIP6 = nextHop.As16()
+	}
+}
+
+func (r *FlowRecord) SetPostNat(tuple FlowTuple) {
+	r.Nat = true
+
+	if r.IsIPv6 {
+		r.PostNatSrcIP6 = netip.MustParseAddr(tuple.SrcAddr).As16()
+		r.PostNatDstIP6 = netip.MustParseAddr(tuple.DstAddr).As16()
+	} else {
+		r.PostNatSrcIP = IPtoUint32(tuple.SrcAddr)
+		r.PostNatDstIP = IPtoUint32(tuple.DstAddr)
+	}
+
+	r.PostNatSrcPort = tuple.SrcPort
+	r.PostNatDstPort = tuple.DstPort
+}
+
+func (r *FlowRecord) SrcAddrString() string {
+	if r.IsIPv6 {
+		return net.IP(r.SrcIP6[:]).String()
+	}
+
+	return ConvertIntToIp(r.SrcIP).String()
+}
+
+func (r *FlowRecord) DstAddrString() string {
+	if r.IsIPv6 {
+		return net.IP(r.DstIP6[:]).String()
+	}
+
+	return ConvertIntToIp(r.DstIP).String()
+}
+
+// Split records by address family, so they can be encoded with the
+// matching template
+func SplitRecordsByFamily(records []FlowRecord) ([]FlowRecord, []FlowRecord) {
+	var ipv4Records []FlowRecord
+	var ipv6Records []FlowRecord
+
+	for _, record := range records {
+		if record.IsIPv6 {
+			ipv6Records = append(ipv6Records, record)
+		} else {
+			ipv4Records = append(ipv4Records, record)
+		}
+	}
+
+	return ipv4Records, ipv6Records
+}
+
+// Split records by translation, translated records are encoded with the
+// NAT templates
+func SplitRecordsByNat(records []FlowRecord) ([]FlowRecord, []FlowRecord) {
+	var plainRecords []FlowRecord
+	var natRecords []FlowRecord
+
+	for _, record := range records {
+		if record.Nat {
+			natRecords = append(natRecords, record)
+		} else {
+			plainRecords = append(plainRecords, record)
+		}
+	}
+
+	return plainRecords, natRecords
+}
+
+// Parse an address or cidr from the config file
+func ParseUserAddr(input string) (netip.Addr, error) {
+	if strings.Contains(input, "/") {
+		prefix, err := netip.ParsePrefix(input)
+
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("failed to parse cidr %s: %v", input, err)
+		}
+
+		return prefix.Addr(), nil
+	}
+
+	addr, err := netip.ParseAddr(input)
+
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to parse ip %s: %v", input, err)
+	}
+
+	return addr, nil
+}
+
+// Check that the addresses in the config file can be carried by the
+// export format of every host they pass, netflow v5 only has room for
+// IPv4 addresses
+func ValidateAddrFamilies(config ConfigFile) error {
+	for _, host := range config.Hosts {
+		addr, err := netip.ParseAddr(host.Ip)
+
+		if err != nil {
+			return fmt.Errorf("host %s: failed to parse ip %s: %v", host.Name, host.Ip, err)
+		}
+
+		exportFormat := HostExportFormat(config, host.Name)
+
+		if addr.Is6() && exportFormat == EXPORT_FORMAT_NETFLOW5 {
+			return fmt.Errorf("host %s: IPv6 address %s is not supported by export format %s", host.Name, host.Ip, exportFormat)
+		}
+	}
+
+	for i, flow := range config.Flows {
+		err := validateFlowAddrFamilies(config, flow)
+
+		if err != nil {
+			return fmt.Errorf("flow %d: %v", i, err)
+		}
+	}
+
+	for i, scenario := range config.Scenarios {
+		err := validateFlowAddrFamilies(config, scenario.flowUser())
+
+		if err != nil {
+			return fmt.Errorf("scenario %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Check the addresses of a flow against each other and the export format
+// of the hosts the flow passes
+func validateFlowAddrFamilies(config ConfigFile, flow ConfigFlowUser) error {
+	isIPv6 := false
+	families := map[bool]string{}
+
+	for _, input := range []string{flow.SrcAddr, flow.DstAddr} {
+		if input == "" {
+			continue
+		}
+
+		addr, err := ParseUserAddr(input)
+
+		if err != nil {
+			return err
+		}
+
+		isIPv6 = addr.Is6()
+		families[isIPv6] = input
+	}
+
+	if len(families) > 1 {
+		return fmt.Errorf("src_addr %s and dst_addr %s are not the same address family", flow.SrcAddr, flow.DstAddr)
+	}
+
+	// Translated addresses have to be in the family of the flow
+	for _, hop := range flow.Hops {
+		for _, input := range []string{hop.Snat, hop.Dnat} {
+			if input == "" {
+				continue
+			}
+
+			addr, err := ParseUserAddr(input)
+
+			if err != nil {
+				return fmt.Errorf("hop %s: %v", hop.Host, err)
+			}
+
+			if len(families) > 0 && addr.Is6() != isIPv6 {
+				return fmt.Errorf("hop %s: translated address %s is not in the address family of the flow", hop.Host, input)
+			}
+		}
+	}
+
+	if !isIPv6 {
+		return nil
+	}
+
+	for _, hops := range [][]ConfigHopUser{flow.Hops, flow.ReturnHops} {
+		for _, hop := range hops {
+			exportFormat := HostExportFormat(config, hop.Host)
+
+			if exportFormat == EXPORT_FORMAT_NETFLOW5 {
+				return fmt.Errorf("IPv6 addresses are not supported by export format %s of host %s", exportFormat, hop.Host)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Whether the addresses of a flow are IPv6, flows without addresses get
+// random IPv4 addresses
+func FlowIsIPv6(flow ConfigFlowUser) bool {
+	for _, input := range []string{flow.SrcAddr, flow.DstAddr} {
+		if addr, err := ParseUserAddr(input); err == nil && addr.Is6() {
+			return true
+		}
+	}
+
+	return false
+}
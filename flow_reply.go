@@ -0,0 +1,88 @@
+package main
+
+// Reply flow of a bidirectional flow, the addresses and ports are swapped
+// and the reply takes the return path, which are the hops in reverse order
+// unless the flow has its own return hops
+func NewReplyFlow(forward ConfigFlow, forwardIndex int, responseRatio float64, returnHops []string, returnHopDrops []float64) ConfigFlow {
+	reply := forward
+
+	reply.SrcAddr = forward.DstAddr
+	reply.SrcPort = forward.DstPort
+	reply.DstAddr = forward.SrcAddr
+	reply.DstPort = forward.SrcPort
+
+	if returnHops != nil {
+		reply.Hops = returnHops
+		reply.HopDrops = returnHopDrops
+	} else {
+		reply.Hops = make([]string, len(forward.Hops))
+		for i, hop := range forward.Hops {
+			reply.Hops[len(forward.Hops)-1-i] = hop
+		}
+
+		if forward.HopDrops != nil {
+			reply.HopDrops = make([]float64, len(forward.HopDrops))
+			for i, drop := range forward.HopDrops {
+				reply.HopDrops[len(forward.HopDrops)-1-i] = drop
+			}
+		}
+	}
+
+	reply.Fields.SrcAs, reply.Fields.DstAs = forward.Fields.DstAs, forward.Fields.SrcAs
+	reply.Fields.SrcMask, reply.Fields.DstMask = forward.Fields.DstMask, forward.Fields.SrcMask
+
+	// The translation of the return path is derived from the seeded
+	// translation of the forward flow, see SeedReplyNat
+	reply.Nat = nil
+
+	reply.Reply = true
+	reply.ForwardIndex = forwardIndex
+	reply.ResponseRatio = responseRatio
+
+	return reply
+}
+
+// Take the seeded values of the forward flow, the reply flow is sent in
+// the same tick as the forward flow
+func (f *ConfigFlow) SeedReply(forward ConfigFlow) {
+	f.SrcAddr = forward.DstAddr
+	f.SrcPort = forward.DstPort
+	f.DstAddr = forward.SrcAddr
+	f.DstPort = forward.SrcPort
+	f.Proto = forward.Proto
+	f.Tick = forward.Tick
+}
+
+// Derive the values of a reply flow for the current tick from the values
+// of the forward flow, so no random values are used for reply flows
+func (f *ConfigFlow) MirrorForward(forward ConfigFlow) {
+	f.Bytes = int(float64(forward.Bytes) * f.ResponseRatio)
+	if f.Bytes < 1 {
+		f.Bytes = 1
+	}
+
+	f.ProfileSkip = forward.ProfileSkip
+
+	f.FieldValues = forward.FieldValues
+	f.FieldValues.Ranges = f.Fields
+	f.FieldValues.SrcAs, f.FieldValues.DstAs = forward.FieldValues.DstAs, forward.FieldValues.SrcAs
+	f.FieldValues.SrcMask, f.FieldValues.DstMask = forward.FieldValues.DstMask, forward.FieldValues.SrcMask
+
+	// Configured packets are scaled like the bytes, otherwise the packets
+	//  are derived from the bytes of the reply
+	if f.FieldValues.Ranges.Packets.Set {
+		f.FieldValues.Packets = int(float64(forward.FieldValues.Packets) * f.ResponseRatio)
+		if f.FieldValues.Packets < 1 {
+			f.FieldValues.Packets = 1
+		}
+	}
+
+	// A reply session lasts as long as the forward session
+	if forward.Duration.Set {
+		f.Duration = ValueRange{
+			Set: true,
+			Min: forward.Lifecycle.SessionSeconds,
+			Max: forward.Lifecycle.SessionSeconds,
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestMirrorForward(t *testing.T) {
+	tests := []struct {
+		name        string
+		packets     ValueRange
+		ratio       float64
+		bytes       int
+		wantBytes   int
+		wantPackets int
+	}{
+		{"derived packets", ValueRange{}, 0.1, 150000, 15000, 10},
+		{"configured packets", ValueRange{Set: true, Min: 100, Max: 100}, 0.1, 150000, 15000, 10},
+		{"at least one packet", ValueRange{Set: true, Min: 5, Max: 5}, 0.1, 150000, 15000, 1},
+		{"larger reply", ValueRange{Set: true, Min: 10, Max: 10}, 2, 1000, 2000, 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forward := ConfigFlow{Bytes: test.bytes}
+			forward.Fields.Packets = test.packets
+			forward.FieldValues = FlowFieldValues{Ranges: forward.Fields, Packets: test.packets.Min}
+
+			reply := NewReplyFlow(forward, 0, test.ratio, nil, nil)
+			reply.MirrorForward(forward)
+
+			volume := reply.TickVolume()
+
+			if volume.Bytes != test.wantBytes || volume.Packets != test.wantPackets {
+				t.Errorf("got %d bytes %d packets, want %d bytes %d packets", volume.Bytes, volume.Packets, test.wantBytes, test.wantPackets)
+			}
+		})
+	}
+}
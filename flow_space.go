@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// Flow entries expanding into more flows have to set max_flows or
+	// sample, unless max_expanded_flows is raised
+	DEFAULT_MAX_EXPANDED_FLOWS = 1000000
+
+	// Added to the seed of the config file and the index of the flow entry
+	// for the generator picking the sampled tuples
+	SAMPLE_SEED_OFFSET = 2
+)
+
+// Addresses of an address setting, the hosts of a cidr are computed on
+// demand instead of being listed. An empty setting is a single empty
+// address, which is replaced by a random address when the flows are seeded
+type AddrSpace struct {
+	value string
+	first netip.Addr
+	size  uint64
+}
+
+// Address, cidr or empty, the hosts of a cidr are the addresses from the
+// address of the cidr to the end of the prefix without the first and the
+// last one
+func NewAddrSpace(input string) (AddrSpace, error) {
+	if !strings.Contains(input, "/") {
+		return AddrSpace{value: input, size: 1}, nil
+	}
+
+	prefix, err := netip.ParsePrefix(input)
+
+	if err != nil {
+		return AddrSpace{}, fmt.Errorf("failed to parse cidr %s: %v", input, err)
+	}
+
+	addr := prefix.Addr()
+	hostBits := addr.BitLen() - prefix.Bits()
+
+	// Addresses from the address of the cidr to the end of the prefix
+	count := uint64(math.MaxUint64)
+	if hostBits < 64 {
+		count = uint64(1)<<uint(hostBits) - addrLow64(addr)&(uint64(1)<<uint(hostBits)-1)
+	}
+
+	if count < 2 {
+		return AddrSpace{first: addr, size: count}, nil
+	}
+
+	return AddrSpace{first: addrAdd(addr, 1), size: count - 2}, nil
+}
+
+func ParseUserAddrSpace(input string) AddrSpace {
+	space, err := NewAddrSpace(input)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return space
+}
+
+// Number of addresses, saturated at the largest uint64
+func (s AddrSpace) Size() uint64 {
+	return s.size
+}
+
+func (s AddrSpace) At(i uint64) string {
+	if !s.first.IsValid() {
+		return s.value
+	}
+
+	return addrAdd(s.first, i).String()
+}
+
+// Random address of the space, drawn like an index into a list of the
+// addresses
+func (s AddrSpace) Pick(randGen *rand.Rand) string {
+	return s.At(randIndex(randGen, s.size))
+}
+
+func addrLow64(addr netip.Addr) uint64 {
+	if addr.Is4() {
+		a4 := addr.As4()
+		return uint64(binary.BigEndian.Uint32(a4[:]))
+	}
+
+	a16 := addr.As16()
+	return binary.BigEndian.Uint64(a16[8:])
+}
+
+// Address n addresses after addr
+func addrAdd(addr netip.Addr, n uint64) netip.Addr {
+	if addr.Is4() {
+		a4 := addr.As4()
+		binary.BigEndian.PutUint32(a4[:], binary.BigEndian.Uint32(a4[:])+uint32(n))
+		return netip.AddrFrom4(a4)
+	}
+
+	a16 := addr.As16()
+	high := binary.BigEndian.Uint64(a16[:8])
+	low := binary.BigEndian.Uint64(a16[8:])
+
+	if low+n < low {
+		high++
+	}
+
+	binary.BigEndian.PutUint64(a16[:8], high)
+	binary.BigEndian.PutUint64(a16[8:], low+n)
+
+	return netip.AddrFrom16(a16)
+}
+
+// Random index below n, like rand.Intn for the sizes that fit an int
+func randIndex(randGen *rand.Rand, n uint64) uint64 {
+	if n <= math.MaxInt32 {
+		return uint64(randGen.Intn(int(n)))
+	}
+
+	if n <= math.MaxInt64 {
+		return uint64(randGen.Int63n(int64(n)))
+	}
+
+	return randGen.Uint64() % n
+}
+
+// Tuples of a flow entry, indexed in the order of the nested loops over
+// src_addr, dst_addr, src_port, dst_port and proto
+type TupleSpace struct {
+	SrcAddr AddrSpace
+	DstAddr AddrSpace
+	SrcPort []uint16
+	DstPort []uint16
+	Proto   []int
+}
+
+// Index of each setting of a tuple
+type TupleIndex [5]uint64
+
+func (s TupleSpace) sizes() [5]uint64 {
+	return [5]uint64{
+		s.SrcAddr.Size(),
+		s.DstAddr.Size(),
+		uint64(len(s.SrcPort)),
+		uint64(len(s.DstPort)),
+		uint64(len(s.Proto)),
+	}
+}
+
+// Number of tuples, saturated at the largest uint64
+func (s TupleSpace) Size() uint64 {
+	size := uint64(1)
+
+	for _, n := range s.sizes() {
+		if n == 0 {
+			return 0
+		}
+
+		if size > math.MaxUint64/n {
+			size = math.MaxUint64
+		} else {
+			size *= n
+		}
+	}
+
+	return size
+}
+
+// Index of the i-th tuple, the proto changes fastest
+func (s TupleSpace) Index(i uint64) TupleIndex {
+	var index TupleIndex
+
+	sizes := s.sizes()
+
+	for j := len(sizes) - 1; j >= 0; j-- {
+		index[j] = i % sizes[j]
+		i /= sizes[j]
+	}
+
+	return index
+}
+
+// Random tuple, every setting is picked on its own so spaces larger than
+// an uint64 can be sampled
+func (s TupleSpace) Pick(randGen *rand.Rand) TupleIndex {
+	var index TupleIndex
+
+	for j, n := range s.sizes() {
+		index[j] = randIndex(randGen, n)
+	}
+
+	return index
+}
+
+// Indexes of the tuples of a flow entry: all tuples, the first maxFlows or
+// sample random tuples. The sampled tuples are distinct and in the order
+// they are picked
+func (s TupleSpace) Indexes(maxFlows int, sample int, randGen *rand.Rand) []TupleIndex {
+	var indexes []TupleIndex
+
+	size := s.Size()
+
+	if sample > 0 && uint64(sample) < size {
+		picked := map[TupleIndex]bool{}
+
+		for len(indexes) < sample {
+			index := s.Pick(randGen)
+
+			if picked[index] {
+				continue
+			}
+
+			picked[index] = true
+			indexes = append(indexes, index)
+		}
+
+		return indexes
+	}
+
+	if maxFlows > 0 && uint64(maxFlows) < size {
+		size = uint64(maxFlows)
+	}
+
+	for i := uint64(0); i < size; i++ {
+		indexes = append(indexes, s.Index(i))
+	}
+
+	return indexes
+}
+
+func configMaxExpandedFlows(config ConfigFile) int {
+	if config.MaxExpandedFlows == 0 {
+		return DEFAULT_MAX_EXPANDED_FLOWS
+	}
+
+	return config.MaxExpandedFlows
+}
+
+// The tuples of a flow entry are expanded when the config file is loaded,
+// max_expanded_flows is a hard cap so a typo in a cidr does not exhaust
+// the memory
+func ValidateExpandedFlows(config ConfigFile, flow ConfigFlowUser) error {
+	maxExpandedFlows := configMaxExpandedFlows(config)
+	numFlows := estimateTuples(flow)
+
+	if numFlows > float64(maxExpandedFlows) {
+		return fmt.Errorf("expands into %.0f flows, more than max_expanded_flows %d: set max_flows or sample", numFlows, maxExpandedFlows)
+	}
+
+	return nil
+}
+
+// The cap is on all flows and scenarios together, entries below the cap
+// can still add up to more flows than fit in memory
+func ValidateTotalExpandedFlows(config ConfigFile) error {
+	maxExpandedFlows := configMaxExpandedFlows(config)
+	numFlows := 0.0
+
+	for _, flow := range config.Flows {
+		numFlows += estimateTuples(flow)
+	}
+
+	for _, scenario := range config.Scenarios {
+		numFlows += estimateTuples(scenario.flowUser())
+	}
+
+	if numFlows > float64(maxExpandedFlows) {
+		return fmt.Errorf("flows and scenarios expand into %.0f flows, more than max_expanded_flows %d: set max_flows or sample", numFlows, maxExpandedFlows)
+	}
+
+	return nil
+}
+
+// Generator of the sampled tuples of a flow entry, seeded from the seed of
+// the config file so all generators pick the same tuples
+func InitSampleRandGen(config ConfigFile, entryIndex int) *rand.Rand {
+	if config.Seed == 0 {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return rand.New(rand.NewSource(int64(config.Seed) + SAMPLE_SEED_OFFSET + int64(entryIndex)))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	WEIGHT_ZIPF     = "zipf"
+	WEIGHT_TOP      = "top"
+	WEIGHT_EXPLICIT = "explicit"
+
+	// Weights scale the bytes of the flows or the chance that they fire
+	WEIGHT_BY_BYTES = "bytes"
+	WEIGHT_BY_RATE  = "rate"
+
+	// Settings of the tuples a weight can be over, flow is the position of
+	// the flow in the flows of the entry
+	WEIGHT_OVER_SRC_ADDR = "src_addr"
+	WEIGHT_OVER_DST_ADDR = "dst_addr"
+	WEIGHT_OVER_SRC_PORT = "src_port"
+	WEIGHT_OVER_DST_PORT = "dst_port"
+	WEIGHT_OVER_PROTO    = "proto"
+	WEIGHT_OVER_FLOW     = "flow"
+
+	DEFAULT_ZIPF_EXPONENT = 1
+	DEFAULT_TOP_SHARE     = 0.8
+)
+
+// Position of each setting in a TupleIndex
+var WEIGHT_OVER_INDEX = map[string]int{
+	WEIGHT_OVER_SRC_ADDR: 0,
+	WEIGHT_OVER_DST_ADDR: 1,
+	WEIGHT_OVER_SRC_PORT: 2,
+	WEIGHT_OVER_DST_PORT: 3,
+	WEIGHT_OVER_PROTO:    4,
+}
+
+// Skew across the flows a flow entry expands into, the values of a setting
+// are ranked in the order of the address, list or range:
+//
+//	{"type": "zipf", "over": "dst_addr", "s": 1.2}
+//	{"type": "top", "over": "src_addr", "n": 5, "share": 0.9}
+//	{"type": "explicit", "over": "dst_port", "values": {"443": 10, "80": 2}}
+type ConfigFlowWeight struct {
+	Type string `json:"type"`
+	Over string `json:"over"`
+
+	// Exponent of a zipf weight, the value of rank r weighs 1/r^s
+	S float64 `json:"s"`
+
+	// The first n values of a top weight carry share of the traffic
+	N     int     `json:"n"`
+	Share float64 `json:"share"`
+
+	// Weights of explicit values, addresses can be matched by the longest
+	// cidr containing them and other values weigh 1
+	Values map[string]float64 `json:"values"`
+}
+
+func (w ConfigFlowWeight) Validate() error {
+	_, isTuple := WEIGHT_OVER_INDEX[w.Over]
+
+	if !isTuple && w.Over != WEIGHT_OVER_FLOW {
+		return fmt.Errorf("unknown over %q", w.Over)
+	}
+
+	switch w.Type {
+	case WEIGHT_ZIPF:
+		if w.S < 0 {
+			return fmt.Errorf("invalid s %v: must not be negative", w.S)
+		}
+	case WEIGHT_TOP:
+		if w.N < 1 {
+			return fmt.Errorf("invalid n %d: must be at least 1", w.N)
+		}
+
+		if w.Share < 0 || w.Share > 1 {
+			return fmt.Errorf("invalid share %v: must be between 0 and 1", w.Share)
+		}
+	case WEIGHT_EXPLICIT:
+		if !isTuple {
+			return fmt.Errorf("explicit weights can not be over %s", w.Over)
+		}
+
+		for key, value := range w.Values {
+			if value < 0 {
+				return fmt.Errorf("invalid weight %v of %s: must not be negative", value, key)
+			}
+
+			if w.Over == WEIGHT_OVER_SRC_ADDR || w.Over == WEIGHT_OVER_DST_ADDR {
+				if _, err := netip.ParsePrefix(key); strings.Contains(key, "/") && err != nil {
+					return fmt.Errorf("invalid cidr %s: %v", key, err)
+				}
+
+				if _, err := netip.ParseAddr(key); !strings.Contains(key, "/") && err != nil {
+					return fmt.Errorf("invalid address %s: %v", key, err)
+				}
+			} else if _, err := strconv.Atoi(key); err != nil {
+				return fmt.Errorf("invalid value %s: %v", key, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q", w.Type)
+	}
+
+	return nil
+}
+
+// Check the weights of a flow entry
+func ValidateFlowWeights(flow ConfigFlowUser) error {
+	if flow.WeightBy != "" && flow.WeightBy != WEIGHT_BY_BYTES && flow.WeightBy != WEIGHT_BY_RATE {
+		return fmt.Errorf("unknown weight_by %q", flow.WeightBy)
+	}
+
+	for i, weight := range flow.Weights {
+		err := weight.Validate()
+
+		if err != nil {
+			return fmt.Errorf("weights %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Relative weight of a flow of the entry, position is the position of the
+// flow in the numFlows flows of the entry
+func (w ConfigFlowWeight) Value(tuples TupleSpace, index TupleIndex, position int, numFlows int) float64 {
+	rank := uint64(position)
+	size := uint64(numFlows)
+
+	if i, ok := WEIGHT_OVER_INDEX[w.Over]; ok {
+		rank = index[i]
+		size = tuples.sizes()[i]
+	}
+
+	switch w.Type {
+	case WEIGHT_ZIPF:
+		s := w.S
+		if s == 0 {
+			s = DEFAULT_ZIPF_EXPONENT
+		}
+
+		return 1 / math.Pow(float64(rank+1), s)
+	case WEIGHT_TOP:
+		share := w.Share
+		if share == 0 {
+			share = DEFAULT_TOP_SHARE
+		}
+
+		n := uint64(w.N)
+
+		if size <= n {
+			return 1
+		}
+
+		if rank < n {
+			return share / float64(n)
+		}
+
+		return (1 - share) / float64(size-n)
+	case WEIGHT_EXPLICIT:
+		return w.explicitValue(tuples, index)
+	}
+
+	return 1
+}
+
+func (w ConfigFlowWeight) explicitValue(tuples TupleSpace, index TupleIndex) float64 {
+	var value string
+
+	switch w.Over {
+	case WEIGHT_OVER_SRC_ADDR:
+		value = tuples.SrcAddr.At(index[0])
+	case WEIGHT_OVER_DST_ADDR:
+		value = tuples.DstAddr.At(index[1])
+	case WEIGHT_OVER_SRC_PORT:
+		value = strconv.Itoa(int(tuples.SrcPort[index[2]]))
+	case WEIGHT_OVER_DST_PORT:
+		value = strconv.Itoa(int(tuples.DstPort[index[3]]))
+	case WEIGHT_OVER_PROTO:
+		value = strconv.Itoa(tuples.Proto[index[4]])
+	}
+
+	if weight, ok := w.Values[value]; ok {
+		return weight
+	}
+
+	addr, err := netip.ParseAddr(value)
+
+	if err != nil {
+		return 1
+	}
+
+	// The longest cidr containing the address wins, the keys are sorted so
+	//  all generators pick the same cidr
+	var keys []string
+	for key := range w.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	weight := 1.0
+	bits := -1
+
+	for _, key := range keys {
+		if prefix, err := netip.ParsePrefix(key); err == nil && prefix.Contains(addr) && prefix.Bits() > bits {
+			weight = w.Values[key]
+			bits = prefix.Bits()
+		}
+	}
+
+	return weight
+}
+
+// Weights of the flows of an entry, normalized so the flows keep the bytes
+// of the entry on average, or so the heaviest flow always fires
+func FlowWeights(multiFlowConfig ConfigFlowMultiple, indexes []TupleIndex) []float64 {
+	weights := make([]float64, len(indexes))
+	total := 0.0
+	max := 0.0
+
+	for i, index := range indexes {
+		weights[i] = 1
+
+		for _, weight := range multiFlowConfig.Weights {
+			weights[i] *= weight.Value(multiFlowConfig.Tuples, index, i, len(indexes))
+		}
+
+		total += weights[i]
+		max = math.Max(max, weights[i])
+	}
+
+	norm := total / float64(len(indexes))
+	if multiFlowConfig.WeightBy == WEIGHT_BY_RATE {
+		norm = max
+	}
+
+	if norm == 0 {
+		return weights
+	}
+
+	for i := range weights {
+		weights[i] /= norm
+	}
+
+	return weights
+}
+
+// Scale the bytes of the flow by its weight, or skip the flow in its tick
+// with the chance of its weight. The seeded random generator is only used
+// for flows weighted by rate
+func (f *ConfigFlow) ApplyWeight(tick int, randGen *rand.Rand) {
+	if !f.Weighted {
+		return
+	}
+
+	if f.WeightBy == WEIGHT_BY_RATE {
+		if tick == f.Tick && !f.ProfileSkip && randGen.Float64() >= f.Weight {
+			f.ProfileSkip = true
+		}
+
+		return
+	}
+
+	f.Bytes = int(math.Min(math.Round(float64(f.Bytes)*f.Weight), math.MaxUint32))
+	if f.Bytes < 1 {
+		f.Bytes = 1
+	}
+}
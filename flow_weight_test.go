@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func testTupleSpace(dstAddr string, dstPorts ...uint16) TupleSpace {
+	return TupleSpace{
+		SrcAddr: ParseUserAddrSpace("10.1.0.1"),
+		DstAddr: ParseUserAddrSpace(dstAddr),
+		SrcPort: []uint16{40000},
+		DstPort: dstPorts,
+		Proto:   []int{PROTO_TCP},
+	}
+}
+
+func TestFlowWeights(t *testing.T) {
+	tests := []struct {
+		name     string
+		tuples   TupleSpace
+		weights  []ConfigFlowWeight
+		weightBy string
+		want     []float64
+	}{
+		{
+			"zipf by rate",
+			testTupleSpace("10.2.0.0/29", 443),
+			[]ConfigFlowWeight{{Type: WEIGHT_ZIPF, Over: WEIGHT_OVER_DST_ADDR}},
+			WEIGHT_BY_RATE,
+			[]float64{1, 1.0 / 2, 1.0 / 3, 1.0 / 4, 1.0 / 5, 1.0 / 6},
+		},
+		{
+			"zipf by bytes keeps the mean",
+			testTupleSpace("10.2.0.1", 80, 443),
+			[]ConfigFlowWeight{{Type: WEIGHT_ZIPF, Over: WEIGHT_OVER_DST_PORT}},
+			WEIGHT_BY_BYTES,
+			[]float64{4.0 / 3, 2.0 / 3},
+		},
+		{
+			"zipf over flow",
+			testTupleSpace("10.2.0.1", 80, 443, 8080),
+			[]ConfigFlowWeight{{Type: WEIGHT_ZIPF, Over: WEIGHT_OVER_FLOW, S: 2}},
+			WEIGHT_BY_RATE,
+			[]float64{1, 1.0 / 4, 1.0 / 9},
+		},
+		{
+			"top share",
+			testTupleSpace("10.2.0.0/29", 443),
+			[]ConfigFlowWeight{{Type: WEIGHT_TOP, Over: WEIGHT_OVER_DST_ADDR, N: 1, Share: 0.7}},
+			WEIGHT_BY_BYTES,
+			[]float64{4.2, 0.36, 0.36, 0.36, 0.36, 0.36},
+		},
+		{
+			"top larger than the values",
+			testTupleSpace("10.2.0.0/30", 443),
+			[]ConfigFlowWeight{{Type: WEIGHT_TOP, Over: WEIGHT_OVER_DST_ADDR, N: 5}},
+			WEIGHT_BY_BYTES,
+			[]float64{1, 1},
+		},
+		{
+			"explicit port, other ports weigh 1",
+			testTupleSpace("10.2.0.1", 80, 443),
+			[]ConfigFlowWeight{{Type: WEIGHT_EXPLICIT, Over: WEIGHT_OVER_DST_PORT, Values: map[string]float64{"443": 3}}},
+			WEIGHT_BY_BYTES,
+			[]float64{0.5, 1.5},
+		},
+		{
+			"explicit longest cidr",
+			testTupleSpace("10.2.0.0/29", 443),
+			[]ConfigFlowWeight{{Type: WEIGHT_EXPLICIT, Over: WEIGHT_OVER_DST_ADDR, Values: map[string]float64{
+				"10.2.0.0/29": 2,
+				"10.2.0.4/30": 4,
+				"10.2.0.6":    8,
+			}}},
+			WEIGHT_BY_RATE,
+			[]float64{0.25, 0.25, 0.25, 0.5, 0.5, 1},
+		},
+		{
+			"weights multiply",
+			testTupleSpace("10.2.0.0/30", 80, 443),
+			[]ConfigFlowWeight{
+				{Type: WEIGHT_ZIPF, Over: WEIGHT_OVER_DST_PORT},
+				{Type: WEIGHT_EXPLICIT, Over: WEIGHT_OVER_DST_ADDR, Values: map[string]float64{"10.2.0.2": 2}},
+			},
+			WEIGHT_BY_RATE,
+			[]float64{0.5, 0.25, 1, 0.5},
+		},
+		{
+			"all weights zero",
+			testTupleSpace("10.2.0.1", 80, 443),
+			[]ConfigFlowWeight{{Type: WEIGHT_EXPLICIT, Over: WEIGHT_OVER_DST_PORT, Values: map[string]float64{"80": 0, "443": 0}}},
+			WEIGHT_BY_BYTES,
+			[]float64{0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			multiFlowConfig := ConfigFlowMultiple{
+				Tuples:   test.tuples,
+				Weights:  test.weights,
+				WeightBy: test.weightBy,
+			}
+
+			weights := FlowWeights(multiFlowConfig, test.tuples.Indexes(0, 0, nil))
+
+			if len(weights) != len(test.want) {
+				t.Fatalf("got %d weights, want %d", len(weights), len(test.want))
+			}
+
+			for i := range weights {
+				if math.Abs(weights[i]-test.want[i]) > 1e-9 {
+					t.Errorf("got weights %v, want %v", weights, test.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func writeNflowBaseServiceBlock(f *os.File, config ConfigFile, configFile string) {
@@ -28,19 +29,36 @@ func writeNflowServiceBlock(f *os.File, hostConfig ConfigHost) {
 	f.WriteString("      HOST_NAME: " + hostConfig.Name + "\n")
 	f.WriteString("    networks:\n")
 	f.WriteString("      nflow-network:\n")
-	f.WriteString("        ipv4_address: " + hostConfig.Ip + "\n")
+	if strings.Contains(hostConfig.Ip, ":") {
+		f.WriteString("        ipv6_address: " + hostConfig.Ip + "\n")
+	} else {
+		f.WriteString("        ipv4_address: " + hostConfig.Ip + "\n")
+	}
 	f.WriteString("    profiles:\n")
 	f.WriteString("      - nflow\n")
 	f.WriteString("\n")
 }
 
 func writeNflowNetworkBlock(f *os.File, config ConfigFile) {
+	hasIPv6 := false
+	for _, hostConfig := range config.Hosts {
+		if strings.Contains(hostConfig.Ip, ":") {
+			hasIPv6 = true
+		}
+	}
+
 	f.WriteString("networks:\n")
 	f.WriteString("  nflow-network:\n")
+	if hasIPv6 {
+		f.WriteString("    enable_ipv6: true\n")
+	}
 	f.WriteString("    ipam:\n")
 	f.WriteString("      driver: default\n")
 	f.WriteString("      config:\n")
 	f.WriteString("        - subnet: 10.0.0.0/16\n")
+	if hasIPv6 {
+		f.WriteString("        - subnet: fd00::/64\n")
+	}
 	f.WriteString("\n")
 }
 
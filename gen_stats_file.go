@@ -9,6 +9,9 @@ import (
 type ConfigFlowState struct {
 	Count int
 	Bytes int
+
+	// Packets since the last sampled packet of the flow
+	SamplePhase int
 }
 
 func InitFlowState(enabledFlows []EnabledConfigFlow) []ConfigFlowState {
@@ -32,13 +35,22 @@ type OutStatsTotal struct {
 	DstAddr string `json:"dst_addr"`
 	DstPort uint16 `json:"dst_port"`
 	Proto   int    `json:"proto"`
+
+	// Name of the scenario that injected the flow
+	Scenario string `json:"scenario,omitempty"`
 }
 
 type OutStats struct {
-	Total []OutStatsTotal `json:"total"`
+	HostName string          `json:"host_name"`
+	HostIp   string          `json:"host_ip"`
+	SourceId uint32          `json:"source_id"`
+	Total    []OutStatsTotal `json:"total"`
+
+	// Ground truth of the injected anomalies
+	Scenarios []OutStatsScenario `json:"scenarios,omitempty"`
 }
 
-func GenStatsFile(filename string, configFlowStates []ConfigFlowState, enabledFlows []EnabledConfigFlow, flowConfigs []ConfigFlow) error {
+func GenStatsFile(filename string, hostName string, hostIp string, sourceId uint32, configFlowStates []ConfigFlowState, enabledFlows []EnabledConfigFlow, flowConfigs []ConfigFlow, scenarios []OutStatsScenario) error {
 	statsFile, err := os.Create(filename)
 
 	if err != nil {
@@ -53,19 +65,35 @@ func GenStatsFile(filename string, configFlowStates []ConfigFlowState, enabledFl
 		flowState := configFlowStates[i]
 		flowConfig := flowConfigs[enabledFlows[i].ConfigIndex]
 
+		// The tuple exported by this host, which differs from the configured
+		// one after address translation
+		tuple := flowConfig.HopTuple(enabledFlows[i].HostIndex)
+
+		scenario := ""
+		if flowConfig.Scenario != nil {
+			scenario = flowConfig.Scenario.Name
+		}
+
 		outStatsTotal = append(outStatsTotal, OutStatsTotal{
 			Count:   flowState.Count,
 			Bytes:   flowState.Bytes,
-			SrcAddr: flowConfig.SrcAddr,
-			SrcPort: flowConfig.SrcPort,
-			DstAddr: flowConfig.DstAddr,
-			DstPort: flowConfig.DstPort,
+			SrcAddr: tuple.SrcAddr,
+			SrcPort: tuple.SrcPort,
+			DstAddr: tuple.DstAddr,
+			DstPort: tuple.DstPort,
 			Proto:   flowConfig.Proto,
+
+			Scenario: scenario,
 		})
 	}
 
 	outStats := OutStats{
-		Total: outStatsTotal,
+		HostName: hostName,
+		HostIp:   hostIp,
+		SourceId: sourceId,
+		Total:    outStatsTotal,
+
+		Scenarios: scenarios,
 	}
 
 	result, err := json.Marshal(outStats)
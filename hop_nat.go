@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+)
+
+// Hop of a flow in the config file, either the host name or an object with
+// the address translation done by the host and the packet loss at the host:
+//
+//	{"host": "gw1", "snat": "100.64.0.0/30", "snat_ports": "1024-65535", "dnat": "10.9.0.1", "dnat_port": "8080", "drop": 0.5}
+type ConfigHopUser struct {
+	Host      string  `json:"host"`
+	Snat      string  `json:"snat"`
+	SnatPorts string  `json:"snat_ports"`
+	Dnat      string  `json:"dnat"`
+	DnatPort  string  `json:"dnat_port"`
+	Drop      float64 `json:"drop"`
+}
+
+func (h *ConfigHopUser) UnmarshalJSON(data []byte) error {
+	var host string
+
+	if err := json.Unmarshal(data, &host); err == nil {
+		*h = ConfigHopUser{Host: host}
+		return nil
+	}
+
+	// Alias type without the UnmarshalJSON method
+	type configHopUser ConfigHopUser
+
+	var hop configHopUser
+
+	if err := json.Unmarshal(data, &hop); err != nil {
+		return fmt.Errorf("failed to parse hop %s: %v", string(data), err)
+	}
+
+	*h = ConfigHopUser(hop)
+
+	return nil
+}
+
+// Address translation done by a hop, the source address is picked from
+// the pool when the flows are seeded
+type HopNat struct {
+	Set      bool
+	SrcPool  AddrSpace
+	SrcPorts ValueRange
+	DstAddr  string
+	DstPort  uint16
+}
+
+// Addresses and ports of a flow
+type FlowTuple struct {
+	SrcAddr string
+	SrcPort uint16
+	DstAddr string
+	DstPort uint16
+}
+
+// Tuple of a flow as seen by a hop, hops that translate the flow also
+// report the translated tuple
+type HopTuple struct {
+	FlowTuple
+	Nat     bool
+	PostNat FlowTuple
+}
+
+func (t FlowTuple) Swap() FlowTuple {
+	return FlowTuple{
+		SrcAddr: t.DstAddr,
+		SrcPort: t.DstPort,
+		DstAddr: t.SrcAddr,
+		DstPort: t.SrcPort,
+	}
+}
+
+// Tuple leaving the hop
+func (t HopTuple) Out() FlowTuple {
+	if t.Nat {
+		return t.PostNat
+	}
+
+	return t.FlowTuple
+}
+
+// Host names, translations and drop percentages of the hops of a flow, the
+// translations and drop percentages are nil if no hop sets them
+func ParseUserHops(hops []ConfigHopUser) ([]string, []HopNat, []float64) {
+	var hostNames []string
+	var hopNats []HopNat
+	var hopDrops []float64
+
+	translated := false
+	lossy := false
+
+	for _, hop := range hops {
+		hostNames = append(hostNames, hop.Host)
+
+		if hop.Drop < 0 || hop.Drop > 100 {
+			panic(fmt.Errorf("invalid drop %v of hop %s: must be a percentage between 0 and 100", hop.Drop, hop.Host))
+		}
+
+		hopDrops = append(hopDrops, hop.Drop)
+		lossy = lossy || hop.Drop > 0
+
+		hopNat := HopNat{}
+
+		if hop.Snat != "" {
+			hopNat.SrcPool = ParseUserAddrSpace(hop.Snat)
+		}
+
+		hopNat.SrcPorts = ParseUserRangeInput("snat_ports", hop.SnatPorts, 1, UINT16_MAX)
+		hopNat.DstAddr = hop.Dnat
+
+		if hop.DnatPort != "" {
+			dstPort := ParseUserRangeInput("dnat_port", hop.DnatPort, 1, UINT16_MAX)
+
+			if dstPort.Min != dstPort.Max {
+				panic(fmt.Errorf("invalid dnat_port %s: must be a single port", hop.DnatPort))
+			}
+
+			hopNat.DstPort = uint16(dstPort.Min)
+		}
+
+		hopNat.Set = hopNat.SrcPool.Size() > 0 || hopNat.SrcPorts.Set || hopNat.DstAddr != "" || hopNat.DstPort != 0
+		translated = translated || hopNat.Set
+
+		hopNats = append(hopNats, hopNat)
+	}
+
+	// Flows without translation or loss do not need the per hop state
+	if !translated {
+		hopNats = nil
+	}
+
+	if !lossy {
+		hopDrops = nil
+	}
+
+	return hostNames, hopNats, hopDrops
+}
+
+func (f *ConfigFlow) Tuple() FlowTuple {
+	return FlowTuple{
+		SrcAddr: f.SrcAddr,
+		SrcPort: f.SrcPort,
+		DstAddr: f.DstAddr,
+		DstPort: f.DstPort,
+	}
+}
+
+// Tuple of the flow as seen by the hop at hostIndex
+func (f *ConfigFlow) HopTuple(hostIndex int) HopTuple {
+	if f.HopTuples == nil {
+		return HopTuple{FlowTuple: f.Tuple()}
+	}
+
+	return f.HopTuples[hostIndex]
+}
+
+// Translate the tuple of the flow at every hop with address translation,
+// the seeded random generator is only used for pools and port ranges
+func (f *ConfigFlow) SeedNat(randGen *rand.Rand) {
+	if f.Nat == nil {
+		return
+	}
+
+	tuple := f.Tuple()
+
+	f.HopTuples = make([]HopTuple, len(f.Nat))
+
+	for i, hopNat := range f.Nat {
+		f.HopTuples[i].FlowTuple = tuple
+
+		if !hopNat.Set {
+			continue
+		}
+
+		if hopNat.SrcPool.Size() == 1 {
+			tuple.SrcAddr = hopNat.SrcPool.At(0)
+		} else if hopNat.SrcPool.Size() > 1 {
+			tuple.SrcAddr = hopNat.SrcPool.Pick(randGen)
+		}
+
+		if hopNat.SrcPorts.Set {
+			tuple.SrcPort = uint16(hopNat.SrcPorts.Gen(randGen))
+		}
+
+		if hopNat.DstAddr != "" {
+			tuple.DstAddr = hopNat.DstAddr
+		}
+
+		if hopNat.DstPort != 0 {
+			tuple.DstPort = hopNat.DstPort
+		}
+
+		f.HopTuples[i].Nat = true
+		f.HopTuples[i].PostNat = tuple
+	}
+}
+
+// The reply of a translated flow starts with the translated tuple, every
+// hop of the return path that translated the forward flow translates the
+// reply back
+func (f *ConfigFlow) SeedReplyNat(forward ConfigFlow) {
+	if forward.HopTuples == nil {
+		return
+	}
+
+	tuple := forward.HopTuples[len(forward.HopTuples)-1].Out().Swap()
+
+	f.HopTuples = make([]HopTuple, len(f.Hops))
+
+	for i, hop := range f.Hops {
+		f.HopTuples[i].FlowTuple = tuple
+
+		forwardIndex := FindIndex(hop, forward.Hops)
+
+		if forwardIndex == -1 || !forward.HopTuples[forwardIndex].Nat {
+			continue
+		}
+
+		tuple = forward.HopTuples[forwardIndex].FlowTuple.Swap()
+
+		f.HopTuples[i].Nat = true
+		f.HopTuples[i].PostNat = tuple
+	}
+}
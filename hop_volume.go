@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Above this packet count dropped packets are drawn from the normal
+// approximation instead of per packet
+const MAX_EXACT_DROP_PACKETS = 100
+
+// Bytes and packets of a flow seen by a hop
+type HopVolume struct {
+	Bytes   int
+	Packets int
+}
+
+// Bytes and packets of the record sent for the flow in this tick, before
+// any loss on the path
+func (f *ConfigFlow) TickVolume() HopVolume {
+	if f.Duration.Set {
+		return HopVolume{
+			Bytes:   f.Lifecycle.Export.Bytes,
+			Packets: f.Lifecycle.Export.Packets,
+		}
+	}
+
+	packets := DerivePackets(f.Bytes)
+	if f.FieldValues.Ranges.Packets.Set {
+		packets = f.FieldValues.Packets
+	}
+
+	return HopVolume{Bytes: f.Bytes, Packets: packets}
+}
+
+// Volume of the flow seen by the hop at hostIndex
+func (f *ConfigFlow) HopVolume(hostIndex int) HopVolume {
+	if f.HopVolumes == nil {
+		return f.TickVolume()
+	}
+
+	return f.HopVolumes[hostIndex]
+}
+
+// Apply the loss of every hop to the volume of this tick, a hop sees the
+// packets that were not dropped by the hops before it. The seeded random
+// generator is only used for flows with loss, so all generators agree on
+// the volume of every hop
+func (f *ConfigFlow) GenHopVolumes(randGen *rand.Rand) {
+	if f.HopDrops == nil {
+		return
+	}
+
+	if f.HopVolumes == nil {
+		f.HopVolumes = make([]HopVolume, len(f.HopDrops))
+	}
+
+	// Long-lived flows only have a volume in ticks where a chunk is exported
+	if f.Duration.Set && !f.Lifecycle.Exporting {
+		return
+	}
+
+	volume := f.TickVolume()
+
+	for i, drop := range f.HopDrops {
+		f.HopVolumes[i] = volume
+
+		if drop <= 0 || volume.Packets == 0 {
+			continue
+		}
+
+		dropped := GenDroppedPackets(volume.Packets, drop/100, randGen)
+
+		volume.Bytes -= volume.Bytes * dropped / volume.Packets
+		volume.Packets -= dropped
+	}
+}
+
+func GenDroppedPackets(packets int, probability float64, randGen *rand.Rand) int {
+	if probability >= 1 {
+		return packets
+	}
+
+	if packets <= MAX_EXACT_DROP_PACKETS {
+		dropped := 0
+		for i := 0; i < packets; i++ {
+			if randGen.Float64() < probability {
+				dropped++
+			}
+		}
+		return dropped
+	}
+
+	mean := float64(packets) * probability
+	stddev := math.Sqrt(mean * (1 - probability))
+
+	dropped := int(math.Round(mean + randGen.NormFloat64()*stddev))
+
+	if dropped < 0 {
+		return 0
+	}
+
+	if dropped > packets {
+		return packets
+	}
+
+	return dropped
+}
+
+// Systematic count-based sampling, every rate-th packet of a flow is
+// sampled, the bytes of the sampled packets are scaled from the volume.
+// phase carries the packets since the last sampled packet between ticks
+func SampleVolume(volume HopVolume, rate int, phase *int) HopVolume {
+	if rate <= 1 || volume.Packets == 0 {
+		return volume
+	}
+
+	total := *phase + volume.Packets
+	sampled := total / rate
+	*phase = total % rate
+
+	return HopVolume{
+		Bytes:   volume.Bytes * sampled / volume.Packets,
+		Packets: sampled,
+	}
+}
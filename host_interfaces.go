@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Interface of a host, peer is the host name of the neighbor connected to
+// the interface, a cidr of the external network behind it, or empty for the
+// default interface used for all other traffic entering or leaving the
+// topology
+type ConfigInterface struct {
+	Index uint32 `json:"index"`
+	Name  string `json:"name"`
+	Speed uint64 `json:"speed"`
+	Peer  string `json:"peer"`
+}
+
+// Input and output interface of a flow at a host
+type InterfacePair struct {
+	Set    bool
+	Input  uint16
+	Output uint16
+}
+
+// Check that interface indexes are unique and peers are hosts or cidrs
+func ValidateHostInterfaces(config ConfigFile) error {
+	for _, host := range config.Hosts {
+		indexes := map[uint32]bool{}
+
+		for _, iface := range host.Interfaces {
+			if iface.Index == 0 || iface.Index > UINT16_MAX {
+				return fmt.Errorf("host %s: invalid interface index %d: must be between 1 and %d", host.Name, iface.Index, UINT16_MAX)
+			}
+
+			if indexes[iface.Index] {
+				return fmt.Errorf("host %s: duplicate interface index %d", host.Name, iface.Index)
+			}
+
+			indexes[iface.Index] = true
+
+			if iface.Peer == "" {
+				continue
+			}
+
+			if strings.Contains(iface.Peer, "/") {
+				if _, err := netip.ParsePrefix(iface.Peer); err != nil {
+					return fmt.Errorf("host %s: interface %d: failed to parse peer cidr %s: %v", host.Name, iface.Index, iface.Peer, err)
+				}
+			} else if _, ok := FindHost(config.Hosts, iface.Peer); !ok {
+				return fmt.Errorf("host %s: interface %d: peer host %s not found", host.Name, iface.Index, iface.Peer)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Interface facing a neighbor, a neighbor host when the flow passes another
+// host or the address of the endpoint at the edge of the topology
+func findInterface(interfaces []ConfigInterface, neighborHost string, endpointAddr string) uint16 {
+	if neighborHost != "" {
+		for _, iface := range interfaces {
+			if iface.Peer == neighborHost {
+				return uint16(iface.Index)
+			}
+		}
+	} else if addr, err := netip.ParseAddr(endpointAddr); err == nil {
+		// The longest cidr containing the endpoint wins, so overlapping
+		//  peers do not depend on the order of the interfaces
+		index := -1
+		bits := -1
+
+		for i, iface := range interfaces {
+			prefix, err := netip.ParsePrefix(iface.Peer)
+
+			if err == nil && prefix.Contains(addr) && prefix.Bits() > bits {
+				index = i
+				bits = prefix.Bits()
+			}
+		}
+
+		if index != -1 {
+			return uint16(interfaces[index].Index)
+		}
+	}
+
+	for _, iface := range interfaces {
+		if iface.Peer == "" {
+			return uint16(iface.Index)
+		}
+	}
+
+	return 0
+}
+
+// Interfaces a flow enters and leaves the host at hostIndex of its hops,
+// unset if the host does not declare interfaces
+func FlowInterfaces(host ConfigHost, flowConfig ConfigFlow, hostIndex int) InterfacePair {
+	if len(host.Interfaces) == 0 {
+		return InterfacePair{}
+	}
+
+	prevHop := ""
+	if hostIndex > 0 {
+		prevHop = flowConfig.Hops[hostIndex-1]
+	}
+
+	nextHop := ""
+	if hostIndex < len(flowConfig.Hops)-1 {
+		nextHop = flowConfig.Hops[hostIndex+1]
+	}
+
+	tuple := flowConfig.HopTuple(hostIndex)
+
+	return InterfacePair{
+		Set:    true,
+		Input:  findInterface(host.Interfaces, prevHop, tuple.SrcAddr),
+		Output: findInterface(host.Interfaces, nextHop, tuple.Out().DstAddr),
+	}
+}
+
+// Configured speeds of the interfaces of a host
+func HostInterfaceSpeeds(host ConfigHost) map[uint32]uint64 {
+	speeds := map[uint32]uint64{}
+
+	for _, iface := range host.Interfaces {
+		if iface.Speed != 0 {
+			speeds[iface.Index] = iface.Speed
+		}
+	}
+
+	return speeds
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestFindInterface(t *testing.T) {
+	interfaces := []ConfigInterface{
+		{Index: 1, Peer: "10.0.0.0/8"},
+		{Index: 2, Peer: "gw2"},
+		{Index: 3, Peer: "10.1.0.0/16"},
+		{Index: 4},
+		{Index: 5, Peer: "10.1.2.0/24"},
+		{Index: 6, Peer: "fd00::/8"},
+	}
+
+	tests := []struct {
+		name         string
+		neighborHost string
+		endpointAddr string
+		want         uint16
+	}{
+		{"neighbor host", "gw2", "", 2},
+		{"only the shortest cidr", "", "10.9.0.1", 1},
+		{"longer cidr after a shorter one", "", "10.1.9.1", 3},
+		{"longest cidr last", "", "10.1.2.3", 5},
+		{"ipv6 endpoint", "", "fd00::1", 6},
+		{"no cidr matches", "", "192.168.0.1", 4},
+		{"unknown neighbor", "gw9", "", 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := findInterface(interfaces, test.neighborHost, test.endpointAddr)
+
+			if index != test.want {
+				t.Errorf("got interface %d, want %d", index, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Flow sending state of a single simulated host
+type HostRunner struct {
+	Host         ConfigHost
+	Clock        *HostClock
+	Exporter     Exporter
+	Conn         io.Writer
+	EnabledFlows []EnabledConfigFlow
+	FlowStates   []ConfigFlowState
+
+	// Interfaces of each enabled flow, derived from the flow hops
+	FlowInterfaces []InterfacePair
+
+	// Packet sampling of the host, sflow exporters sample themselves
+	SamplingRate int
+
+	// Paces the records of the host to its target rate, nil sends the
+	// flows at their tick
+	Pacer *RatePacer
+}
+
+func NewHostRunner(config ConfigFile, hostName string, flowConfigs []ConfigFlow) (*HostRunner, error) {
+	hostIndex := -1
+	for i, host := range config.Hosts {
+		if host.Name == hostName {
+			hostIndex = i
+		}
+	}
+
+	if hostIndex == -1 {
+		return nil, fmt.Errorf("host not found: %s", hostName)
+	}
+
+	runner := new(HostRunner)
+	runner.Host = config.Hosts[hostIndex]
+	runner.Clock = NewHostClock(hostIndex)
+
+	// Filter flows for this host
+	runner.EnabledFlows = FilterEnabledFlows(flowConfigs, hostName)
+
+	// Initialize flow state for each flow
+	runner.FlowStates = InitFlowState(runner.EnabledFlows)
+
+	for _, enabledFlow := range runner.EnabledFlows {
+		runner.FlowInterfaces = append(
+			runner.FlowInterfaces,
+			FlowInterfaces(runner.Host, flowConfigs[enabledFlow.ConfigIndex], enabledFlow.HostIndex),
+		)
+	}
+
+	// Initialize the exporter for the configured export format
+	exporter, err := NewExporter(config, hostName, runner.Clock)
+
+	if err != nil {
+		return nil, err
+	}
+
+	runner.Exporter = exporter
+
+	runner.SamplingRate = 1
+	if HostExportFormat(config, hostName) != EXPORT_FORMAT_SFLOW {
+		runner.SamplingRate = FindHostSamplingRate(config.Hosts, hostName)
+	}
+
+	return runner, nil
+}
+
+// Open the connection to the collector, the source address depends on
+// the source mode
+func (h *HostRunner) Connect(config ConfigFile, sourceMode string) error {
+	conn, err := InitSourceConn(config, h.Host, sourceMode)
+
+	if err != nil {
+		return fmt.Errorf("host %s: %v", h.Host.Name, err)
+	}
+
+	h.Conn = conn
+
+	return nil
+}
+
+// Print all configured flows for this host
+func (h *HostRunner) PrintFlows(flowConfigs []ConfigFlow) {
+	for i := 0; i < len(h.EnabledFlows); i++ {
+		flowConfig := flowConfigs[h.EnabledFlows[i].ConfigIndex]
+
+		fmt.Printf(
+			"%15s = %15s %5d -> %15s %5d [%3d] = %d (tick %d) (count %d)\n",
+			h.Host.Name,
+			flowConfig.SrcAddr,
+			flowConfig.SrcPort,
+			flowConfig.DstAddr,
+			flowConfig.DstPort,
+			flowConfig.Proto,
+			flowConfig.Bytes,
+			flowConfig.Tick,
+			flowConfig.Count,
+		)
+	}
+}
+
+// Send the flows of this host for a tick starting at tickMs, returns false
+// if all flows of the host have reached their count
+func (h *HostRunner) SendTick(tick int, tickMs int64, flowConfigs []ConfigFlow, config ConfigFile) bool {
+	if h.Pacer == nil {
+		active, _ := h.sendFlows(tick, tickMs, flowConfigs, config, nil, true)
+		return active
+	}
+
+	h.Pacer.BeginTick(h.Clock.Now())
+
+	// Records of scenarios and long-lived flows count towards the quota,
+	//  the flows sent every flow_timeout fill the rest in turn
+	active, _ := h.sendFlows(tick, tickMs, flowConfigs, config, make([]bool, len(h.EnabledFlows)), true)
+
+	for h.Pacer.Remaining() > 0 {
+		picked := h.Pacer.PickFlows(len(h.EnabledFlows), func(i int) bool {
+			flowConfig := &flowConfigs[h.EnabledFlows[i].ConfigIndex]
+			return flowConfig.Periodic() && !flowConfig.ProfileSkip && (flowConfig.Count == 0 || h.FlowStates[i].Count < flowConfig.Count)
+		})
+
+		_, sent := h.sendFlows(tick, tickMs, flowConfigs, config, picked, false)
+
+		// All flows reached their count, or none of them reached the host
+		if sent == 0 {
+			break
+		}
+	}
+
+	return active
+}
+
+// Send the flows of this host that are due in the tick, returns whether
+// the host has flows left and the number of records sent. Picked selects
+// the flows sent every flow_timeout instead of their tick, scheduled
+// whether scenarios and long-lived flows are sent
+func (h *HostRunner) sendFlows(tick int, tickMs int64, flowConfigs []ConfigFlow, config ConfigFile, picked []bool, scheduled bool) (bool, int) {
+	active := false
+	sent := 0
+
+	for i := 0; i < len(h.EnabledFlows); {
+		records := []FlowRecord{}
+
+		// Calculate sytem uptime for this tick
+		// This value is used in the netflow packet header
+		h.Clock.CreateCalcUptime()
+
+		// We send MAX_FLOWS_PER_RECORD netflow records per netflow packet
+		//  so we use a nested loop to send all flows for this tick
+		j := 0
+		for ; j < MAX_FLOWS_PER_RECORD && i < len(h.EnabledFlows); i, j = i+1, j+1 {
+			enabledFlow := h.EnabledFlows[i]
+			flowConfig := flowConfigs[enabledFlow.ConfigIndex]
+
+			if !flowConfig.Periodic() && !scheduled {
+				continue
+			}
+
+			if flowConfig.Scenario != nil {
+				// Scenario flows are sent on their own schedule
+				if !flowConfig.Scenario.Ended {
+					active = true
+				}
+
+				if !flowConfig.Scenario.Firing {
+					continue
+				}
+			} else if flowConfig.Duration.Set {
+				// Long-lived flows are sent when a chunk of the flow is exported
+				if !flowConfig.Lifecycle.Done(flowConfig.Count) {
+					active = true
+				}
+
+				if !flowConfig.Lifecycle.Exporting {
+					continue
+				}
+			} else {
+				// Check if the flow count has been reached
+				if flowConfig.Count != 0 && h.FlowStates[i].Count+1 > flowConfig.Count {
+					continue
+				}
+
+				active = true
+
+				if picked != nil {
+					if !picked[i] {
+						continue
+					}
+				} else if flowConfig.Tick != tick || flowConfig.ProfileSkip {
+					continue
+				}
+			}
+
+			// Volume seen by this host after the loss of the previous hops
+			volume := SampleVolume(flowConfig.HopVolume(enabledFlow.HostIndex), h.SamplingRate, &h.FlowStates[i].SamplePhase)
+
+			// No packets of the flow reached this host or were sampled
+			if volume.Packets == 0 {
+				continue
+			}
+
+			// If the flow has multiple hops, check if we should provide a value
+			//  for the next hop field
+			numHops := len(flowConfig.Hops)
+
+			nextHopHostName := ""
+			if enabledFlow.HostIndex < numHops-1 {
+				nextHopHostName = flowConfig.Hops[enabledFlow.HostIndex+1]
+			}
+
+			// Hops after a translating hop see the translated tuple
+			tuple := flowConfig.HopTuple(enabledFlow.HostIndex)
+
+			// Create the netflow record
+			payload := CreateCustomFlow(
+				h.Clock.SysUptime,
+				tuple.SrcAddr,
+				tuple.SrcPort,
+				tuple.DstAddr,
+				tuple.DstPort,
+				flowConfig.Proto,
+				FindHostIp(config.Hosts, nextHopHostName),
+				volume.Bytes,
+				flowConfig.FieldValues,
+			)
+
+			payload.NumPackets = uint32(volume.Packets)
+
+			if interfaces := h.FlowInterfaces[i]; interfaces.Set {
+				payload.SnmpInIndex = interfaces.Input
+				payload.SnmpOutIndex = interfaces.Output
+			}
+
+			if tuple.Nat {
+				payload.SetPostNat(tuple.PostNat)
+			}
+
+			// The times of a record are the same on all hops of the flow,
+			//  each hop adds FLOW_HOP_DELAY_MS
+			if flowConfig.Duration.Set {
+				flowConfig.Lifecycle.Export.Apply(&payload, h.Clock, enabledFlow.HostIndex)
+			} else {
+				TickChunk(tickMs, numHops).Apply(&payload, h.Clock, enabledFlow.HostIndex)
+			}
+
+			// Update the flow state
+			h.FlowStates[i].Count++
+			h.FlowStates[i].Bytes += volume.Bytes
+
+			// Print the flow record
+			if !opts.DisableLogging {
+				fmt.Printf(
+					"%15s = %15s %5d -> %15s %5d [%3d] = %s -> %s = %d\n",
+					h.Host.Name,
+					payload.SrcAddrString(),
+					payload.SrcPort,
+					payload.DstAddrString(),
+					payload.DstPort,
+					payload.IpProtocol,
+					unixMillisToTime(h.Clock.UptimeToUnixMillis(payload.SysUptimeStart)).Format("2006-01-02T15:04:05.000Z"),
+					unixMillisToTime(h.Clock.UptimeToUnixMillis(payload.SysUptimeEnd)).Format("2006-01-02T15:04:05.000Z"),
+					payload.NumOctets,
+				)
+			}
+
+			records = append(records, payload)
+		}
+
+		if len(records) == 0 {
+			continue
+		}
+
+		if h.Pacer != nil && h.Pacer.Wait() {
+			fmt.Printf("Warning: host %s can not keep up with the target rate of %.1f records/s\n", h.Host.Name, h.Pacer.Rate)
+		}
+
+		// Create the netflow packets, sflow can split the records into
+		//  several datagrams
+		for _, buffer := range h.Exporter.BuildPackets(records) {
+			// Write the netflow packet to the collector connection
+			if !opts.Simulate {
+				bytesWritten, err := h.Conn.Write(buffer)
+				if err != nil {
+					log.Fatal("Failed to write: ", err)
+				}
+
+				sentRecordsTotalBytesCounter.Add(float64(bytesWritten))
+			}
+
+			sentNetflowTotalCounter.Inc()
+		}
+
+		// Update prometheus metrics
+		sentRecordsTotalCounter.Add(float64(len(records)))
+
+		if h.Pacer != nil {
+			h.Pacer.Sent(len(records))
+		}
+
+		sent += len(records)
+	}
+
+	return active, sent
+}
+
+func (h *HostRunner) PrintStats(flowConfigs []ConfigFlow) {
+	for i := 0; i < len(h.FlowStates); i++ {
+		flowConfig := flowConfigs[h.EnabledFlows[i].ConfigIndex]
+		flowConfigState := h.FlowStates[i]
+		tuple := flowConfig.HopTuple(h.EnabledFlows[i].HostIndex)
+
+		scenario := ""
+		if flowConfig.Scenario != nil {
+			scenario = " (scenario " + flowConfig.Scenario.Name + ")"
+		}
+
+		fmt.Printf(
+			"%15s = %15s %5d -> %15s %5d [%3d] = %d total = %d bytes%s\n",
+			h.Host.Name,
+			tuple.SrcAddr,
+			tuple.SrcPort,
+			tuple.DstAddr,
+			tuple.DstPort,
+			flowConfig.Proto,
+			flowConfigState.Count,
+			flowConfigState.Bytes,
+			scenario,
+		)
+	}
+}
+
+// Stats file name for a host when several hosts are simulated,
+// stats.json becomes stats-gw1.json
+func HostStatsFileName(filename string, hostName string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + hostName + ext
+}
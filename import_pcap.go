@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const COMMAND_IMPORT_PCAP = "import-pcap"
+
+const (
+	IMPORT_HOST_NAME      = "gw1"
+	IMPORT_HOST_IP        = "127.0.0.1"
+	IMPORT_COLLECTOR_IP   = "127.0.0.1"
+	IMPORT_COLLECTOR_PORT = 9995
+)
+
+// 5-tuple of the captured packets
+type ImportFlowKey struct {
+	SrcAddr string
+	DstAddr string
+	SrcPort uint16
+	DstPort uint16
+	Proto   int
+}
+
+// Totals of a 5-tuple, Windows are the flow_timeout intervals of the
+// capture in which the tuple has packets
+type ImportFlowTotal struct {
+	Bytes    int
+	Packets  int
+	TcpFlags uint8
+	Windows  map[int64]bool
+}
+
+// Config file written by import-pcap, only the settings it fills in
+type ImportConfigFile struct {
+	Seed          int                `json:"seed"`
+	FlowTimeout   int                `json:"flow_timeout"`
+	CollectorIp   string             `json:"collector_ip"`
+	CollectorPort int                `json:"collector_port"`
+	ExportFormat  string             `json:"export_format,omitempty"`
+	Hosts         []ImportConfigHost `json:"hosts"`
+	Flows         []ImportConfigFlow `json:"flows"`
+}
+
+type ImportConfigHost struct {
+	Ip   string `json:"ip"`
+	Name string `json:"name"`
+}
+
+type ImportConfigFlow struct {
+	SrcAddr           string                  `json:"src_addr"`
+	SrcPort           string                  `json:"src_port,omitempty"`
+	DstAddr           string                  `json:"dst_addr"`
+	DstPort           string                  `json:"dst_port,omitempty"`
+	Proto             string                  `json:"proto"`
+	Hops              []string                `json:"hops"`
+	Count             int                     `json:"count"`
+	Packets           string                  `json:"packets"`
+	TcpFlags          string                  `json:"tcp_flags,omitempty"`
+	BytesDistribution ImportBytesDistribution `json:"bytes_distribution"`
+}
+
+type ImportBytesDistribution struct {
+	Type  string `json:"type"`
+	Value int    `json:"value"`
+}
+
+// Aggregate the IP packets of a capture by 5-tuple, the windows are
+// counted from the first packet of the capture
+func AggregatePcapFlows(packets []PcapPacket, flowTimeout int) map[ImportFlowKey]*ImportFlowTotal {
+	flows := map[ImportFlowKey]*ImportFlowTotal{}
+
+	var start int64
+	started := false
+
+	for _, packet := range packets {
+		ipPacket, ok := DecodePcapPacket(packet)
+
+		if !ok {
+			continue
+		}
+
+		if !started {
+			start = packet.Timestamp
+			started = true
+		}
+
+		key := ImportFlowKey{
+			SrcAddr: ipPacket.SrcAddr.String(),
+			DstAddr: ipPacket.DstAddr.String(),
+			SrcPort: ipPacket.SrcPort,
+			DstPort: ipPacket.DstPort,
+			Proto:   ipPacket.Proto,
+		}
+
+		total, ok := flows[key]
+
+		if !ok {
+			total = &ImportFlowTotal{Windows: map[int64]bool{}}
+			flows[key] = total
+		}
+
+		total.Bytes += ipPacket.Bytes
+		total.Packets++
+		total.TcpFlags |= ipPacket.TcpFlags
+		total.Windows[(packet.Timestamp-start)/(int64(flowTimeout)*1000000000)] = true
+	}
+
+	return flows
+}
+
+// Flows of the config file for the aggregated 5-tuples, largest first.
+// Every window of a tuple becomes one record of the flow, so the flow is
+// sent count times with the average bytes and packets of its windows
+func ImportConfigFlows(flows map[ImportFlowKey]*ImportFlowTotal, hostName string, top int) []ImportConfigFlow {
+	var keys []ImportFlowKey
+
+	for key := range flows {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+
+		if flows[a].Bytes != flows[b].Bytes {
+			return flows[a].Bytes > flows[b].Bytes
+		}
+		if a.SrcAddr != b.SrcAddr {
+			return a.SrcAddr < b.SrcAddr
+		}
+		if a.DstAddr != b.DstAddr {
+			return a.DstAddr < b.DstAddr
+		}
+		if a.SrcPort != b.SrcPort {
+			return a.SrcPort < b.SrcPort
+		}
+		if a.DstPort != b.DstPort {
+			return a.DstPort < b.DstPort
+		}
+		return a.Proto < b.Proto
+	})
+
+	if top > 0 && len(keys) > top {
+		keys = keys[:top]
+	}
+
+	var configFlows []ImportConfigFlow
+
+	for _, key := range keys {
+		total := flows[key]
+		count := len(total.Windows)
+
+		// Small packets of a tuple can average below one byte per record
+		bytes := total.Bytes / count
+		if bytes == 0 {
+			bytes = 1
+		}
+
+		packets := total.Packets / count
+		if packets == 0 {
+			packets = 1
+		}
+
+		flow := ImportConfigFlow{
+			SrcAddr: key.SrcAddr,
+			DstAddr: key.DstAddr,
+			Proto:   strconv.Itoa(key.Proto),
+			Hops:    []string{hostName},
+			Count:   count,
+			Packets: strconv.Itoa(packets),
+			BytesDistribution: ImportBytesDistribution{
+				Type:  BYTES_DIST_CONSTANT,
+				Value: bytes,
+			},
+		}
+
+		// The ports of the other protocols are left out, they stay 0
+		if ProtoHasPorts(key.Proto) {
+			flow.SrcPort = strconv.Itoa(int(key.SrcPort))
+			flow.DstPort = strconv.Itoa(int(key.DstPort))
+		}
+
+		if total.TcpFlags != 0 {
+			flow.TcpFlags = strconv.Itoa(int(total.TcpFlags))
+		}
+
+		configFlows = append(configFlows, flow)
+	}
+
+	return configFlows
+}
+
+// Write a config file reproducing the traffic mix of a capture, sent by
+// a single host
+func RunImportPcap(pcapFile string, configFile string, hostName string, flowTimeout int, top int) error {
+	if flowTimeout <= 0 {
+		return fmt.Errorf("invalid flow timeout %d: must be greater than 0", flowTimeout)
+	}
+
+	if hostName == "" {
+		hostName = IMPORT_HOST_NAME
+	}
+
+	packets, err := ReadPcapFile(pcapFile)
+
+	if err != nil {
+		return err
+	}
+
+	flows := AggregatePcapFlows(packets, flowTimeout)
+
+	if len(flows) == 0 {
+		return fmt.Errorf("no IP packets found in pcap file %s", pcapFile)
+	}
+
+	config := ImportConfigFile{
+		Seed:          1,
+		FlowTimeout:   flowTimeout,
+		CollectorIp:   IMPORT_COLLECTOR_IP,
+		CollectorPort: IMPORT_COLLECTOR_PORT,
+		Hosts:         []ImportConfigHost{{Ip: IMPORT_HOST_IP, Name: hostName}},
+		Flows:         ImportConfigFlows(flows, hostName, top),
+	}
+
+	// Netflow v5 can not carry the IPv6 flows of the capture
+	for _, flow := range config.Flows {
+		if addr, _ := netip.ParseAddr(flow.SrcAddr); addr.Is6() {
+			config.ExportFormat = EXPORT_FORMAT_IPFIX
+		}
+	}
+
+	outFile, err := os.Create(configFile)
+
+	if err != nil {
+		return fmt.Errorf("failed to create config file %s: %v", configFile, err)
+	}
+
+	defer outFile.Close()
+
+	configJson, err := json.MarshalIndent(config, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %v", err)
+	}
+
+	_, err = outFile.WriteString(string(configJson) + "\n")
+
+	if err != nil {
+		return fmt.Errorf("failed to write config file %s: %v", configFile, err)
+	}
+
+	err = outFile.Sync()
+
+	if err != nil {
+		return fmt.Errorf("failed to sync config file %s: %v", configFile, err)
+	}
+
+	// Frames that are not IP packets are skipped by the aggregation
+	aggregated := 0
+	for _, total := range flows {
+		aggregated += total.Packets
+	}
+
+	fmt.Printf("Imported %d packets into %d of %d flows\n", aggregated, len(config.Flows), len(flows))
+	fmt.Println("Successfully generated config file: " + configFile)
+
+	return nil
+}
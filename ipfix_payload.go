@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const IPFIX_VERSION = 10
+
+// IPFIX information element ids (RFC 7012 / IANA registry)
+const (
+	IPFIX_OCTET_DELTA_COUNT           = 1
+	IPFIX_PACKET_DELTA_COUNT          = 2
+	IPFIX_PROTOCOL_IDENTIFIER         = 4
+	IPFIX_IP_CLASS_OF_SERVICE         = 5
+	IPFIX_TCP_CONTROL_BITS            = 6
+	IPFIX_SOURCE_TRANSPORT_PORT       = 7
+	IPFIX_SOURCE_IPV4_ADDRESS         = 8
+	IPFIX_SOURCE_IPV4_PREFIX_LENGTH   = 9
+	IPFIX_INGRESS_INTERFACE           = 10
+	IPFIX_DESTINATION_TRANSPORT_PORT  = 11
+	IPFIX_DESTINATION_IPV4_ADDRESS    = 12
+	IPFIX_DESTINATION_IPV4_PREFIX_LEN = 13
+	IPFIX_EGRESS_INTERFACE            = 14
+	IPFIX_IP_NEXT_HOP_IPV4_ADDRESS    = 15
+	IPFIX_BGP_SOURCE_AS_NUMBER        = 16
+	IPFIX_BGP_DESTINATION_AS_NUMBER   = 17
+	IPFIX_SOURCE_IPV6_ADDRESS         = 27
+	IPFIX_DESTINATION_IPV6_ADDRESS    = 28
+	IPFIX_SOURCE_IPV6_PREFIX_LENGTH   = 29
+	IPFIX_DESTINATION_IPV6_PREFIX_LEN = 30
+	IPFIX_IP_NEXT_HOP_IPV6_ADDRESS    = 62
+	IPFIX_FLOW_START_MILLISECONDS     = 152
+	IPFIX_FLOW_END_MILLISECONDS       = 153
+	IPFIX_POST_NAT_SOURCE_IPV4        = 225
+	IPFIX_POST_NAT_DESTINATION_IPV4   = 226
+	IPFIX_POST_NAPT_SOURCE_PORT       = 227
+	IPFIX_POST_NAPT_DESTINATION_PORT  = 228
+	IPFIX_POST_NAT_SOURCE_IPV6        = 281
+	IPFIX_POST_NAT_DESTINATION_IPV6   = 282
+	IPFIX_TEMPLATE_SET_ID             = 2
+	IPFIX_TEMPLATE_ID                 = 256
+	IPFIX_TEMPLATE_ID_V6              = 257
+	IPFIX_TEMPLATE_ID_NAT             = 258
+	IPFIX_TEMPLATE_ID_NAT_V6          = 259
+
+	// Options template announcing the sampling of the exporter
+	IPFIX_OPTIONS_TEMPLATE_SET_ID   = 3
+	IPFIX_OBSERVATION_DOMAIN_ID     = 149
+	IPFIX_SELECTOR_ALGORITHM        = 304
+	IPFIX_SAMPLING_PACKET_INTERVAL  = 305
+	IPFIX_SELECTOR_SYSTEMATIC_COUNT = 1
+	IPFIX_TEMPLATE_ID_SAMPLING      = 260
+)
+
+type IpfixHeader struct {
+	Version             uint16
+	Length              uint16
+	ExportTime          uint32
+	SequenceNumber      uint32
+	ObservationDomainId uint32
+}
+
+type IpfixSetHeader struct {
+	SetId  uint16
+	Length uint16
+}
+
+type IpfixFieldSpecifier struct {
+	Id     uint16
+	Length uint16
+}
+
+type IpfixTemplate struct {
+	Id     uint16
+	Fields []IpfixFieldSpecifier
+}
+
+var ipfixTemplate = IpfixTemplate{
+	Id: IPFIX_TEMPLATE_ID,
+	Fields: []IpfixFieldSpecifier{
+		{IPFIX_SOURCE_IPV4_ADDRESS, 4},
+		{IPFIX_DESTINATION_IPV4_ADDRESS, 4},
+		{IPFIX_IP_NEXT_HOP_IPV4_ADDRESS, 4},
+		{IPFIX_INGRESS_INTERFACE, 4},
+		{IPFIX_EGRESS_INTERFACE, 4},
+		{IPFIX_PACKET_DELTA_COUNT, 8},
+		{IPFIX_OCTET_DELTA_COUNT, 8},
+		{IPFIX_FLOW_START_MILLISECONDS, 8},
+		{IPFIX_FLOW_END_MILLISECONDS, 8},
+		{IPFIX_SOURCE_TRANSPORT_PORT, 2},
+		{IPFIX_DESTINATION_TRANSPORT_PORT, 2},
+		{IPFIX_TCP_CONTROL_BITS, 2},
+		{IPFIX_PROTOCOL_IDENTIFIER, 1},
+		{IPFIX_IP_CLASS_OF_SERVICE, 1},
+		{IPFIX_BGP_SOURCE_AS_NUMBER, 4},
+		{IPFIX_BGP_DESTINATION_AS_NUMBER, 4},
+		{IPFIX_SOURCE_IPV4_PREFIX_LENGTH, 1},
+		{IPFIX_DESTINATION_IPV4_PREFIX_LEN, 1},
+	},
+}
+
+// Same layout as ipfixTemplate with IPv6 addresses
+var ipfixTemplateV6 = IpfixTemplate{
+	Id: IPFIX_TEMPLATE_ID_V6,
+	Fields: []IpfixFieldSpecifier{
+		{IPFIX_SOURCE_IPV6_ADDRESS, 16},
+		{IPFIX_DESTINATION_IPV6_ADDRESS, 16},
+		{IPFIX_IP_NEXT_HOP_IPV6_ADDRESS, 16},
+		{IPFIX_INGRESS_INTERFACE, 4},
+		{IPFIX_EGRESS_INTERFACE, 4},
+		{IPFIX_PACKET_DELTA_COUNT, 8},
+		{IPFIX_OCTET_DELTA_COUNT, 8},
+		{IPFIX_FLOW_START_MILLISECONDS, 8},
+		{IPFIX_FLOW_END_MILLISECONDS, 8},
+		{IPFIX_SOURCE_TRANSPORT_PORT, 2},
+		{IPFIX_DESTINATION_TRANSPORT_PORT, 2},
+		{IPFIX_TCP_CONTROL_BITS, 2},
+		{IPFIX_PROTOCOL_IDENTIFIER, 1},
+		{IPFIX_IP_CLASS_OF_SERVICE, 1},
+		{IPFIX_BGP_SOURCE_AS_NUMBER, 4},
+		{IPFIX_BGP_DESTINATION_AS_NUMBER, 4},
+		{IPFIX_SOURCE_IPV6_PREFIX_LENGTH, 1},
+		{IPFIX_DESTINATION_IPV6_PREFIX_LEN, 1},
+	},
+}
+
+// Templates of records exported by a hop doing address translation, the
+// post NAT tuple follows the fields of the regular templates
+var ipfixTemplateNat = IpfixTemplate{
+	Id: IPFIX_TEMPLATE_ID_NAT,
+	Fields: append(append([]IpfixFieldSpecifier{}, ipfixTemplate.Fields...),
+		IpfixFieldSpecifier{IPFIX_POST_NAT_SOURCE_IPV4, 4},
+		IpfixFieldSpecifier{IPFIX_POST_NAT_DESTINATION_IPV4, 4},
+		IpfixFieldSpecifier{IPFIX_POST_NAPT_SOURCE_PORT, 2},
+		IpfixFieldSpecifier{IPFIX_POST_NAPT_DESTINATION_PORT, 2},
+	),
+}
+
+var ipfixTemplateNatV6 = IpfixTemplate{
+	Id: IPFIX_TEMPLATE_ID_NAT_V6,
+	Fields: append(append([]IpfixFieldSpecifier{}, ipfixTemplateV6.Fields...),
+		IpfixFieldSpecifier{IPFIX_POST_NAT_SOURCE_IPV6, 16},
+		IpfixFieldSpecifier{IPFIX_POST_NAT_DESTINATION_IPV6, 16},
+		IpfixFieldSpecifier{IPFIX_POST_NAPT_SOURCE_PORT, 2},
+		IpfixFieldSpecifier{IPFIX_POST_NAPT_DESTINATION_PORT, 2},
+	),
+}
+
+var ipfixTemplates = []IpfixTemplate{
+	ipfixTemplate,
+	ipfixTemplateV6,
+	ipfixTemplateNat,
+	ipfixTemplateNatV6,
+}
+
+// Wire layout of a single data record, must match ipfixTemplate
+type IpfixRecord struct {
+	SrcIP           uint32
+	DstIP           uint32
+	NextHopIP       uint32
+	IngressIndex    uint32
+	EgressIndex     uint32
+	NumPackets      uint64
+	NumOctets       uint64
+	FlowStartMillis uint64
+	FlowEndMillis   uint64
+	SrcPort         uint16
+	DstPort         uint16
+	TcpFlags        uint16
+	IpProtocol      uint8
+	IpTos           uint8
+	SrcAsNumber     uint32
+	DstAsNumber     uint32
+	SrcPrefixMask   uint8
+	DstPrefixMask   uint8
+}
+
+// Wire layout of a single data record, must match ipfixTemplateV6
+type IpfixRecordV6 struct {
+	SrcIP           [16]byte
+	DstIP           [16]byte
+	NextHopIP       [16]byte
+	IngressIndex    uint32
+	EgressIndex     uint32
+	NumPackets      uint64
+	NumOctets       uint64
+	FlowStartMillis uint64
+	FlowEndMillis   uint64
+	SrcPort         uint16
+	DstPort         uint16
+	TcpFlags        uint16
+	IpProtocol      uint8
+	IpTos           uint8
+	SrcAsNumber     uint32
+	DstAsNumber     uint32
+	SrcPrefixMask   uint8
+	DstPrefixMask   uint8
+}
+
+// Wire layout of a single data record, must match ipfixTemplateNat
+type IpfixRecordNat struct {
+	IpfixRecord
+	PostNatSrcIP   uint32
+	PostNatDstIP   uint32
+	PostNatSrcPort uint16
+	PostNatDstPort uint16
+}
+
+// Wire layout of a single data record, must match ipfixTemplateNatV6
+type IpfixRecordNatV6 struct {
+	IpfixRecordV6
+	PostNatSrcIP   [16]byte
+	PostNatDstIP   [16]byte
+	PostNatSrcPort uint16
+	PostNatDstPort uint16
+}
+
+// Wire layout of the sampling options record, observation domain scope
+// followed by the sampling interval and selector algorithm
+type IpfixSamplingRecord struct {
+	ObservationDomainId    uint32
+	SamplingPacketInterval uint32
+	SelectorAlgorithm      uint8
+}
+
+// IPFIX exporter state, one per simulated host
+// A refresh count and period of 0 only sends the template in the first
+// message, which is what the RFC requires for TCP sessions
+type IpfixExporter struct {
+	Clock                 *HostClock
+	ObservationDomainId   uint32
+	TemplateRefreshPkts   int
+	TemplateRefreshPeriod time.Duration
+	SamplingRate          int
+
+	sequenceNumber   uint32
+	pktsSinceRefresh int
+	lastRefresh      time.Time
+}
+
+func NewIpfixExporter(clock *HostClock, observationDomainId uint32, refreshPkts int, refreshPeriod time.Duration) *IpfixExporter {
+	return &IpfixExporter{
+		Clock:                 clock,
+		ObservationDomainId:   observationDomainId,
+		TemplateRefreshPkts:   refreshPkts,
+		TemplateRefreshPeriod: refreshPeriod,
+	}
+}
+
+func (e *IpfixExporter) templateDue(now time.Time) bool {
+	if e.lastRefresh.IsZero() {
+		return true
+	}
+
+	if e.TemplateRefreshPkts > 0 && e.pktsSinceRefresh >= e.TemplateRefreshPkts {
+		return true
+	}
+
+	if e.TemplateRefreshPeriod > 0 && now.Sub(e.lastRefresh) >= e.TemplateRefreshPeriod {
+		return true
+	}
+
+	return false
+}
+
+func (e *IpfixExporter) BuildPackets(records []FlowRecord) [][]byte {
+	return [][]byte{e.BuildPacket(records)}
+}
+
+func (e *IpfixExporter) BuildPacket(records []FlowRecord) []byte {
+	uptime := e.Clock.CreateCalcUptime()
+	now := time.Unix(int64(uptime.UnixSec), int64(uptime.UnixMsec))
+
+	body := new(bytes.Buffer)
+
+	if e.templateDue(now) {
+		writeIpfixTemplateSet(body, ipfixTemplates...)
+
+		// Sampling is announced with an options template and data record
+		if e.SamplingRate > 1 {
+			writeIpfixSamplingSets(body, e.ObservationDomainId, e.SamplingRate)
+		}
+
+		e.pktsSinceRefresh = 0
+		e.lastRefresh = now
+	}
+
+	ipv4Records, ipv6Records := SplitRecordsByFamily(records)
+	ipv4Records, ipv4NatRecords := SplitRecordsByNat(ipv4Records)
+	ipv6Records, ipv6NatRecords := SplitRecordsByNat(ipv6Records)
+
+	if len(ipv4Records) > 0 {
+		writeIpfixDataSet(body, IPFIX_TEMPLATE_ID, ipv4Records, e.Clock)
+	}
+
+	if len(ipv6Records) > 0 {
+		writeIpfixDataSet(body, IPFIX_TEMPLATE_ID_V6, ipv6Records, e.Clock)
+	}
+
+	if len(ipv4NatRecords) > 0 {
+		writeIpfixDataSet(body, IPFIX_TEMPLATE_ID_NAT, ipv4NatRecords, e.Clock)
+	}
+
+	if len(ipv6NatRecords) > 0 {
+		writeIpfixDataSet(body, IPFIX_TEMPLATE_ID_NAT_V6, ipv6NatRecords, e.Clock)
+	}
+
+	header := IpfixHeader{
+		Version:             IPFIX_VERSION,
+		Length:              uint16(16 + body.Len()),
+		ExportTime:          uptime.UnixSec,
+		SequenceNumber:      e.sequenceNumber,
+		ObservationDomainId: e.ObservationDomainId,
+	}
+
+	// The sequence number counts data records, not messages
+	e.sequenceNumber += uint32(len(records))
+	e.pktsSinceRefresh++
+
+	buffer := new(bytes.Buffer)
+	err := binary.Write(buffer, binary.BigEndian, &header)
+	if err != nil {
+		log.Println("Writing ipfix header failed:", err)
+	}
+
+	buffer.Write(body.Bytes())
+
+	return buffer.Bytes()
+}
+
+func writeIpfixTemplateSet(buffer *bytes.Buffer, templates ...IpfixTemplate) {
+	// Set header + (template id + field count + fields) per template
+	length := 4
+	for _, template := range templates {
+		length += 4 + 4*len(template.Fields)
+	}
+
+	binary.Write(buffer, binary.BigEndian, IpfixSetHeader{
+		SetId:  IPFIX_TEMPLATE_SET_ID,
+		Length: uint16(length),
+	})
+
+	for _, template := range templates {
+		binary.Write(buffer, binary.BigEndian, template.Id)
+		binary.Write(buffer, binary.BigEndian, uint16(len(template.Fields)))
+
+		for _, field := range template.Fields {
+			binary.Write(buffer, binary.BigEndian, field)
+		}
+	}
+}
+
+func writeIpfixSamplingSets(buffer *bytes.Buffer, observationDomainId uint32, samplingRate int) {
+	// Set header + template id + field count + scope field count + 3 fields
+	binary.Write(buffer, binary.BigEndian, IpfixSetHeader{
+		SetId:  IPFIX_OPTIONS_TEMPLATE_SET_ID,
+		Length: 4 + 6 + 3*4,
+	})
+	binary.Write(buffer, binary.BigEndian, uint16(IPFIX_TEMPLATE_ID_SAMPLING))
+	binary.Write(buffer, binary.BigEndian, uint16(3))
+	binary.Write(buffer, binary.BigEndian, uint16(1))
+	binary.Write(buffer, binary.BigEndian, IpfixFieldSpecifier{IPFIX_OBSERVATION_DOMAIN_ID, 4})
+	binary.Write(buffer, binary.BigEndian, IpfixFieldSpecifier{IPFIX_SAMPLING_PACKET_INTERVAL, 4})
+	binary.Write(buffer, binary.BigEndian, IpfixFieldSpecifier{IPFIX_SELECTOR_ALGORITHM, 1})
+
+	binary.Write(buffer, binary.BigEndian, IpfixSetHeader{
+		SetId:  IPFIX_TEMPLATE_ID_SAMPLING,
+		Length: 4 + 9,
+	})
+	binary.Write(buffer, binary.BigEndian, IpfixSamplingRecord{
+		ObservationDomainId:    observationDomainId,
+		SamplingPacketInterval: uint32(samplingRate),
+		SelectorAlgorithm:      IPFIX_SELECTOR_SYSTEMATIC_COUNT,
+	})
+}
+
+func newIpfixRecord(record FlowRecord, clock *HostClock) interface{} {
+	if record.IsIPv6 {
+		v6Record := IpfixRecordV6{
+			SrcIP:           record.SrcIP6,
+			DstIP:           record.DstIP6,
+			NextHopIP:       record.NextHopIP6,
+			IngressIndex:    uint32(record.SnmpInIndex),
+			EgressIndex:     uint32(record.SnmpOutIndex),
+			NumPackets:      uint64(record.NumPackets),
+			NumOctets:       uint64(record.NumOctets),
+			FlowStartMillis: clock.UptimeToUnixMillis(record.SysUptimeStart),
+			FlowEndMillis:   clock.UptimeToUnixMillis(record.SysUptimeEnd),
+			SrcPort:         record.SrcPort,
+			DstPort:         record.DstPort,
+			TcpFlags:        uint16(record.TcpFlags),
+			IpProtocol:      record.IpProtocol,
+			IpTos:           record.IpTos,
+			SrcAsNumber:     uint32(record.SrcAsNumber),
+			DstAsNumber:     uint32(record.DstAsNumber),
+			SrcPrefixMask:   record.SrcPrefixMask,
+			DstPrefixMask:   record.DstPrefixMask,
+		}
+
+		if record.Nat {
+			return IpfixRecordNatV6{
+				IpfixRecordV6:  v6Record,
+				PostNatSrcIP:   record.PostNatSrcIP6,
+				PostNatDstIP:   record.PostNatDstIP6,
+				PostNatSrcPort: record.PostNatSrcPort,
+				PostNatDstPort: record.PostNatDstPort,
+			}
+		}
+
+		return v6Record
+	}
+
+	v4Record := IpfixRecord{
+		SrcIP:           record.SrcIP,
+		DstIP:           record.DstIP,
+		NextHopIP:       record.NextHopIP,
+		IngressIndex:    uint32(record.SnmpInIndex),
+		EgressIndex:     uint32(record.SnmpOutIndex),
+		NumPackets:      uint64(record.NumPackets),
+		NumOctets:       uint64(record.NumOctets),
+		FlowStartMillis: clock.UptimeToUnixMillis(record.SysUptimeStart),
+		FlowEndMillis:   clock.UptimeToUnixMillis(record.SysUptimeEnd),
+		SrcPort:         record.SrcPort,
+		DstPort:         record.DstPort,
+		TcpFlags:        uint16(record.TcpFlags),
+		IpProtocol:      record.IpProtocol,
+		IpTos:           record.IpTos,
+		SrcAsNumber:     uint32(record.SrcAsNumber),
+		DstAsNumber:     uint32(record.DstAsNumber),
+		SrcPrefixMask:   record.SrcPrefixMask,
+		DstPrefixMask:   record.DstPrefixMask,
+	}
+
+	if record.Nat {
+		return IpfixRecordNat{
+			IpfixRecord:    v4Record,
+			PostNatSrcIP:   record.PostNatSrcIP,
+			PostNatDstIP:   record.PostNatDstIP,
+			PostNatSrcPort: record.PostNatSrcPort,
+			PostNatDstPort: record.PostNatDstPort,
+		}
+	}
+
+	return v4Record
+}
+
+func writeIpfixDataSet(buffer *bytes.Buffer, templateId uint16, records []FlowRecord, clock *HostClock) {
+	data := new(bytes.Buffer)
+
+	for _, record := range records {
+		err := binary.Write(data, binary.BigEndian, newIpfixRecord(record, clock))
+		if err != nil {
+			log.Println("Writing ipfix record failed:", err)
+		}
+	}
+
+	binary.Write(buffer, binary.BigEndian, IpfixSetHeader{
+		SetId:  templateId,
+		Length: uint16(4 + data.Len()),
+	})
+	buffer.Write(data.Bytes())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIpfixRoundTrip(t *testing.T) {
+	natRecord := testFlowRecord("fd00::5", "fd00::6", 41000, 80, PROTO_TCP, 2, 900)
+	natRecord.SetPostNat(FlowTuple{SrcAddr: "fd00::7", DstAddr: "fd00::6", SrcPort: 20000, DstPort: 80})
+
+	records := []FlowRecord{
+		testFlowRecord("10.1.0.1", "10.2.0.1", 40000, 443, PROTO_TCP, 3, 1500),
+		testFlowRecord("fd00::1", "fd00::2", 53000, 53, PROTO_UDP, 1, 80),
+		natRecord,
+		testFlowRecord("10.1.0.2", "10.2.0.3", 0, 0, 1, 1, 84),
+	}
+
+	tests := []struct {
+		name         string
+		samplingRate int
+	}{
+		{"unsampled", 1},
+		{"sampled", 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := NewIpfixExporter(testClock(), 70000, 20, 30*time.Second)
+			exporter.SamplingRate = test.samplingRate
+
+			collector := collectPackets(t, exporter.BuildPackets(records))
+
+			checkCollectedFlows(t, collectedExporter(t, collector, 70000), records)
+		})
+	}
+}
+
+func TestIpfixSequenceNumber(t *testing.T) {
+	tests := []struct {
+		name     string
+		received []int
+		wantLost int
+	}{
+		{"all messages", []int{0, 1, 2}, 0},
+		{"message with 2 records lost", []int{0, 2}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The template is only sent in the first message, like over tcp
+			exporter := NewIpfixExporter(testClock(), 1, 0, 0)
+			exporter.SamplingRate = 10
+
+			var messages [][]byte
+
+			for i := 0; i < 3; i++ {
+				messages = append(messages, exporter.BuildPackets([]FlowRecord{
+					testFlowRecord("10.1.0.1", "10.2.0.1", 40000, uint16(i), PROTO_TCP, 1, 100),
+					testFlowRecord("10.1.0.2", "10.2.0.1", 40000, uint16(i), PROTO_TCP, 1, 100),
+				})...)
+			}
+
+			var received [][]byte
+			for _, i := range test.received {
+				received = append(received, messages[i])
+			}
+
+			state := collectedExporter(t, collectPackets(t, received), 1)
+
+			if state.LostRecords != test.wantLost || state.OutOfOrder != 0 {
+				t.Errorf("got %d lost records %d out of order, want %d lost records", state.LostRecords, state.OutOfOrder, test.wantLost)
+			}
+		})
+	}
+}
@@ -10,9 +10,10 @@ package main
 
 import (
 	"fmt"
-	"net"
+	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -45,6 +46,76 @@ func main() {
 		panic(err)
 	}
 
+	// Send random flows to the collector given on the command line, quick
+	//  mode takes no command
+	if opts.Target != "" {
+		if configArgs.Command != "" {
+			panic(fmt.Errorf("-t can not be used with the %s command", configArgs.Command))
+		}
+
+		err := RunQuickMode(opts.Target, opts.Port)
+
+		if err != nil {
+			panic(err)
+		}
+
+		return
+	}
+
+	// Run as a collector that verifies what the generators sent
+	if configArgs.Command == COMMAND_COLLECT {
+		listenAddr := opts.ListenAddr
+
+		if listenAddr == "" {
+			var config ConfigFile
+
+			err = ReadFlowConfigFile(&config, configArgs.ConfigFile)
+
+			if err != nil {
+				panic(err)
+			}
+
+			listenAddr = ":" + strconv.Itoa(config.CollectorPort)
+		}
+
+		err := RunCollector(listenAddr, time.Duration(opts.IdleTimeout)*time.Second, configArgs.Args)
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	} else if configArgs.Command == COMMAND_VALIDATE {
+		configFile := configArgs.ConfigFile
+		if len(configArgs.Args) > 0 {
+			configFile = configArgs.Args[0]
+		}
+
+		err := RunValidate(configFile)
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	} else if configArgs.Command == COMMAND_IMPORT_PCAP {
+		if len(configArgs.Args) != 2 {
+			panic(fmt.Errorf("usage: manflow import-pcap <pcap file> <config file>"))
+		}
+
+		err := RunImportPcap(configArgs.Args[0], configArgs.Args[1], configArgs.HostName, opts.ImportTimeout, opts.ImportTop)
+
+		if err != nil {
+			panic(err)
+		}
+
+		return
+	} else if configArgs.Command != "" {
+		panic(fmt.Errorf("unknown command %s", configArgs.Command))
+	}
+
 	// Read flow configuration file
 	var config ConfigFile
 
@@ -76,7 +147,7 @@ func main() {
 		return
 	}
 
-	if configArgs.HostName == "" {
+	if configArgs.HostName == "" && !opts.AllHosts {
 		panic(fmt.Errorf("host name not provided"))
 	}
 
@@ -84,8 +155,24 @@ func main() {
 		panic(fmt.Errorf("collector ip/port not provided"))
 	}
 
-	hostName := configArgs.HostName
-	fmt.Println("Host: " + hostName)
+	backfill, err := ParseBackfillArgs(opts.BackfillStart, opts.BackfillEnd, opts.BackfillSpeed)
+
+	if err != nil {
+		panic(err)
+	}
+
+	// Hosts simulated by this process
+	var hostNames []string
+
+	if opts.AllHosts {
+		for _, host := range config.Hosts {
+			hostNames = append(hostNames, host.Name)
+		}
+		fmt.Println("Hosts: " + strconv.Itoa(len(hostNames)))
+	} else {
+		hostNames = []string{configArgs.HostName}
+		fmt.Println("Host: " + configArgs.HostName)
+	}
 
 	// Initialize random number generator using seed value
 	randGen := InitRandGen(config)
@@ -100,10 +187,16 @@ func main() {
 
 	// Populate all missing fields using seeded randgen before sending
 	//  so multiple generators will have the same values
-	SeedFlows(flowConfigs, randGen, configArgs, config)
+	SeedFlows(flowConfigs, randGen, config)
 
-	// Filter flows for this host
-	enabledFlows := FilterEnabledFlows(flowConfigs)
+	// Flows of the anomaly scenarios use their own seeded randgen
+	//  so the values of the flows of the config file stay the same
+	scenarioRandGen := InitScenarioRandGen(config)
+	scenarioFlowConfigs := ParseUserScenarios(&config)
+
+	SeedFlows(scenarioFlowConfigs, scenarioRandGen, config)
+
+	flowConfigs = append(flowConfigs, scenarioFlowConfigs...)
 
 	// Generate graph file for topology visualization (WIP)
 	if opts.GenGraphFile != "" {
@@ -116,32 +209,34 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Initialize flow state for each flow
-	configFlowStates := InitFlowState(enabledFlows)
+	// Initialize the flows, flow state and exporter of each host
+	var runners []*HostRunner
+	numEnabledFlows := 0
 
-	// Print all configured flows for this host
-	if !opts.DisableLogging {
-		for i := 0; i < len(enabledFlows); i++ {
-			flowConfig := flowConfigs[enabledFlows[i].ConfigIndex]
-
-			fmt.Printf(
-				"%15s = %15s %5d -> %15s %5d [%3d] = %d (tick %d) (count %d)\n",
-				hostName,
-				flowConfig.SrcAddr,
-				flowConfig.SrcPort,
-				flowConfig.DstAddr,
-				flowConfig.DstPort,
-				flowConfig.Proto,
-				flowConfig.Bytes,
-				flowConfig.Tick,
-				flowConfig.Count,
-			)
+	for _, hostName := range hostNames {
+		runner, err := NewHostRunner(config, hostName, flowConfigs)
+
+		if err != nil {
+			panic(err)
+		}
+
+		// Print all configured flows for this host
+		if !opts.DisableLogging {
+			runner.PrintFlows(flowConfigs)
 		}
+
+		if len(runner.EnabledFlows) == 0 {
+			fmt.Println("No flows configured for host " + hostName)
+			continue
+		}
+
+		fmt.Println("Export format of " + hostName + ": " + HostExportFormat(config, hostName))
+
+		numEnabledFlows += len(runner.EnabledFlows)
+		runners = append(runners, runner)
 	}
 
 	// Print flow configuration information
-	numEnabledFlows := len(enabledFlows)
-
 	fmt.Println("Number of user flow configs: " + strconv.Itoa(len(config.Flows)))
 	fmt.Println("Number of flows configured: " + strconv.Itoa(len(flowConfigs)))
 	fmt.Println("Number of active flows: " + strconv.Itoa(numEnabledFlows))
@@ -152,27 +247,131 @@ func main() {
 		return
 	}
 
-	// Initialize UDP connection to netflow collector
-	var conn *net.UDPConn
+	// Pace the records of the hosts with a target rate, the target rate
+	//  of the config file is shared by all hosts without their own
+	targetRate := config.TargetRate
+
+	if opts.TargetRate < 0 {
+		panic(fmt.Errorf("invalid target rate %v: must not be negative", opts.TargetRate))
+	} else if opts.TargetRate > 0 {
+		targetRate = opts.TargetRate
+	}
+
+	targetRates := HostTargetRates(config, targetRate, HostPeriodicFlows(config, flowConfigs))
+	paced := false
+
+	for _, runner := range runners {
+		rate, ok := targetRates[runner.Host.Name]
+
+		if !ok {
+			continue
+		}
+
+		runner.Pacer = NewRatePacer(rate)
+		paced = true
+
+		targetRateGauge.WithLabelValues(runner.Host.Name).Set(rate)
+		fmt.Printf("Target rate of %s: %.1f records/s\n", runner.Host.Name, rate)
+	}
+
+	// Write the export packets of all hosts to a capture file instead of
+	//  sending them to the collector
+	var pcapWriter *PcapWriter
+
+	if opts.PcapOut != "" {
+		pcapWriter, err = NewPcapWriter(opts.PcapOut)
+
+		if err != nil {
+			panic(err)
+		}
+
+		for _, runner := range runners {
+			runner.Conn, err = pcapWriter.HostConn(config, runner.Host, runner.Clock)
+
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		// The jitter of the records comes from the global randgen, which
+		//  is seeded so captures of a seeded config are reproducible
+		if config.Seed != 0 {
+			rand.Seed(int64(config.Seed))
+		}
+
+		fmt.Println("Writing export packets to " + opts.PcapOut)
+	} else if !opts.Simulate {
+		// Initialize UDP or TCP connection to netflow collector for each host
+		for _, runner := range runners {
+			err = runner.Connect(config, opts.SourceMode)
+
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	// Answer SNMP requests for the interfaces of the simulated hosts
+	if opts.SnmpListen != "" {
+		var snmpHosts []SnmpHost
 
-	if !opts.Simulate {
-		conn, err = InitUdpConn(config)
+		for _, runner := range runners {
+			snmpHosts = append(snmpHosts, SnmpHost{Host: runner.Host, Clock: runner.Clock})
+		}
+
+		agent, err := NewSnmpAgent(opts.SnmpListen, opts.SnmpCommunity, snmpHosts)
 
 		if err != nil {
 			panic(err)
 		}
+
+		fmt.Println("SNMP agent listening on " + opts.SnmpListen)
+		go agent.Serve()
 	}
 
 	// Initialize prometheus metrics server
 	go HandleMetricsServer()
 
-	// Sleep until the start of the next 10 second interval
-	//  so that multiple generators start at roughly the same time
-	now := time.Now()
-	diff := time.Duration(10-now.Second()%10) * time.Second
+	var sendStart time.Time
 
-	fmt.Printf("Sleeping for %v\n", diff)
-	time.Sleep(diff)
+	if backfill != nil {
+		// Backfill sends the ticks of a past time range without waiting,
+		//  the host clocks follow the time of the tick
+		sendStart = backfill.Start
+
+		for _, runner := range runners {
+			backfill.InitClock(runner.Clock)
+		}
+
+		for _, runner := range runners {
+			if runner.Pacer != nil {
+				runner.Pacer.TickDuration = backfill.TickDuration()
+			}
+		}
+
+		fmt.Println("Backfilling from " + backfill.Start.Format(time.RFC3339) + " to " + backfill.End.Format(time.RFC3339))
+		backfill.Begin()
+	} else {
+		// Sleep until the start of the next 10 second interval
+		//  so that multiple generators start at roughly the same time
+		now := time.Now()
+		diff := time.Duration(10-now.Second()%10) * time.Second
+
+		fmt.Printf("Sleeping for %v\n", diff)
+		time.Sleep(diff)
+
+		// Timestamps of long-lived flows are relative to the aligned start time
+		sendStart = time.Now().Truncate(10 * time.Second)
+
+		// Paced hosts spread the packets of a tick over the tick
+		for _, runner := range runners {
+			if runner.Pacer != nil {
+				runner.Pacer.TickDuration = TICK_INTERVAL_MS * time.Millisecond
+			}
+		}
+	}
+
+	absTick := 0
 
 	// Flows are sent every TICK_INTERVAL_MS
 	tick := 0
@@ -185,109 +384,97 @@ func main() {
 		// Initialize bytes value for this tick
 		// Note we initialize bytes for all flows, even if they are not enabled
 		//  so that the same values are used for all generators
-		for i := 0; i < len(flowConfigs); i++ {
-			flowConfigs[i].Bytes = GenBytesValue(randGen)
-		}
-
-		// Send flows for this tick
-		for i := 0; i < len(enabledFlows); {
-			records := []NetflowPayload{}
+		tickMs := TickUnixMillis(sendStart, absTick)
 
-			// Calculate sytem uptime for this tick
-			// This value is used in the netflow packet header
-			uptime := CreateCalcUptime()
-
-			// We send MAX_FLOWS_PER_RECORD netflow records per netflow packet
-			//  so we use a nested loop to send all flows for this tick
-			j := 0
-			for ; j < MAX_FLOWS_PER_RECORD && i < len(enabledFlows); i, j = i+1, j+1 {
-				flowConfig := flowConfigs[enabledFlows[i].ConfigIndex]
+		if backfill != nil {
+			if backfill.Done(tickMs) {
+				fmt.Println("Backfill complete")
+				break
+			}
 
-				// Check if the flow count has been reached
-				if flowConfig.Count != 0 && configFlowStates[i].Count+1 > flowConfig.Count {
-					continue
-				}
+			for _, runner := range runners {
+				runner.Clock.SetSimTime(tickMs * int64(time.Millisecond))
+			}
+		}
 
-				skipped = false
+		for i := 0; i < len(flowConfigs); i++ {
+			if flowConfigs[i].Scenario != nil {
+				flowConfigs[i].AdvanceScenario(absTick, scenarioRandGen)
+				continue
+			}
 
-				if flowConfig.Tick != tick {
-					continue
+			if flowConfigs[i].Reply {
+				flowConfigs[i].MirrorForward(flowConfigs[flowConfigs[i].ForwardIndex])
+			} else {
+				flowConfigs[i].Bytes = GenBytesValue(flowConfigs[i].BytesDistribution, randGen)
+				flowConfigs[i].FieldValues = GenFlowFieldValues(flowConfigs[i].Fields, randGen)
+				// Paced flows do not wait for their tick, so whether they are
+				//  skipped is drawn every tick
+				dueTick := tick
+				if len(targetRates) > 0 && flowConfigs[i].Periodic() {
+					dueTick = flowConfigs[i].Tick
 				}
 
-				// If the flow has multiple hops, check if we should provide a value
-				//  for the next hop field
-				numHops := len(flowConfig.Hops)
+				flowConfigs[i].ApplyProfile(dueTick, tickMs, TickUnixMillis(sendStart, 0), randGen)
+				flowConfigs[i].ApplyWeight(dueTick, randGen)
+			}
 
-				nextHopHostName := ""
-				if flowConfig.HostIndex < numHops-1 {
-					nextHopHostName = flowConfig.Hops[flowConfig.HostIndex+1]
-				}
+			if flowConfigs[i].Duration.Set {
+				flowConfigs[i].AdvanceLifecycle(tick, tickMs, config, randGen)
+			}
 
-				// Create the netflow record
-				payload := CreateCustomFlow(
-					flowConfig.SrcAddr,
-					flowConfig.SrcPort,
-					flowConfig.DstAddr,
-					flowConfig.DstPort,
-					flowConfig.Proto,
-					FindHostIp(config.Hosts, nextHopHostName),
-					flowConfig.Bytes,
-					// TODO improve the logic for first_switched and last_switched
-					int(TICK_INTERVAL_MS/numHops)*(numHops-flowConfig.HostIndex),
-					int(TICK_INTERVAL_MS/numHops)*(numHops-flowConfig.HostIndex-1),
-				)
-
-				// Update the flow state
-				configFlowStates[i].Count++
-				configFlowStates[i].Bytes += flowConfig.Bytes
-
-				// Print the flow record
-				if !opts.DisableLogging {
-					fmt.Printf(
-						"%15s = %15s %5d -> %15s %5d [%3d] = %s -> %s = %d\n",
-						hostName,
-						ConvertIntToIp(payload.SrcIP).String(),
-						payload.SrcPort,
-						ConvertIntToIp(payload.DstIP).String(),
-						payload.DstPort,
-						payload.IpProtocol,
-						time.Unix(int64(uptime.UnixSec+payload.SysUptimeStart/1000), int64(uptime.UnixMsec)).Format("2006-01-02T15:04:05.000Z"),
-						time.Unix(int64(uptime.UnixSec+payload.SysUptimeEnd/1000), int64(uptime.UnixMsec)).Format("2006-01-02T15:04:05.000Z"),
-						payload.NumOctets,
-					)
-				}
+			flowConfigs[i].GenHopVolumes(randGen)
+		}
 
-				records = append(records, payload)
-			}
+		// Send flows of all hosts for this tick concurrently
+		var wg sync.WaitGroup
+		active := make([]bool, len(runners))
 
-			if len(records) == 0 {
+		for r, runner := range runners {
+			// Hosts written to a capture file draw from the global randgen
+			//  in order
+			if pcapWriter != nil {
+				active[r] = runner.SendTick(tick, tickMs, flowConfigs, config)
 				continue
 			}
 
-			// Create the netflow packet
-			data := new(Netflow)
+			wg.Add(1)
 
-			data.Header = CreateNFlowHeader(len(records))
+			go func(r int, runner *HostRunner) {
+				defer wg.Done()
+				active[r] = runner.SendTick(tick, tickMs, flowConfigs, config)
+			}(r, runner)
+		}
 
-			data.Records = records
+		wg.Wait()
 
-			buffer := BuildNFlowPayload(*data)
+		if pcapWriter != nil {
+			err = pcapWriter.Flush()
 
-			// Write the netflow packet to the UDP connection
-			if !opts.Simulate {
-				bytesWritten, err := conn.Write(buffer.Bytes())
-				if err != nil {
-					log.Fatal("Failed to write: ", err)
-				}
+			if err != nil {
+				panic(err)
+			}
+		}
 
-				sentRecordsTotalBytesCounter.Add(float64(bytesWritten))
+		for _, runner := range runners {
+			if runner.Pacer == nil {
+				continue
 			}
 
-			// Update prometheus metrics
-			sentNetflowTotalCounter.Inc()
-			sentRecordsTotalCounter.Add(float64(len(records)))
+			achievedRateGauge.WithLabelValues(runner.Host.Name).Set(runner.Pacer.AchievedRate())
+
+			if (absTick+1)%RATE_REPORT_TICKS == 0 {
+				runner.Pacer.Report(runner.Host.Name)
+			}
 		}
 
+		for _, hostActive := range active {
+			if hostActive {
+				skipped = false
+			}
+		}
+
+		absTick++
 		tick++
 		if tick == maxTick {
 			// If we went through a whole tick cycle without sending any flows
@@ -302,36 +489,55 @@ func main() {
 		}
 
 		// Sleep until the next tick
-		sleepInt := time.Duration(TICK_INTERVAL_MS)
-		time.Sleep(sleepInt * time.Millisecond)
+		if backfill != nil {
+			backfill.Sleep(absTick)
+		} else if paced {
+			// Ticks of paced hosts are due at fixed times from the start, so
+			//  the time spent sending does not lower the rate
+			time.Sleep(time.Until(sendStart.Add(time.Duration(absTick*TICK_INTERVAL_MS) * time.Millisecond)))
+		} else {
+			sleepInt := time.Duration(TICK_INTERVAL_MS)
+			time.Sleep(sleepInt * time.Millisecond)
+		}
+	}
+
+	if pcapWriter != nil {
+		err = pcapWriter.Close()
+
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	if !opts.DisableLogging {
 		fmt.Println("Done sending flows, here are the stats:")
 
-		for i := 0; i < len(configFlowStates); i++ {
-			flowConfig := flowConfigs[enabledFlows[i].ConfigIndex]
-			flowConfigState := configFlowStates[i]
-
-			fmt.Printf(
-				"%15s = %15s %5d -> %15s %5d [%3d] = %d total = %d bytes\n",
-				hostName,
-				flowConfig.SrcAddr,
-				flowConfig.SrcPort,
-				flowConfig.DstAddr,
-				flowConfig.DstPort,
-				flowConfig.Proto,
-				flowConfigState.Count,
-				flowConfigState.Bytes,
-			)
+		for _, runner := range runners {
+			runner.PrintStats(flowConfigs)
 		}
 	}
 
 	if opts.StatsOutFile != "" {
-		err := GenStatsFile(opts.StatsOutFile, configFlowStates, enabledFlows, flowConfigs)
+		for _, runner := range runners {
+			statsFile := opts.StatsOutFile
+			if opts.AllHosts {
+				statsFile = HostStatsFileName(statsFile, runner.Host.Name)
+			}
 
-		if err != nil {
-			panic(err)
+			err := GenStatsFile(
+				statsFile,
+				runner.Host.Name,
+				runner.Host.Ip,
+				HostEngineId(config, runner.Host.Name),
+				runner.FlowStates,
+				runner.EnabledFlows,
+				flowConfigs,
+				ScenarioStats(flowConfigs, sendStart),
+			)
+
+			if err != nil {
+				panic(err)
+			}
 		}
 	}
 }
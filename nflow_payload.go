@@ -5,18 +5,13 @@ import (
 	"encoding/binary"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 // Start time for this instance, used to compute sysUptime
 var StartTime = time.Now().UnixNano()
 
-// current sysUptime in msec - recalculated in CreateNFlowHeader()
-var sysUptime uint32 = 0
-
-// Counter of flow packets that have been sent
-var flowSequence uint32 = 0
-
 const (
 	FTP_PORT        = 21
 	SSH_PORT        = 22
@@ -98,11 +93,43 @@ type Uptime struct {
 	UnixMsec uint32
 }
 
-func CreateCalcUptime() Uptime {
-	t := time.Now().UnixNano()
+// Clock of a simulated exporter, every host has its own boot time so
+// hosts simulated by one process still report their own sysUptime
+type HostClock struct {
+	StartTime int64
+
+	// current sysUptime in msec - recalculated in CreateCalcUptime()
+	SysUptime uint32
+
+	// Simulated time in nanoseconds since the unix epoch in backfill mode,
+	// zero uses the wall clock. Read by the snmp agent, see SetSimTime
+	SimTime int64
+}
+
+// Hosts boot one minute apart in the order of the config file
+func NewHostClock(hostIndex int) *HostClock {
+	return &HostClock{
+		StartTime: StartTime - int64(hostIndex)*int64(time.Minute),
+	}
+}
+
+func (c *HostClock) Now() int64 {
+	if simTime := atomic.LoadInt64(&c.SimTime); simTime != 0 {
+		return simTime
+	}
+
+	return time.Now().UnixNano()
+}
+
+func (c *HostClock) SetSimTime(simTime int64) {
+	atomic.StoreInt64(&c.SimTime, simTime)
+}
+
+func (c *HostClock) CreateCalcUptime() Uptime {
+	t := c.Now()
 	sec := t / int64(time.Second)
 	nsec := t - sec*int64(time.Second)
-	sysUptime = uint32((t-StartTime)/int64(time.Millisecond)) + 1000
+	c.SysUptime = uint32((t-c.StartTime)/int64(time.Millisecond)) + 1000
 
 	uptime := new(Uptime)
 	uptime.UnixSec = uint32(sec)
@@ -110,33 +137,40 @@ func CreateCalcUptime() Uptime {
 	return *uptime
 }
 
-// Generate and initialize netflow header
-func CreateNFlowHeader(recordCount int) NetflowHeader {
+// Convert a sysUptime value into milliseconds since the unix epoch
+func (c *HostClock) UptimeToUnixMillis(uptime uint32) uint64 {
+	bootMillis := c.StartTime/int64(time.Millisecond) - 1000
+	return uint64(bootMillis + int64(uptime))
+}
 
-	t := time.Now().UnixNano()
-	sec := t / int64(time.Second)
-	nsec := t - sec*int64(time.Second)
-	sysUptime = uint32((t-StartTime)/int64(time.Millisecond)) + 1000
-	flowSequence++
+// Convert milliseconds since the unix epoch into a sysUptime value
+func (c *HostClock) UnixMillisToUptime(millis int64) uint32 {
+	bootMillis := c.StartTime/int64(time.Millisecond) - 1000
+	return uint32(millis - bootMillis)
+}
 
-	// log.Infof("Time: %d; Seconds: %d; Nanoseconds: %d\n", t, sec, nsec)
-	// log.Infof("StartTime: %d; sysUptime: %d", StartTime, sysUptime)
+// Generate and initialize netflow header
+func CreateNFlowHeader(recordCount int, clock *HostClock, flowSequence uint32, engineId uint8) NetflowHeader {
+	uptime := clock.CreateCalcUptime()
+
+	// log.Infof("StartTime: %d; sysUptime: %d", clock.StartTime, clock.SysUptime)
 	// log.Infof("FlowSequence %d", flowSequence)
 
 	h := new(NetflowHeader)
 	h.Version = 5
 	h.FlowCount = uint16(recordCount)
-	h.SysUptime = sysUptime
-	h.UnixSec = uint32(sec)
-	h.UnixMsec = uint32(nsec)
+	h.SysUptime = clock.SysUptime
+	h.UnixSec = uptime.UnixSec
+	h.UnixMsec = uptime.UnixMsec
 	h.FlowSequence = flowSequence
 	h.EngineType = 1
-	h.EngineId = 0
+	h.EngineId = engineId
 	h.SampleInterval = 0
 	return *h
 }
 
 func CreateCustomFlow(
+	sysUptime uint32,
 	srcIp string,
 	srcPort uint16,
 	dstIp string,
@@ -144,32 +178,38 @@ func CreateCustomFlow(
 	protocol int,
 	nextHopIp string,
 	bytes int,
-	startOffset int,
-	endOffset int,
-) NetflowPayload {
-	payload := new(NetflowPayload)
+	fields FlowFieldValues,
+) FlowRecord {
+	record := new(FlowRecord)
+	payload := &record.NetflowPayload
 
-	FillCommonFields(payload, PAYLOAD_AVG_SM, protocol, rand.Intn(32))
+	FillCommonFields(payload, PAYLOAD_AVG_SM, protocol, rand.Intn(32), sysUptime)
 
-	offsetCenter := int((startOffset-endOffset)/2) + endOffset
+	// The times are set by the caller
+	payload.SysUptimeStart = sysUptime
+	payload.SysUptimeEnd = sysUptime
 
-	uptime := int(sysUptime)
-	payload.SysUptimeEnd = uint32(uptime - randomNum(endOffset, offsetCenter))
-	payload.SysUptimeStart = payload.SysUptimeEnd - uint32(randomNum(offsetCenter, startOffset))
+	record.SetAddrs(srcIp, dstIp, nextHopIp)
 
-	payload.SrcIP = IPtoUint32(srcIp)
-	payload.DstIP = IPtoUint32(dstIp)
-
-	if nextHopIp != "" {
-		payload.NextHopIP = IPtoUint32(nextHopIp)
+	// The false index follows the order of the addresses, so it is set
+	//  once they are
+	if payload.SrcIP > payload.DstIP {
+		payload.SnmpInIndex = 1
+		payload.SnmpOutIndex = 2
+	} else {
+		payload.SnmpInIndex = 2
+		payload.SnmpOutIndex = 1
 	}
 
 	payload.SrcPort = srcPort
 	payload.DstPort = dstPort
 
 	payload.NumOctets = uint32(bytes)
+	payload.NumPackets = uint32(DerivePackets(bytes))
 
-	return *payload
+	ApplyFlowFieldValues(payload, fields)
+
+	return *record
 }
 
 // patch up the common fields of the packets
@@ -177,7 +217,8 @@ func FillCommonFields(
 	payload *NetflowPayload,
 	numPktOct int,
 	ipProtocol int,
-	srcPrefixMask int) NetflowPayload {
+	srcPrefixMask int,
+	sysUptime uint32) NetflowPayload {
 
 	// Fill template with values not filled by caller
 	// payload.SrcIP = IPtoUint32("10.154.20.12")
@@ -201,15 +242,6 @@ func FillCommonFields(
 	payload.DstPrefixMask = uint8(rand.Intn(32))
 	payload.Padding2 = 0
 
-	// now handle computed values
-	if payload.SrcIP > payload.DstIP { // false-index
-		payload.SnmpInIndex = 1
-		payload.SnmpOutIndex = 2
-	} else {
-		payload.SnmpInIndex = 2
-		payload.SnmpOutIndex = 1
-	}
-
 	uptime := int(sysUptime)
 	payload.SysUptimeEnd = uint32(uptime - randomNum(10, 500))
 	payload.SysUptimeStart = payload.SysUptimeEnd - uint32(randomNum(10, 500))
@@ -228,9 +260,13 @@ func genRandUint16(max int, randGen *rand.Rand) uint16 {
 	}
 }
 
+// Returns 0 for addresses that are not IPv4
 func IPtoUint32(s string) uint32 {
-	ip := net.ParseIP(s)
-	return binary.BigEndian.Uint32(ip.To4())
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip)
 }
 
 func genRandUint32(max int) uint32 {
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const NETFLOW_V9_VERSION = 9
+
+// Netflow v9 field types (RFC 3954 section 8)
+const (
+	NFV9_IN_BYTES        = 1
+	NFV9_IN_PKTS         = 2
+	NFV9_PROTOCOL        = 4
+	NFV9_SRC_TOS         = 5
+	NFV9_TCP_FLAGS       = 6
+	NFV9_L4_SRC_PORT     = 7
+	NFV9_IPV4_SRC_ADDR   = 8
+	NFV9_SRC_MASK        = 9
+	NFV9_INPUT_SNMP      = 10
+	NFV9_L4_DST_PORT     = 11
+	NFV9_IPV4_DST_ADDR   = 12
+	NFV9_DST_MASK        = 13
+	NFV9_OUTPUT_SNMP     = 14
+	NFV9_IPV4_NEXT_HOP   = 15
+	NFV9_SRC_AS          = 16
+	NFV9_DST_AS          = 17
+	NFV9_LAST_SWITCHED   = 21
+	NFV9_FIRST_SWITCHED  = 22
+	NFV9_IPV6_SRC_ADDR   = 27
+	NFV9_IPV6_DST_ADDR   = 28
+	NFV9_IPV6_SRC_MASK   = 29
+	NFV9_IPV6_DST_MASK   = 30
+	NFV9_IPV6_NEXT_HOP   = 62
+	NFV9_TEMPLATE_SET_ID = 0
+	NFV9_TEMPLATE_ID     = 256
+	NFV9_TEMPLATE_ID_V6  = 257
+
+	// Translation fields as used by NSEL, same ids as the IPFIX elements
+	NFV9_XLATE_SRC_ADDR_IPV4 = 225
+	NFV9_XLATE_DST_ADDR_IPV4 = 226
+	NFV9_XLATE_SRC_PORT      = 227
+	NFV9_XLATE_DST_PORT      = 228
+	NFV9_XLATE_SRC_ADDR_IPV6 = 281
+	NFV9_XLATE_DST_ADDR_IPV6 = 282
+	NFV9_TEMPLATE_ID_NAT     = 258
+	NFV9_TEMPLATE_ID_NAT_V6  = 259
+
+	// Options template announcing the sampling of the exporter
+	NFV9_OPTIONS_TEMPLATE_SET_ID = 1
+	NFV9_SCOPE_SYSTEM            = 1
+	NFV9_SAMPLING_INTERVAL       = 34
+	NFV9_SAMPLING_ALGORITHM      = 35
+	NFV9_SAMPLING_DETERMINISTIC  = 1
+	NFV9_TEMPLATE_ID_SAMPLING    = 260
+)
+
+type NetflowV9Header struct {
+	Version      uint16
+	Count        uint16
+	SysUptime    uint32
+	UnixSec      uint32
+	FlowSequence uint32
+	SourceId     uint32
+}
+
+type NetflowV9FlowSetHeader struct {
+	FlowSetId uint16
+	Length    uint16
+}
+
+type NetflowV9TemplateField struct {
+	Type   uint16
+	Length uint16
+}
+
+type NetflowV9Template struct {
+	Id     uint16
+	Fields []NetflowV9TemplateField
+}
+
+// Template describing the v5 record layout, so the same records
+// can be encoded as v9 data flowsets
+var netflowV9Template = NetflowV9Template{
+	Id: NFV9_TEMPLATE_ID,
+	Fields: []NetflowV9TemplateField{
+		{NFV9_IPV4_SRC_ADDR, 4},
+		{NFV9_IPV4_DST_ADDR, 4},
+		{NFV9_IPV4_NEXT_HOP, 4},
+		{NFV9_INPUT_SNMP, 2},
+		{NFV9_OUTPUT_SNMP, 2},
+		{NFV9_IN_PKTS, 4},
+		{NFV9_IN_BYTES, 4},
+		{NFV9_FIRST_SWITCHED, 4},
+		{NFV9_LAST_SWITCHED, 4},
+		{NFV9_L4_SRC_PORT, 2},
+		{NFV9_L4_DST_PORT, 2},
+		{NFV9_TCP_FLAGS, 1},
+		{NFV9_PROTOCOL, 1},
+		{NFV9_SRC_TOS, 1},
+		{NFV9_SRC_AS, 2},
+		{NFV9_DST_AS, 2},
+		{NFV9_SRC_MASK, 1},
+		{NFV9_DST_MASK, 1},
+	},
+}
+
+// Same layout as netflowV9Template with IPv6 addresses
+var netflowV9TemplateV6 = NetflowV9Template{
+	Id: NFV9_TEMPLATE_ID_V6,
+	Fields: []NetflowV9TemplateField{
+		{NFV9_IPV6_SRC_ADDR, 16},
+		{NFV9_IPV6_DST_ADDR, 16},
+		{NFV9_IPV6_NEXT_HOP, 16},
+		{NFV9_INPUT_SNMP, 2},
+		{NFV9_OUTPUT_SNMP, 2},
+		{NFV9_IN_PKTS, 4},
+		{NFV9_IN_BYTES, 4},
+		{NFV9_FIRST_SWITCHED, 4},
+		{NFV9_LAST_SWITCHED, 4},
+		{NFV9_L4_SRC_PORT, 2},
+		{NFV9_L4_DST_PORT, 2},
+		{NFV9_TCP_FLAGS, 1},
+		{NFV9_PROTOCOL, 1},
+		{NFV9_SRC_TOS, 1},
+		{NFV9_SRC_AS, 2},
+		{NFV9_DST_AS, 2},
+		{NFV9_IPV6_SRC_MASK, 1},
+		{NFV9_IPV6_DST_MASK, 1},
+	},
+}
+
+// Templates of records exported by a hop doing address translation, the
+// translated tuple follows the fields of the regular templates
+var netflowV9TemplateNat = NetflowV9Template{
+	Id: NFV9_TEMPLATE_ID_NAT,
+	Fields: append(append([]NetflowV9TemplateField{}, netflowV9Template.Fields...),
+		NetflowV9TemplateField{NFV9_XLATE_SRC_ADDR_IPV4, 4},
+		NetflowV9TemplateField{NFV9_XLATE_DST_ADDR_IPV4, 4},
+		NetflowV9TemplateField{NFV9_XLATE_SRC_PORT, 2},
+		NetflowV9TemplateField{NFV9_XLATE_DST_PORT, 2},
+	),
+}
+
+var netflowV9TemplateNatV6 = NetflowV9Template{
+	Id: NFV9_TEMPLATE_ID_NAT_V6,
+	Fields: append(append([]NetflowV9TemplateField{}, netflowV9TemplateV6.Fields...),
+		NetflowV9TemplateField{NFV9_XLATE_SRC_ADDR_IPV6, 16},
+		NetflowV9TemplateField{NFV9_XLATE_DST_ADDR_IPV6, 16},
+		NetflowV9TemplateField{NFV9_XLATE_SRC_PORT, 2},
+		NetflowV9TemplateField{NFV9_XLATE_DST_PORT, 2},
+	),
+}
+
+// Wire layout of a single data record, must match netflowV9Template
+type NetflowV9Record struct {
+	SrcIP          uint32
+	DstIP          uint32
+	NextHopIP      uint32
+	SnmpInIndex    uint16
+	SnmpOutIndex   uint16
+	NumPackets     uint32
+	NumOctets      uint32
+	SysUptimeStart uint32
+	SysUptimeEnd   uint32
+	SrcPort        uint16
+	DstPort        uint16
+	TcpFlags       uint8
+	IpProtocol     uint8
+	IpTos          uint8
+	SrcAsNumber    uint16
+	DstAsNumber    uint16
+	SrcPrefixMask  uint8
+	DstPrefixMask  uint8
+}
+
+// Wire layout of a single data record, must match netflowV9TemplateV6
+type NetflowV9RecordV6 struct {
+	SrcIP          [16]byte
+	DstIP          [16]byte
+	NextHopIP      [16]byte
+	SnmpInIndex    uint16
+	SnmpOutIndex   uint16
+	NumPackets     uint32
+	NumOctets      uint32
+	SysUptimeStart uint32
+	SysUptimeEnd   uint32
+	SrcPort        uint16
+	DstPort        uint16
+	TcpFlags       uint8
+	IpProtocol     uint8
+	IpTos          uint8
+	SrcAsNumber    uint16
+	DstAsNumber    uint16
+	SrcPrefixMask  uint8
+	DstPrefixMask  uint8
+}
+
+// Wire layout of a single data record, must match netflowV9TemplateNat
+type NetflowV9RecordNat struct {
+	NetflowV9Record
+	PostNatSrcIP   uint32
+	PostNatDstIP   uint32
+	PostNatSrcPort uint16
+	PostNatDstPort uint16
+}
+
+// Wire layout of a single data record, must match netflowV9TemplateNatV6
+type NetflowV9RecordNatV6 struct {
+	NetflowV9RecordV6
+	PostNatSrcIP   [16]byte
+	PostNatDstIP   [16]byte
+	PostNatSrcPort uint16
+	PostNatDstPort uint16
+}
+
+var netflowV9Templates = []NetflowV9Template{
+	netflowV9Template,
+	netflowV9TemplateV6,
+	netflowV9TemplateNat,
+	netflowV9TemplateNatV6,
+}
+
+// Wire layout of the sampling options record, system scope followed by
+// the sampling interval and algorithm
+type NetflowV9SamplingRecord struct {
+	SourceId          uint32
+	SamplingInterval  uint32
+	SamplingAlgorithm uint8
+}
+
+// Netflow v9 exporter state, one per simulated host
+type NetflowV9Exporter struct {
+	Clock                 *HostClock
+	SourceId              uint32
+	TemplateRefreshPkts   int
+	TemplateRefreshPeriod time.Duration
+	SamplingRate          int
+
+	flowSequence     uint32
+	pktsSinceRefresh int
+	lastRefresh      time.Time
+}
+
+func NewNetflowV9Exporter(clock *HostClock, sourceId uint32, refreshPkts int, refreshPeriod time.Duration) *NetflowV9Exporter {
+	return &NetflowV9Exporter{
+		Clock:                 clock,
+		SourceId:              sourceId,
+		TemplateRefreshPkts:   refreshPkts,
+		TemplateRefreshPeriod: refreshPeriod,
+	}
+}
+
+// Check if the template flowset should be included in the next packet
+func (e *NetflowV9Exporter) templateDue(now time.Time) bool {
+	if e.lastRefresh.IsZero() {
+		return true
+	}
+
+	if e.TemplateRefreshPkts > 0 && e.pktsSinceRefresh >= e.TemplateRefreshPkts {
+		return true
+	}
+
+	if e.TemplateRefreshPeriod > 0 && now.Sub(e.lastRefresh) >= e.TemplateRefreshPeriod {
+		return true
+	}
+
+	return false
+}
+
+func (e *NetflowV9Exporter) BuildPackets(records []FlowRecord) [][]byte {
+	return [][]byte{e.BuildPacket(records)}
+}
+
+func (e *NetflowV9Exporter) BuildPacket(records []FlowRecord) []byte {
+	uptime := e.Clock.CreateCalcUptime()
+	now := time.Unix(int64(uptime.UnixSec), int64(uptime.UnixMsec))
+
+	body := new(bytes.Buffer)
+	count := len(records)
+
+	if e.templateDue(now) {
+		writeNetflowV9TemplateFlowSet(body, netflowV9Templates...)
+
+		e.pktsSinceRefresh = 0
+		e.lastRefresh = now
+		count += len(netflowV9Templates)
+
+		// Sampling is announced with an options template and data record
+		if e.SamplingRate > 1 {
+			writeNetflowV9SamplingFlowSets(body, e.SourceId, e.SamplingRate)
+			count += 2
+		}
+	}
+
+	ipv4Records, ipv6Records := SplitRecordsByFamily(records)
+	ipv4Records, ipv4NatRecords := SplitRecordsByNat(ipv4Records)
+	ipv6Records, ipv6NatRecords := SplitRecordsByNat(ipv6Records)
+
+	if len(ipv4Records) > 0 {
+		writeNetflowV9DataFlowSet(body, NFV9_TEMPLATE_ID, ipv4Records)
+	}
+
+	if len(ipv6Records) > 0 {
+		writeNetflowV9DataFlowSet(body, NFV9_TEMPLATE_ID_V6, ipv6Records)
+	}
+
+	if len(ipv4NatRecords) > 0 {
+		writeNetflowV9DataFlowSet(body, NFV9_TEMPLATE_ID_NAT, ipv4NatRecords)
+	}
+
+	if len(ipv6NatRecords) > 0 {
+		writeNetflowV9DataFlowSet(body, NFV9_TEMPLATE_ID_NAT_V6, ipv6NatRecords)
+	}
+
+	e.flowSequence++
+	e.pktsSinceRefresh++
+
+	header := NetflowV9Header{
+		Version:      NETFLOW_V9_VERSION,
+		Count:        uint16(count),
+		SysUptime:    e.Clock.SysUptime,
+		UnixSec:      uptime.UnixSec,
+		FlowSequence: e.flowSequence,
+		SourceId:     e.SourceId,
+	}
+
+	buffer := new(bytes.Buffer)
+	err := binary.Write(buffer, binary.BigEndian, &header)
+	if err != nil {
+		log.Println("Writing netflow v9 header failed:", err)
+	}
+
+	buffer.Write(body.Bytes())
+
+	return buffer.Bytes()
+}
+
+func writeNetflowV9TemplateFlowSet(buffer *bytes.Buffer, templates ...NetflowV9Template) {
+	// Flowset header + (template id + field count + fields) per template
+	length := 4
+	for _, template := range templates {
+		length += 4 + 4*len(template.Fields)
+	}
+
+	binary.Write(buffer, binary.BigEndian, NetflowV9FlowSetHeader{
+		FlowSetId: NFV9_TEMPLATE_SET_ID,
+		Length:    uint16(length),
+	})
+
+	for _, template := range templates {
+		binary.Write(buffer, binary.BigEndian, template.Id)
+		binary.Write(buffer, binary.BigEndian, uint16(len(template.Fields)))
+
+		for _, field := range template.Fields {
+			binary.Write(buffer, binary.BigEndian, field)
+		}
+	}
+}
+
+func writeNetflowV9SamplingFlowSets(buffer *bytes.Buffer, sourceId uint32, samplingRate int) {
+	// Flowset header + template id + scope length + option length +
+	// one scope field + two option fields, padded to a 4 byte boundary
+	binary.Write(buffer, binary.BigEndian, NetflowV9FlowSetHeader{
+		FlowSetId: NFV9_OPTIONS_TEMPLATE_SET_ID,
+		Length:    4 + 6 + 4 + 8 + 2,
+	})
+	binary.Write(buffer, binary.BigEndian, uint16(NFV9_TEMPLATE_ID_SAMPLING))
+	binary.Write(buffer, binary.BigEndian, uint16(4))
+	binary.Write(buffer, binary.BigEndian, uint16(8))
+	binary.Write(buffer, binary.BigEndian, NetflowV9TemplateField{NFV9_SCOPE_SYSTEM, 4})
+	binary.Write(buffer, binary.BigEndian, NetflowV9TemplateField{NFV9_SAMPLING_INTERVAL, 4})
+	binary.Write(buffer, binary.BigEndian, NetflowV9TemplateField{NFV9_SAMPLING_ALGORITHM, 1})
+	buffer.Write(make([]byte, 2))
+
+	// Flowset header + 9 byte record, padded to a 4 byte boundary
+	binary.Write(buffer, binary.BigEndian, NetflowV9FlowSetHeader{
+		FlowSetId: NFV9_TEMPLATE_ID_SAMPLING,
+		Length:    4 + 9 + 3,
+	})
+	binary.Write(buffer, binary.BigEndian, NetflowV9SamplingRecord{
+		SourceId:          sourceId,
+		SamplingInterval:  uint32(samplingRate),
+		SamplingAlgorithm: NFV9_SAMPLING_DETERMINISTIC,
+	})
+	buffer.Write(make([]byte, 3))
+}
+
+func newNetflowV9Record(record FlowRecord) interface{} {
+	if record.IsIPv6 {
+		v6Record := NetflowV9RecordV6{
+			SrcIP:          record.SrcIP6,
+			DstIP:          record.DstIP6,
+			NextHopIP:      record.NextHopIP6,
+			SnmpInIndex:    record.SnmpInIndex,
+			SnmpOutIndex:   record.SnmpOutIndex,
+			NumPackets:     record.NumPackets,
+			NumOctets:      record.NumOctets,
+			SysUptimeStart: record.SysUptimeStart,
+			SysUptimeEnd:   record.SysUptimeEnd,
+			SrcPort:        record.SrcPort,
+			DstPort:        record.DstPort,
+			TcpFlags:       record.TcpFlags,
+			IpProtocol:     record.IpProtocol,
+			IpTos:          record.IpTos,
+			SrcAsNumber:    record.SrcAsNumber,
+			DstAsNumber:    record.DstAsNumber,
+			SrcPrefixMask:  record.SrcPrefixMask,
+			DstPrefixMask:  record.DstPrefixMask,
+		}
+
+		if record.Nat {
+			return NetflowV9RecordNatV6{
+				NetflowV9RecordV6: v6Record,
+				PostNatSrcIP:      record.PostNatSrcIP6,
+				PostNatDstIP:      record.PostNatDstIP6,
+				PostNatSrcPort:    record.PostNatSrcPort,
+				PostNatDstPort:    record.PostNatDstPort,
+			}
+		}
+
+		return v6Record
+	}
+
+	v4Record := NetflowV9Record{
+		SrcIP:          record.SrcIP,
+		DstIP:          record.DstIP,
+		NextHopIP:      record.NextHopIP,
+		SnmpInIndex:    record.SnmpInIndex,
+		SnmpOutIndex:   record.SnmpOutIndex,
+		NumPackets:     record.NumPackets,
+		NumOctets:      record.NumOctets,
+		SysUptimeStart: record.SysUptimeStart,
+		SysUptimeEnd:   record.SysUptimeEnd,
+		SrcPort:        record.SrcPort,
+		DstPort:        record.DstPort,
+		TcpFlags:       record.TcpFlags,
+		IpProtocol:     record.IpProtocol,
+		IpTos:          record.IpTos,
+		SrcAsNumber:    record.SrcAsNumber,
+		DstAsNumber:    record.DstAsNumber,
+		SrcPrefixMask:  record.SrcPrefixMask,
+		DstPrefixMask:  record.DstPrefixMask,
+	}
+
+	if record.Nat {
+		return NetflowV9RecordNat{
+			NetflowV9Record: v4Record,
+			PostNatSrcIP:    record.PostNatSrcIP,
+			PostNatDstIP:    record.PostNatDstIP,
+			PostNatSrcPort:  record.PostNatSrcPort,
+			PostNatDstPort:  record.PostNatDstPort,
+		}
+	}
+
+	return v4Record
+}
+
+func writeNetflowV9DataFlowSet(buffer *bytes.Buffer, templateId uint16, records []FlowRecord) {
+	data := new(bytes.Buffer)
+
+	for _, record := range records {
+		err := binary.Write(data, binary.BigEndian, newNetflowV9Record(record))
+		if err != nil {
+			log.Println("Writing netflow v9 record failed:", err)
+		}
+	}
+
+	// Flowsets are padded to a 4 byte boundary
+	padding := (4 - (4+data.Len())%4) % 4
+
+	binary.Write(buffer, binary.BigEndian, NetflowV9FlowSetHeader{
+		FlowSetId: templateId,
+		Length:    uint16(4 + data.Len() + padding),
+	})
+	buffer.Write(data.Bytes())
+	buffer.Write(make([]byte, padding))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNetflowV9RoundTrip(t *testing.T) {
+	natRecord := testFlowRecord("10.1.0.3", "10.2.0.2", 41000, 80, PROTO_TCP, 2, 900)
+	natRecord.SetPostNat(FlowTuple{SrcAddr: "100.64.0.1", DstAddr: "10.2.0.2", SrcPort: 20000, DstPort: 80})
+
+	records := []FlowRecord{
+		testFlowRecord("10.1.0.1", "10.2.0.1", 40000, 443, PROTO_TCP, 3, 1500),
+		testFlowRecord("fd00::1", "fd00::2", 53000, 53, PROTO_UDP, 1, 80),
+		natRecord,
+		testFlowRecord("fd00::3", "fd00::4", 0, 0, 58, 1, 64),
+	}
+
+	tests := []struct {
+		name         string
+		samplingRate int
+	}{
+		{"unsampled", 1},
+		{"sampled", 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := NewNetflowV9Exporter(testClock(), 300, 20, 30*time.Second)
+			exporter.SamplingRate = test.samplingRate
+
+			collector := collectPackets(t, exporter.BuildPackets(records))
+
+			checkCollectedFlows(t, collectedExporter(t, collector, 300), records)
+		})
+	}
+}
+
+func TestNetflowV9TemplateRefresh(t *testing.T) {
+	exporter := NewNetflowV9Exporter(testClock(), 1, 2, 0)
+
+	var packets [][]byte
+
+	for i := 0; i < 5; i++ {
+		packets = append(packets, exporter.BuildPackets([]FlowRecord{
+			testFlowRecord("10.1.0.1", "10.2.0.1", 40000, uint16(i), PROTO_TCP, 1, 100),
+		})...)
+	}
+
+	// A collector starting with a packet without templates can not decode it
+	for i, wantTemplate := range []bool{true, false, true, false, true} {
+		err := NewCollector().HandlePacket("10.0.0.3", packets[i])
+
+		if (err == nil) != wantTemplate {
+			t.Errorf("packet %d: got error %v, want templates %v", i, err, wantTemplate)
+		}
+	}
+
+	// The sequence number counts packets
+	collector := collectPackets(t, [][]byte{packets[0], packets[1], packets[3], packets[4]})
+	state := collectedExporter(t, collector, 1)
+
+	if state.LostRecords != 1 || state.OutOfOrder != 0 || state.Records != 4 {
+		t.Errorf("got %d records %d lost %d out of order, want 4 records 1 lost", state.Records, state.LostRecords, state.OutOfOrder)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	ETHERNET_HEADER_LEN = 14
+	IPV4_HEADER_LEN     = 20
+	IPV6_HEADER_LEN     = 40
+	TCP_HEADER_LEN      = 20
+	UDP_HEADER_LEN      = 8
+	ETHERTYPE_IPV4      = 0x0800
+	ETHERTYPE_IPV6      = 0x86dd
+	PROTO_TCP           = 6
+	PROTO_UDP           = 17
+)
+
+// Locally administered MAC addresses used for synthesized frames
+var (
+	srcMacAddr = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	dstMacAddr = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+func BuildEthernetHeader(etherType uint16) []byte {
+	buffer := new(bytes.Buffer)
+	buffer.Write(dstMacAddr)
+	buffer.Write(srcMacAddr)
+	binary.Write(buffer, binary.BigEndian, etherType)
+	return buffer.Bytes()
+}
+
+func BuildIPv4Header(srcIp uint32, dstIp uint32, protocol uint8, tos uint8, payloadLen int) []byte {
+	// Don't fragment
+	return buildIPv4Header(srcIp, dstIp, protocol, tos, 0, 0x4000, payloadLen)
+}
+
+// Header of a fragment of a packet, offset is the offset of the fragment
+// in the packet in bytes, a multiple of 8
+func BuildIPv4FragmentHeader(srcIp uint32, dstIp uint32, protocol uint8, tos uint8, id uint16, offset int, more bool, payloadLen int) []byte {
+	flags := uint16(offset / 8)
+	if more {
+		// More fragments
+		flags |= 0x2000
+	}
+
+	return buildIPv4Header(srcIp, dstIp, protocol, tos, id, flags, payloadLen)
+}
+
+func buildIPv4Header(srcIp uint32, dstIp uint32, protocol uint8, tos uint8, id uint16, flags uint16, payloadLen int) []byte {
+	header := make([]byte, IPV4_HEADER_LEN)
+	header[0] = 0x45
+	header[1] = tos
+	binary.BigEndian.PutUint16(header[2:], uint16(IPV4_HEADER_LEN+payloadLen))
+	binary.BigEndian.PutUint16(header[4:], id)
+	binary.BigEndian.PutUint16(header[6:], flags)
+	header[8] = 64
+	header[9] = protocol
+	binary.BigEndian.PutUint32(header[12:], srcIp)
+	binary.BigEndian.PutUint32(header[16:], dstIp)
+	binary.BigEndian.PutUint16(header[10:], ipChecksum(header))
+	return header
+}
+
+func BuildIPv6Header(srcIp [16]byte, dstIp [16]byte, protocol uint8, tos uint8, payloadLen int) []byte {
+	header := make([]byte, IPV6_HEADER_LEN)
+	binary.BigEndian.PutUint32(header[0:], 6<<28|uint32(tos)<<20)
+	binary.BigEndian.PutUint16(header[4:], uint16(payloadLen))
+	header[6] = protocol
+	header[7] = 64
+	copy(header[8:], srcIp[:])
+	copy(header[24:], dstIp[:])
+	return header
+}
+
+func BuildTcpHeader(srcPort uint16, dstPort uint16, flags uint8) []byte {
+	header := make([]byte, TCP_HEADER_LEN)
+	binary.BigEndian.PutUint16(header[0:], srcPort)
+	binary.BigEndian.PutUint16(header[2:], dstPort)
+	header[12] = (TCP_HEADER_LEN / 4) << 4
+	header[13] = flags
+	binary.BigEndian.PutUint16(header[14:], 65535)
+	return header
+}
+
+func BuildUdpHeader(srcPort uint16, dstPort uint16, payloadLen int) []byte {
+	header := make([]byte, UDP_HEADER_LEN)
+	binary.BigEndian.PutUint16(header[0:], srcPort)
+	binary.BigEndian.PutUint16(header[2:], dstPort)
+	binary.BigEndian.PutUint16(header[4:], uint16(UDP_HEADER_LEN+payloadLen))
+	return header
+}
+
+// Synthesize the headers of a packet belonging to the flow record
+// frameLength is the length of the whole ethernet frame the headers
+// were taken from, without the frame check sequence
+func BuildSampledPacketHeader(record FlowRecord, frameLength int) []byte {
+	buffer := new(bytes.Buffer)
+
+	ipPayloadLen := frameLength - ETHERNET_HEADER_LEN - IPV4_HEADER_LEN
+	if record.IsIPv6 {
+		ipPayloadLen = frameLength - ETHERNET_HEADER_LEN - IPV6_HEADER_LEN
+	}
+
+	if record.IsIPv6 {
+		buffer.Write(BuildEthernetHeader(ETHERTYPE_IPV6))
+		buffer.Write(BuildIPv6Header(record.SrcIP6, record.DstIP6, record.IpProtocol, record.IpTos, ipPayloadLen))
+	} else {
+		buffer.Write(BuildEthernetHeader(ETHERTYPE_IPV4))
+		buffer.Write(BuildIPv4Header(record.SrcIP, record.DstIP, record.IpProtocol, record.IpTos, ipPayloadLen))
+	}
+
+	switch record.IpProtocol {
+	case PROTO_TCP:
+		flags := record.TcpFlags
+		if flags == 0 {
+			// ACK
+			flags = 0x10
+		}
+		buffer.Write(BuildTcpHeader(record.SrcPort, record.DstPort, flags))
+	case PROTO_UDP:
+		buffer.Write(BuildUdpHeader(record.SrcPort, record.DstPort, ipPayloadLen-UDP_HEADER_LEN))
+	}
+
+	return buffer.Bytes()
+}
+
+// Length of the headers synthesized by BuildSampledPacketHeader
+func SampledPacketHeaderLen(record FlowRecord) int {
+	length := ETHERNET_HEADER_LEN + IPV4_HEADER_LEN
+	if record.IsIPv6 {
+		length = ETHERNET_HEADER_LEN + IPV6_HEADER_LEN
+	}
+
+	switch record.IpProtocol {
+	case PROTO_TCP:
+		length += TCP_HEADER_LEN
+	case PROTO_UDP:
+		length += UDP_HEADER_LEN
+	}
+
+	return length
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
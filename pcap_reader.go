@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+)
+
+const (
+	PCAP_MAGIC_NANO   = 0xa1b23c4d
+	PCAPNG_MAGIC      = 0x0a0d0d0a
+	PCAPNG_BYTE_ORDER = 0x1a2b3c4d
+
+	PCAPNG_BLOCK_INTERFACE = 1
+	PCAPNG_BLOCK_ENHANCED  = 6
+	PCAPNG_OPTION_TSRESOL  = 9
+
+	PCAP_LINKTYPE_NULL      = 0
+	PCAP_LINKTYPE_RAW       = 101
+	PCAP_LINKTYPE_LINUX_SLL = 113
+	PCAP_LINKTYPE_IPV4      = 228
+	PCAP_LINKTYPE_IPV6      = 229
+
+	ETHERTYPE_VLAN    = 0x8100
+	ETHERTYPE_QINQ    = 0x88a8
+	PROTO_SCTP        = 132
+	PROTO_IPV6_FRAG   = 44
+	PROTO_IPV6_HOP    = 0
+	PROTO_IPV6_ROUTE  = 43
+	PROTO_IPV6_DSTOPT = 60
+)
+
+// Captured packet, the timestamp is in nanoseconds since the unix epoch
+type PcapPacket struct {
+	LinkType  int
+	Timestamp int64
+	Data      []byte
+}
+
+// IP packet decoded from a captured frame, the ports are zero for
+// protocols without ports and fragments after the first
+type PcapIpPacket struct {
+	SrcAddr  netip.Addr
+	DstAddr  netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+	Proto    int
+	Bytes    int
+	TcpFlags uint8
+}
+
+// Read all packets of a pcap or pcapng file
+func ReadPcapFile(filename string) ([]PcapPacket, error) {
+	data, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pcap file %s: %v", filename, err)
+	}
+
+	if len(data) < 24 {
+		return nil, fmt.Errorf("failed to read pcap file %s: file too short", filename)
+	}
+
+	var packets []PcapPacket
+
+	if binary.LittleEndian.Uint32(data) == PCAPNG_MAGIC {
+		packets, err = parsePcapng(data)
+	} else {
+		packets, err = parsePcap(data)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pcap file %s: %v", filename, err)
+	}
+
+	return packets, nil
+}
+
+func parsePcap(data []byte) ([]PcapPacket, error) {
+	var order binary.ByteOrder
+	var nano bool
+
+	switch {
+	case binary.LittleEndian.Uint32(data) == PCAP_MAGIC:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(data) == PCAP_MAGIC:
+		order = binary.BigEndian
+	case binary.LittleEndian.Uint32(data) == PCAP_MAGIC_NANO:
+		order, nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(data) == PCAP_MAGIC_NANO:
+		order, nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("unknown file format")
+	}
+
+	linkType := int(order.Uint32(data[20:]))
+
+	var packets []PcapPacket
+
+	for offset := 24; offset < len(data); {
+		if offset+16 > len(data) {
+			return nil, fmt.Errorf("truncated packet record at offset %d", offset)
+		}
+
+		sec := int64(order.Uint32(data[offset:]))
+		frac := int64(order.Uint32(data[offset+4:]))
+		capLen := int(order.Uint32(data[offset+8:]))
+		offset += 16
+
+		if offset+capLen > len(data) {
+			return nil, fmt.Errorf("truncated packet record at offset %d", offset-16)
+		}
+
+		if !nano {
+			frac *= 1000
+		}
+
+		packets = append(packets, PcapPacket{
+			LinkType:  linkType,
+			Timestamp: sec*1000000000 + frac,
+			Data:      data[offset : offset+capLen],
+		})
+
+		offset += capLen
+	}
+
+	return packets, nil
+}
+
+// Interface of a pcapng section, the timestamps of its packets are in
+// units of 1/Resolution seconds
+type pcapngInterface struct {
+	LinkType   int
+	Resolution uint64
+}
+
+func parsePcapng(data []byte) ([]PcapPacket, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []pcapngInterface
+	var packets []PcapPacket
+
+	for offset := 0; offset < len(data); {
+		if offset+12 > len(data) {
+			return nil, fmt.Errorf("truncated block at offset %d", offset)
+		}
+
+		blockType := binary.LittleEndian.Uint32(data[offset:])
+
+		// Every section starts with a header block giving its byte order
+		if blockType == PCAPNG_MAGIC {
+			if binary.LittleEndian.Uint32(data[offset+8:]) == PCAPNG_BYTE_ORDER {
+				order = binary.LittleEndian
+			} else {
+				order = binary.BigEndian
+			}
+			interfaces = nil
+		} else {
+			blockType = order.Uint32(data[offset:])
+		}
+
+		blockLen := int(order.Uint32(data[offset+4:]))
+
+		if blockLen < 12 || offset+blockLen > len(data) {
+			return nil, fmt.Errorf("invalid block length %d at offset %d", blockLen, offset)
+		}
+
+		body := data[offset+8 : offset+blockLen-4]
+
+		switch blockType {
+		case PCAPNG_BLOCK_INTERFACE:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("truncated interface block at offset %d", offset)
+			}
+
+			interfaces = append(interfaces, pcapngInterface{
+				LinkType:   int(order.Uint16(body)),
+				Resolution: pcapngResolution(body[8:], order),
+			})
+		case PCAPNG_BLOCK_ENHANCED:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("truncated packet block at offset %d", offset)
+			}
+
+			ifIndex := int(order.Uint32(body))
+			timestamp := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			capLen := int(order.Uint32(body[12:]))
+
+			if ifIndex >= len(interfaces) {
+				return nil, fmt.Errorf("packet block at offset %d refers to unknown interface %d", offset, ifIndex)
+			}
+
+			if 20+capLen > len(body) {
+				return nil, fmt.Errorf("truncated packet block at offset %d", offset)
+			}
+
+			resolution := interfaces[ifIndex].Resolution
+
+			packets = append(packets, PcapPacket{
+				LinkType:  interfaces[ifIndex].LinkType,
+				Timestamp: int64(timestamp/resolution*1000000000 + timestamp%resolution*1000000000/resolution),
+				Data:      body[20 : 20+capLen],
+			})
+		}
+
+		offset += blockLen
+	}
+
+	return packets, nil
+}
+
+// Timestamp resolution from the options of an interface block, microseconds
+// by default
+func pcapngResolution(options []byte, order binary.ByteOrder) uint64 {
+	for len(options) >= 4 {
+		code := order.Uint16(options)
+		length := int(order.Uint16(options[2:]))
+
+		if 4+length > len(options) {
+			break
+		}
+
+		if code == PCAPNG_OPTION_TSRESOL && length >= 1 {
+			value := options[4]
+			resolution := uint64(1)
+
+			// The high bit selects a power of two instead of ten
+			for i := 0; i < int(value&0x7f); i++ {
+				if value&0x80 != 0 {
+					resolution *= 2
+				} else {
+					resolution *= 10
+				}
+			}
+
+			return resolution
+		}
+
+		// Options are padded to 32 bits
+		options = options[4+(length+3)/4*4:]
+	}
+
+	return 1000000
+}
+
+// Decode the IP header of a captured frame, returns false for frames that
+// are not IP packets
+func DecodePcapPacket(packet PcapPacket) (PcapIpPacket, bool) {
+	data := packet.Data
+
+	switch packet.LinkType {
+	case PCAP_LINKTYPE_ETHER:
+		if len(data) < 14 {
+			return PcapIpPacket{}, false
+		}
+
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+
+		for (etherType == ETHERTYPE_VLAN || etherType == ETHERTYPE_QINQ) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+
+		if etherType != ETHERTYPE_IPV4 && etherType != ETHERTYPE_IPV6 {
+			return PcapIpPacket{}, false
+		}
+	case PCAP_LINKTYPE_LINUX_SLL:
+		if len(data) < 16 {
+			return PcapIpPacket{}, false
+		}
+
+		data = data[16:]
+	case PCAP_LINKTYPE_NULL:
+		if len(data) < 4 {
+			return PcapIpPacket{}, false
+		}
+
+		data = data[4:]
+	case PCAP_LINKTYPE_RAW, PCAP_LINKTYPE_IPV4, PCAP_LINKTYPE_IPV6:
+	default:
+		return PcapIpPacket{}, false
+	}
+
+	if len(data) == 0 {
+		return PcapIpPacket{}, false
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		return decodePcapIPv4(data)
+	case 6:
+		return decodePcapIPv6(data)
+	}
+
+	return PcapIpPacket{}, false
+}
+
+func decodePcapIPv4(data []byte) (PcapIpPacket, bool) {
+	headerLen := int(data[0]&0x0f) * 4
+
+	if len(data) < 20 || headerLen < 20 {
+		return PcapIpPacket{}, false
+	}
+
+	var src, dst [4]byte
+	copy(src[:], data[12:16])
+	copy(dst[:], data[16:20])
+
+	packet := PcapIpPacket{
+		SrcAddr: netip.AddrFrom4(src),
+		DstAddr: netip.AddrFrom4(dst),
+		Proto:   int(data[9]),
+		// Captures may be truncated, the ip header has the length on the wire
+		Bytes: int(binary.BigEndian.Uint16(data[2:])),
+	}
+
+	// Only the first fragment has the transport header
+	if binary.BigEndian.Uint16(data[6:])&0x1fff == 0 && len(data) > headerLen {
+		packet.decodeTransport(data[headerLen:])
+	}
+
+	return packet, true
+}
+
+func decodePcapIPv6(data []byte) (PcapIpPacket, bool) {
+	if len(data) < 40 {
+		return PcapIpPacket{}, false
+	}
+
+	var src, dst [16]byte
+	copy(src[:], data[8:24])
+	copy(dst[:], data[24:40])
+
+	packet := PcapIpPacket{
+		SrcAddr: netip.AddrFrom16(src),
+		DstAddr: netip.AddrFrom16(dst),
+		Bytes:   int(binary.BigEndian.Uint16(data[4:])) + 40,
+	}
+
+	nextHeader := int(data[6])
+	payload := data[40:]
+	firstFragment := true
+
+	// Skip the extension headers to reach the transport header
+	for len(payload) >= 8 {
+		if nextHeader == PROTO_IPV6_FRAG {
+			firstFragment = firstFragment && binary.BigEndian.Uint16(payload[2:])&0xfff8 == 0
+			nextHeader = int(payload[0])
+			payload = payload[8:]
+		} else if nextHeader == PROTO_IPV6_HOP || nextHeader == PROTO_IPV6_ROUTE || nextHeader == PROTO_IPV6_DSTOPT {
+			length := (int(payload[1]) + 1) * 8
+			if length > len(payload) {
+				break
+			}
+			nextHeader = int(payload[0])
+			payload = payload[length:]
+		} else {
+			break
+		}
+	}
+
+	packet.Proto = nextHeader
+
+	if firstFragment {
+		packet.decodeTransport(payload)
+	}
+
+	return packet, true
+}
+
+// Ports and tcp flags from the transport header
+func (p *PcapIpPacket) decodeTransport(data []byte) {
+	switch p.Proto {
+	case PROTO_TCP, PROTO_UDP, PROTO_SCTP:
+		if len(data) < 4 {
+			return
+		}
+
+		p.SrcPort = binary.BigEndian.Uint16(data)
+		p.DstPort = binary.BigEndian.Uint16(data[2:])
+
+		if p.Proto == PROTO_TCP && len(data) >= 14 {
+			p.TcpFlags = data[13]
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+)
+
+const (
+	PCAP_MAGIC          = 0xa1b2c3d4
+	PCAP_VERSION_MAJOR  = 2
+	PCAP_VERSION_MINOR  = 4
+	PCAP_SNAPLEN        = 65535
+	PCAP_LINKTYPE_ETHER = 1
+
+	// Source ports of the hosts, counted up from this port in the order of
+	// the config file so captures are reproducible
+	PCAP_SRC_PORT_BASE = 32768
+)
+
+// Capture file written instead of sending to the collector, the packets of
+// all hosts are written in host order at the end of every tick so the file
+// does not depend on the scheduling of the hosts
+type PcapWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	conns  []*PcapConn
+}
+
+// Writer of one host, export packets are wrapped in synthesized
+// ethernet, ip and udp headers from the host to the collector
+type PcapConn struct {
+	clock   *HostClock
+	srcAddr netip.Addr
+	dstAddr netip.Addr
+	srcPort uint16
+	dstPort uint16
+	pending []pcapPacket
+}
+
+type pcapPacket struct {
+	timestamp int64
+	frame     []byte
+}
+
+func NewPcapWriter(filename string) (*PcapWriter, error) {
+	file, err := os.Create(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap file %s: %v", filename, err)
+	}
+
+	w := &PcapWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], PCAP_MAGIC)
+	binary.LittleEndian.PutUint16(header[4:], PCAP_VERSION_MAJOR)
+	binary.LittleEndian.PutUint16(header[6:], PCAP_VERSION_MINOR)
+	binary.LittleEndian.PutUint32(header[16:], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint32(header[20:], PCAP_LINKTYPE_ETHER)
+
+	_, err = w.writer.Write(header)
+
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write pcap file %s: %v", filename, err)
+	}
+
+	return w, nil
+}
+
+// Writer for the packets of a host, the capture times follow the clock of
+// the host so backfilled captures are backdated
+func (w *PcapWriter) HostConn(config ConfigFile, host ConfigHost, clock *HostClock) (*PcapConn, error) {
+	srcAddr, err := netip.ParseAddr(host.Ip)
+
+	if err != nil {
+		return nil, fmt.Errorf("host %s: failed to parse ip %s: %v", host.Name, host.Ip, err)
+	}
+
+	dstAddr, err := netip.ParseAddr(config.CollectorIp)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse collector ip %s: %v", config.CollectorIp, err)
+	}
+
+	if srcAddr.Is4() != dstAddr.Is4() {
+		return nil, fmt.Errorf("host %s: ip %s and collector ip %s are not the same address family", host.Name, host.Ip, config.CollectorIp)
+	}
+
+	hostIndex := 0
+	for i, configHost := range config.Hosts {
+		if configHost.Name == host.Name {
+			hostIndex = i
+			break
+		}
+	}
+
+	conn := &PcapConn{
+		clock:   clock,
+		srcAddr: srcAddr,
+		dstAddr: dstAddr,
+		srcPort: uint16(PCAP_SRC_PORT_BASE + hostIndex%PCAP_SRC_PORT_BASE),
+		dstPort: uint16(HostCollectorPort(config, host.Name)),
+	}
+
+	w.conns = append(w.conns, conn)
+
+	return conn, nil
+}
+
+func (c *PcapConn) Write(payload []byte) (int, error) {
+	udp := BuildUdpHeader(c.srcPort, c.dstPort, len(payload))
+	udp = append(udp, payload...)
+
+	var frame []byte
+
+	if c.srcAddr.Is4() {
+		frame = BuildEthernetHeader(ETHERTYPE_IPV4)
+		frame = append(frame, BuildIPv4Header(IPtoUint32(c.srcAddr.String()), IPtoUint32(c.dstAddr.String()), PROTO_UDP, 0, len(udp))...)
+	} else {
+		frame = BuildEthernetHeader(ETHERTYPE_IPV6)
+		frame = append(frame, BuildIPv6Header(c.srcAddr.As16(), c.dstAddr.As16(), PROTO_UDP, 0, len(udp))...)
+	}
+
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(c.srcAddr, c.dstAddr, udp))
+
+	c.pending = append(c.pending, pcapPacket{
+		timestamp: c.clock.Now(),
+		frame:     append(frame, udp...),
+	})
+
+	return len(payload), nil
+}
+
+// Write the packets of all hosts since the last flush
+func (w *PcapWriter) Flush() error {
+	for _, conn := range w.conns {
+		for _, packet := range conn.pending {
+			record := make([]byte, 16)
+			binary.LittleEndian.PutUint32(record[0:], uint32(packet.timestamp/int64(time.Second)))
+			binary.LittleEndian.PutUint32(record[4:], uint32(packet.timestamp%int64(time.Second)/int64(time.Microsecond)))
+			binary.LittleEndian.PutUint32(record[8:], uint32(len(packet.frame)))
+			binary.LittleEndian.PutUint32(record[12:], uint32(len(packet.frame)))
+
+			// Write errors are kept by the buffered writer until the flush
+			w.writer.Write(record)
+			w.writer.Write(packet.frame)
+		}
+
+		conn.pending = nil
+	}
+
+	err := w.writer.Flush()
+
+	if err != nil {
+		return fmt.Errorf("failed to write pcap file %s: %v", w.file.Name(), err)
+	}
+
+	return nil
+}
+
+func (w *PcapWriter) Close() error {
+	err := w.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	return w.file.Close()
+}
+
+// Checksum of a udp header and payload with the ip pseudo header, which is
+// optional for IPv4 but required for IPv6
+func udpChecksum(srcAddr netip.Addr, dstAddr netip.Addr, udp []byte) uint16 {
+	var pseudo []byte
+
+	if srcAddr.Is4() {
+		src, dst := srcAddr.As4(), dstAddr.As4()
+		pseudo = append(pseudo, src[:]...)
+		pseudo = append(pseudo, dst[:]...)
+		pseudo = append(pseudo, 0, PROTO_UDP, byte(len(udp)>>8), byte(len(udp)))
+	} else {
+		src, dst := srcAddr.As16(), dstAddr.As16()
+		pseudo = append(pseudo, src[:]...)
+		pseudo = append(pseudo, dst[:]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(udp)))
+		pseudo = append(pseudo, 0, 0, 0, PROTO_UDP)
+	}
+
+	data := append(pseudo, udp...)
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+
+	checksum := ipChecksum(data)
+
+	// A zero checksum is sent as all ones
+	if checksum == 0 {
+		return 0xffff
+	}
+
+	return checksum
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Ones complement sum of the udp pseudo header and datagram, zero when the
+// checksum in the datagram is valid
+func testUdpChecksum(srcAddr netip.Addr, dstAddr netip.Addr, udp []byte) uint16 {
+	var data []byte
+	data = append(data, srcAddr.AsSlice()...)
+	data = append(data, dstAddr.AsSlice()...)
+
+	if srcAddr.Is4() {
+		data = append(data, 0, PROTO_UDP)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(udp)))
+	} else {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(udp)))
+		data = append(data, 0, 0, 0, PROTO_UDP)
+	}
+
+	data = append(data, udp...)
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+
+	return ipChecksum(data)
+}
+
+func TestPcapWriterRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		collectorIp string
+		hostIps     []string
+		ipHeaderLen int
+	}{
+		{"ipv4", "10.0.0.1", []string{"10.0.0.3", "10.0.0.4"}, IPV4_HEADER_LEN},
+		{"ipv6", "fd00::1", []string{"fd00::3", "fd00::4"}, IPV6_HEADER_LEN},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "manflow")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			config := ConfigFile{
+				CollectorIp:   test.collectorIp,
+				CollectorPort: 2055,
+				Hosts: []ConfigHost{
+					{Name: "gw1", Ip: test.hostIps[0]},
+					{Name: "gw2", Ip: test.hostIps[1]},
+				},
+			}
+
+			filename := filepath.Join(dir, "export.pcap")
+			w, err := NewPcapWriter(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clocks := []*HostClock{NewHostClock(0), NewHostClock(1)}
+			var conns []*PcapConn
+			for i, host := range config.Hosts {
+				conn, err := w.HostConn(config, host, clocks[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				conns = append(conns, conn)
+			}
+
+			// gw2 writes first but the packets of a tick are written in
+			// host order, odd lengths check the checksum padding
+			start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+			type wantPacket struct {
+				host      int
+				timestamp int64
+				payload   []byte
+			}
+			var want []wantPacket
+
+			for tick := 0; tick < 2; tick++ {
+				tickTime := start + int64(tick)*int64(time.Second)
+				var tickPackets []wantPacket
+
+				for _, host := range []int{1, 0} {
+					clocks[host].SetSimTime(tickTime + int64(host)*1500)
+					payload := bytes.Repeat([]byte{byte(tick*2 + host + 1)}, 31+tick*100+host)
+
+					if _, err := conns[host].Write(payload); err != nil {
+						t.Fatal(err)
+					}
+					tickPackets = append([]wantPacket{{host, clocks[host].Now(), payload}}, tickPackets...)
+				}
+
+				want = append(want, tickPackets...)
+
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			packets, err := ReadPcapFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(packets) != len(want) {
+				t.Fatalf("got %d packets, want %d", len(packets), len(want))
+			}
+
+			collectorAddr := netip.MustParseAddr(test.collectorIp)
+
+			for i, packet := range packets {
+				wantPacket := want[i]
+				hostAddr := netip.MustParseAddr(test.hostIps[wantPacket.host])
+
+				if packet.LinkType != PCAP_LINKTYPE_ETHER {
+					t.Errorf("packet %d: got link type %d, want %d", i, packet.LinkType, PCAP_LINKTYPE_ETHER)
+				}
+
+				// The capture keeps microseconds
+				wantTimestamp := wantPacket.timestamp / int64(time.Microsecond) * int64(time.Microsecond)
+				if packet.Timestamp != wantTimestamp {
+					t.Errorf("packet %d: got timestamp %d, want %d", i, packet.Timestamp, wantTimestamp)
+				}
+
+				if i > 0 && packet.Timestamp/int64(time.Second) < packets[i-1].Timestamp/int64(time.Second) {
+					t.Errorf("packet %d: timestamp %d is in an earlier tick than the previous packet", i, packet.Timestamp)
+				}
+
+				decoded, ok := DecodePcapPacket(packet)
+				if !ok {
+					t.Fatalf("packet %d: failed to decode", i)
+				}
+
+				udpLen := UDP_HEADER_LEN + len(wantPacket.payload)
+				wantDecoded := PcapIpPacket{
+					SrcAddr: hostAddr,
+					DstAddr: collectorAddr,
+					SrcPort: uint16(PCAP_SRC_PORT_BASE + wantPacket.host),
+					DstPort: 2055,
+					Proto:   PROTO_UDP,
+					Bytes:   test.ipHeaderLen + udpLen,
+				}
+				if decoded != wantDecoded {
+					t.Errorf("packet %d: got %+v, want %+v", i, decoded, wantDecoded)
+				}
+
+				ip := packet.Data[ETHERNET_HEADER_LEN:]
+				if len(ip) != test.ipHeaderLen+udpLen {
+					t.Fatalf("packet %d: got %d bytes after the ethernet header, want %d", i, len(ip), test.ipHeaderLen+udpLen)
+				}
+
+				if hostAddr.Is4() && ipChecksum(ip[:IPV4_HEADER_LEN]) != 0 {
+					t.Errorf("packet %d: invalid ip header checksum %#04x", i, binary.BigEndian.Uint16(ip[10:]))
+				}
+
+				udp := ip[test.ipHeaderLen:]
+				if binary.BigEndian.Uint16(udp[4:]) != uint16(udpLen) {
+					t.Errorf("packet %d: got udp length %d, want %d", i, binary.BigEndian.Uint16(udp[4:]), udpLen)
+				}
+
+				if binary.BigEndian.Uint16(udp[6:]) == 0 || testUdpChecksum(hostAddr, collectorAddr, udp) != 0 {
+					t.Errorf("packet %d: invalid udp checksum %#04x", i, binary.BigEndian.Uint16(udp[6:]))
+				}
+
+				if !bytes.Equal(udp[UDP_HEADER_LEN:], wantPacket.payload) {
+					t.Errorf("packet %d: got payload %x, want %x", i, udp[UDP_HEADER_LEN:], wantPacket.payload)
+				}
+			}
+		})
+	}
+}
@@ -21,6 +21,14 @@ var (
 		Name: "nflow_generator_sent_netflow_total",
 		Help: "The total number of sent netflow packets",
 	})
+	targetRateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nflow_generator_target_records_rate",
+		Help: "The target records per second of each host",
+	}, []string{"host"})
+	achievedRateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nflow_generator_achieved_records_rate",
+		Help: "The records per second sent by each host with a target rate",
+	}, []string{"host"})
 )
 
 const PROM_PORT = "2112"
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of spike records sent per tick for every regular record
+const SPIKE_FLOW_MULTIPLIER = 4
+
+var protoNames = map[string]Proto{
+	"ftp":        FTP,
+	"ssh":        SSH,
+	"dns":        DNS,
+	"http":       HTTP,
+	"https":      HTTPS,
+	"ntp":        NTP,
+	"snmp":       SNMP,
+	"imaps":      IMAPS,
+	"mysql":      MYSQL,
+	"https_alt":  HTTPS_ALT,
+	"p2p":        P2P,
+	"bittorrent": BITTORRENT,
+}
+
+func ParseProtoName(name string) (Proto, error) {
+	proto, ok := protoNames[strings.ToLower(name)]
+
+	if !ok {
+		return 0, fmt.Errorf("unknown spike protocol %s", name)
+	}
+
+	return proto, nil
+}
+
+// Destination port and ip protocol of the traffic of an application protocol
+func (p Proto) PortAndProtocol() (uint16, int) {
+	switch p {
+	case FTP:
+		return FTP_PORT, PROTO_TCP
+	case SSH:
+		return SSH_PORT, PROTO_TCP
+	case DNS:
+		return DNS_PORT, PROTO_UDP
+	case HTTP:
+		return HTTP_PORT, PROTO_TCP
+	case HTTPS:
+		return HTTPS_PORT, PROTO_TCP
+	case NTP:
+		return NTP_PORT, PROTO_UDP
+	case SNMP:
+		return SNMP_PORT, PROTO_UDP
+	case IMAPS:
+		return IMAPS_PORT, PROTO_TCP
+	case MYSQL:
+		return MYSQL_PORT, PROTO_TCP
+	case HTTPS_ALT:
+		return HTTPS_ALT_PORT, PROTO_TCP
+	case P2P:
+		return P2P_PORT, PROTO_UDP
+	case BITTORRENT:
+		return BITTORRENT_PORT, PROTO_UDP
+	}
+
+	return 0, 0
+}
+
+// Create a random flow record for the given application protocol
+func CreateQuickFlow(sysUptime uint32, proto Proto, avgBytes int) FlowRecord {
+	dstPort, ipProtocol := proto.PortAndProtocol()
+
+	srcIp := fmt.Sprintf("10.%d.%d.%d", rand.Intn(256), rand.Intn(256), rand.Intn(254)+1)
+	dstIp := fmt.Sprintf("172.%d.%d.%d", rand.Intn(16)+16, rand.Intn(256), rand.Intn(254)+1)
+
+	record := CreateCustomFlow(
+		sysUptime,
+		srcIp,
+		uint16(rand.Intn(UINT16_MAX-1024)+1024),
+		dstIp,
+		dstPort,
+		ipProtocol,
+		"",
+		rand.Intn(avgBytes)+avgBytes/2,
+		FlowFieldValues{},
+	)
+
+	// Quick flows end in the second half of the last tick and start in the
+	//  first half
+	record.SysUptimeEnd = sysUptime - uint32(randomNum(0, TICK_INTERVAL_MS/2))
+	record.SysUptimeStart = record.SysUptimeEnd - uint32(randomNum(TICK_INTERVAL_MS/2, TICK_INTERVAL_MS))
+
+	// The sources of quick flows are always below their destinations, so
+	//  the false index is drawn at random. Without the option interface
+	//  indexes are not reported
+	if opts.FalseIndex {
+		record.SnmpInIndex = uint16(rand.Intn(2) + 1)
+		record.SnmpOutIndex = 3 - record.SnmpInIndex
+	} else {
+		record.SnmpInIndex = 0
+		record.SnmpOutIndex = 0
+	}
+
+	return record
+}
+
+type quickSender struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	clock    *HostClock
+	exporter Exporter
+}
+
+func (s *quickSender) sysUptime() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clock.CreateCalcUptime()
+
+	return s.clock.SysUptime
+}
+
+// Send records in packets of MAX_FLOWS_PER_RECORD, the exporter state is
+// shared between the regular and the spike goroutine
+func (s *quickSender) send(records []FlowRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < len(records); i += MAX_FLOWS_PER_RECORD {
+		end := i + MAX_FLOWS_PER_RECORD
+		if end > len(records) {
+			end = len(records)
+		}
+
+		for _, buffer := range s.exporter.BuildPackets(records[i:end]) {
+			if !opts.Simulate {
+				bytesWritten, err := s.conn.Write(buffer)
+				if err != nil {
+					log.Fatal("Failed to write: ", err)
+				}
+
+				sentRecordsTotalBytesCounter.Add(float64(bytesWritten))
+			}
+
+			sentNetflowTotalCounter.Inc()
+		}
+
+		sentRecordsTotalCounter.Add(float64(end - i))
+	}
+}
+
+// Generate random flows of all protocols to the collector given on the
+// command line, without a config file
+func RunQuickMode(target string, port int) error {
+	config := ConfigFile{
+		CollectorIp:        target,
+		CollectorPort:      port,
+		CollectorTransport: TRANSPORT_UDP,
+	}
+
+	clock := NewHostClock(0)
+
+	sender := &quickSender{
+		clock:    clock,
+		exporter: NewNetflowV5Exporter(clock, 0),
+	}
+
+	if !opts.Simulate {
+		conn, err := InitUdpConn(config, "")
+
+		if err != nil {
+			return err
+		}
+
+		sender.conn = conn
+	}
+
+	if opts.Spike != "" {
+		spikeProto, err := ParseProtoName(opts.Spike)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Generating spike for protocol " + opts.Spike)
+
+		go func() {
+			for {
+				var records []FlowRecord
+				sysUptime := sender.sysUptime()
+				for i := 0; i < opts.FlowCount*SPIKE_FLOW_MULTIPLIER; i++ {
+					records = append(records, CreateQuickFlow(sysUptime, spikeProto, PAYLOAD_AVG_MD))
+				}
+
+				sender.send(records)
+
+				time.Sleep(TICK_INTERVAL_MS * time.Millisecond)
+			}
+		}()
+	}
+
+	fmt.Printf("Sending %d flows per tick to %s:%d\n", opts.FlowCount, target, port)
+
+	for {
+		var records []FlowRecord
+		sysUptime := sender.sysUptime()
+		for i := 0; i < opts.FlowCount; i++ {
+			proto := Proto(rand.Intn(len(protoNames)) + 1)
+			records = append(records, CreateQuickFlow(sysUptime, proto, PAYLOAD_AVG_SM))
+		}
+
+		sender.send(records)
+
+		time.Sleep(TICK_INTERVAL_MS * time.Millisecond)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestCreateCustomFlowFalseIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		srcIp   string
+		dstIp   string
+		wantIn  uint16
+		wantOut uint16
+	}{
+		{"source above destination", "172.16.0.1", "10.0.0.1", 1, 2},
+		{"source below destination", "10.0.0.1", "172.16.0.1", 2, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := CreateCustomFlow(1000, test.srcIp, 40000, test.dstIp, 443, PROTO_TCP, "", 1500, FlowFieldValues{})
+
+			if record.SnmpInIndex != test.wantIn || record.SnmpOutIndex != test.wantOut {
+				t.Errorf("got interfaces %d/%d, want %d/%d", record.SnmpInIndex, record.SnmpOutIndex, test.wantIn, test.wantOut)
+			}
+		})
+	}
+}
+
+func TestCreateQuickFlowFalseIndex(t *testing.T) {
+	falseIndex := opts.FalseIndex
+	defer func() { opts.FalseIndex = falseIndex }()
+
+	opts.FalseIndex = true
+
+	inputs := map[uint16]bool{}
+
+	for i := 0; i < 100; i++ {
+		record := CreateQuickFlow(100000, HTTPS, 1000)
+
+		if record.SnmpInIndex+record.SnmpOutIndex != 3 {
+			t.Fatalf("got interfaces %d/%d, want 1/2 or 2/1", record.SnmpInIndex, record.SnmpOutIndex)
+		}
+
+		inputs[record.SnmpInIndex] = true
+	}
+
+	if !inputs[1] || !inputs[2] {
+		t.Errorf("got input interfaces %v, want both 1 and 2", inputs)
+	}
+}
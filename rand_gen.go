@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"net/netip"
 	"strconv"
 	"time"
 )
@@ -16,6 +17,19 @@ func InitRandGen(config ConfigFile) *rand.Rand {
 	}
 }
 
-func GenBytesValue(randGen *rand.Rand) int {
-	return randGen.Intn(1000) + 50
+func GenBytesValue(distribution *ConfigBytesDistribution, randGen *rand.Rand) int {
+	return distribution.Gen(randGen)
+}
+
+// Generate a random address in the same family as the peer address
+func GenRandAddr(randGen *rand.Rand, peerAddr string) string {
+	peer, err := netip.ParseAddr(peerAddr)
+
+	if err == nil && peer.Is6() {
+		var addr [16]byte
+		randGen.Read(addr[:])
+		return netip.AddrFrom16(addr).String()
+	}
+
+	return ConvertIntToIp(randGen.Uint32()).String()
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"syscall"
+)
+
+// Packets are fragmented to the ethernet MTU, the kernel does not fragment
+// the packets of a raw socket
+const RAW_MTU = 1500
+
+// Raw IPv4 socket that sends udp packets with the address of a simulated
+// host as source, requires CAP_NET_RAW
+type RawUdpConn struct {
+	fd      int
+	srcIp   uint32
+	srcPort uint16
+	dstIp   uint32
+	dstPort uint16
+	dstAddr syscall.SockaddrInet4
+
+	// Identification of the last packet, shared by its fragments
+	ipId uint16
+}
+
+func InitRawUdpConn(config ConfigFile, host ConfigHost) (*RawUdpConn, error) {
+	srcAddr, err := netip.ParseAddr(host.Ip)
+
+	if err != nil || !srcAddr.Is4() {
+		return nil, fmt.Errorf("raw source mode requires an IPv4 host ip, got %s", host.Ip)
+	}
+
+	dstAddr, err := netip.ParseAddr(config.CollectorIp)
+
+	if err != nil || !dstAddr.Is4() {
+		return nil, fmt.Errorf("raw source mode requires an IPv4 collector ip, got %s", config.CollectorIp)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raw socket: %v", err)
+	}
+
+	conn := &RawUdpConn{
+		fd:      fd,
+		srcIp:   IPtoUint32(host.Ip),
+		srcPort: uint16(rand.Intn(UINT16_MAX-32768) + 32768),
+		dstIp:   IPtoUint32(config.CollectorIp),
+		dstPort: uint16(config.CollectorPort),
+		dstAddr: syscall.SockaddrInet4{Addr: dstAddr.As4()},
+	}
+
+	return conn, nil
+}
+
+func (c *RawUdpConn) Write(payload []byte) (int, error) {
+	datagram := BuildUdpHeader(c.srcPort, c.dstPort, len(payload))
+	datagram = append(datagram, payload...)
+
+	// Fragments carry a multiple of 8 bytes of the datagram, except the last
+	fragmentLen := (RAW_MTU - IPV4_HEADER_LEN) &^ 7
+	c.ipId++
+
+	for offset := 0; offset < len(datagram); offset += fragmentLen {
+		end := offset + fragmentLen
+		if end > len(datagram) {
+			end = len(datagram)
+		}
+
+		packet := BuildIPv4FragmentHeader(c.srcIp, c.dstIp, PROTO_UDP, 0, c.ipId, offset, end < len(datagram), end-offset)
+		packet = append(packet, datagram[offset:end]...)
+
+		err := syscall.Sendto(c.fd, packet, 0, &c.dstAddr)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(payload), nil
+}
+
+func (c *RawUdpConn) Close() error {
+	return syscall.Close(c.fd)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func InitRawUdpConn(config ConfigFile, host ConfigHost) (io.Writer, error) {
+	return nil, fmt.Errorf("raw source mode is only supported on linux")
+}
@@ -3,54 +3,246 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"path/filepath"
 )
 
 type ConfigHost struct {
-	Ip   string `json:"ip"`
-	Name string `json:"name"`
+	Ip           string `json:"ip"`
+	Name         string `json:"name"`
+	SourceId     uint32 `json:"source_id"`
+	ExportFormat string `json:"export_format"`
+
+	// Only every sampling_rate-th packet of a flow is exported
+	SamplingRate int `json:"sampling_rate"`
+
+	// Records per second sent by the host, overrides the share of the host
+	// in the target rate of the config file
+	TargetRate float64 `json:"target_rate"`
+
+	// Interfaces of the host, the interface indexes of a record are derived
+	// from the neighbors of the host in the hops of the flow
+	Interfaces []ConfigInterface `json:"interfaces"`
 }
 
 type ConfigFlowUser struct {
-	SrcAddr string   `json:"src_addr"`
-	SrcPort string   `json:"src_port"`
-	DstAddr string   `json:"dst_addr"`
-	DstPort string   `json:"dst_port"`
-	Proto   string   `json:"proto"`
-	Hops    []string `json:"hops"`
-	Count   int      `json:"count"`
+	SrcAddr string          `json:"src_addr"`
+	SrcPort string          `json:"src_port"`
+	DstAddr string          `json:"dst_addr"`
+	DstPort string          `json:"dst_port"`
+	Proto   string          `json:"proto"`
+	Hops    []ConfigHopUser `json:"hops"`
+	Count   int             `json:"count"`
+
+	// Expand only the first max_flows tuples of the addresses, ports and
+	// protocols of the flow, or sample random tuples
+	MaxFlows int `json:"max_flows"`
+	Sample   int `json:"sample"`
+
+	// Skew of the bytes or the rate across the expanded flows
+	Weights  []ConfigFlowWeight `json:"weights"`
+	WeightBy string             `json:"weight_by"`
+
+	// Optional record fields, a value or a range that is picked from every tick
+	Packets  string `json:"packets"`
+	TcpFlags string `json:"tcp_flags"`
+	Tos      string `json:"tos"`
+	SrcAs    string `json:"src_as"`
+	DstAs    string `json:"dst_as"`
+	SrcMask  string `json:"src_mask"`
+	DstMask  string `json:"dst_mask"`
+
+	// Duration in seconds of a long-lived flow, a value or a range that is
+	// picked from for every session of the flow
+	Duration string `json:"duration"`
+
+	// Also send the reply flow, with response_ratio times the bytes
+	Bidirectional bool    `json:"bidirectional"`
+	ResponseRatio float64 `json:"response_ratio"`
+
+	// Return path of the reply flow, the hops in reverse order by default
+	ReturnHops []ConfigHopUser `json:"return_hops"`
+
+	// Overrides the bytes distribution of the config file
+	BytesDistribution *ConfigBytesDistribution `json:"bytes_distribution"`
+
+	// Name of the traffic profile of the flow, overrides the profile of the
+	// config file
+	Profile string `json:"profile"`
 }
 
 type ConfigFile struct {
-	Seed          int              `json:"seed"`
-	FlowTimeout   int              `json:"flow_timeout"`
-	CollectorIp   string           `json:"collector_ip"`
-	CollectorPort int              `json:"collector_port"`
-	Hosts         []ConfigHost     `json:"hosts"`
-	Flows         []ConfigFlowUser `json:"flows"`
+	Seed                   int                              `json:"seed"`
+	FlowTimeout            int                              `json:"flow_timeout"`
+	CollectorIp            string                           `json:"collector_ip"`
+	CollectorPort          int                              `json:"collector_port"`
+	CollectorTransport     string                           `json:"collector_transport"`
+	ExportFormat           string                           `json:"export_format"`
+	TemplateRefreshPackets int                              `json:"template_refresh_packets"`
+	TemplateRefreshSeconds int                              `json:"template_refresh_seconds"`
+	SflowCollectorPort     int                              `json:"sflow_collector_port"`
+	SflowSamplingRate      int                              `json:"sflow_sampling_rate"`
+	SflowCounterSeconds    int                              `json:"sflow_counter_seconds"`
+	BytesDistribution      *ConfigBytesDistribution         `json:"bytes_distribution"`
+	MaxExpandedFlows       int                              `json:"max_expanded_flows"`
+	TargetRate             float64                          `json:"target_rate"`
+	ActiveTimeout          int                              `json:"active_timeout"`
+	InactiveTimeout        int                              `json:"inactive_timeout"`
+	Profiles               map[string]*ConfigTrafficProfile `json:"profiles"`
+	Profile                string                           `json:"profile"`
+	Hosts                  []ConfigHost                     `json:"hosts"`
+	Flows                  []ConfigFlowUser                 `json:"flows"`
+	Scenarios              []ConfigScenario                 `json:"scenarios"`
 }
 
 func ReadFlowConfigFile(config *ConfigFile, filename string) error {
-	jsonFile, err := os.Open(filename)
+	// Includes and flow templates are resolved into a single JSON document
+	byteValue, err := LoadConfigDocument(filename)
 
 	if err != nil {
-		return fmt.Errorf("failed to open config file %s: %v", filename, err)
+		return err
 	}
 
-	defer jsonFile.Close()
-
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-
 	err = json.Unmarshal(byteValue, config)
 
 	if err != nil {
 		return fmt.Errorf("failed to parse config file %s: %v", filename, err)
 	}
 
+	if config.FlowTimeout < 0 {
+		return fmt.Errorf("invalid config file %s: invalid flow timeout %d: must not be negative", filename, config.FlowTimeout)
+	}
+
 	if config.FlowTimeout == 0 {
 		config.FlowTimeout = 60
 	}
 
+	if config.ExportFormat == "" {
+		config.ExportFormat = EXPORT_FORMAT_NETFLOW5
+	}
+
+	if config.CollectorTransport == "" {
+		config.CollectorTransport = TRANSPORT_UDP
+	}
+
+	if config.TemplateRefreshPackets == 0 {
+		config.TemplateRefreshPackets = 20
+	}
+
+	if config.TemplateRefreshSeconds == 0 {
+		config.TemplateRefreshSeconds = 30
+	}
+
+	if config.SflowSamplingRate == 0 {
+		config.SflowSamplingRate = 100
+	}
+
+	if config.SflowCounterSeconds == 0 {
+		config.SflowCounterSeconds = 20
+	}
+
+	if config.ActiveTimeout == 0 {
+		config.ActiveTimeout = 60
+	}
+
+	if config.InactiveTimeout == 0 {
+		config.InactiveTimeout = 15
+	}
+
+	if config.BytesDistribution == nil {
+		config.BytesDistribution = DefaultBytesDistribution()
+	}
+
+	configDir := filepath.Dir(filename)
+
+	err = config.BytesDistribution.Init(configDir)
+
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+
+	for i, flow := range config.Flows {
+		if flow.BytesDistribution == nil {
+			continue
+		}
+
+		err = flow.BytesDistribution.Init(configDir)
+
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: flow %d: %v", filename, i, err)
+		}
+	}
+
+	for name, profile := range config.Profiles {
+		err = profile.Init(configDir)
+
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: profile %s: %v", filename, name, err)
+		}
+	}
+
+	if _, ok := config.Profiles[config.Profile]; config.Profile != "" && !ok {
+		return fmt.Errorf("invalid config file %s: profile %s not found", filename, config.Profile)
+	}
+
+	for i, flow := range config.Flows {
+		err = ValidateFlowWeights(flow)
+
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: flow %d: %v", filename, i, err)
+		}
+
+		if _, ok := config.Profiles[flow.Profile]; flow.Profile != "" && !ok {
+			return fmt.Errorf("invalid config file %s: flow %d: profile %s not found", filename, i, flow.Profile)
+		}
+
+		err = ValidateExpandedFlows(*config, flow)
+
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: flow %d: %v", filename, i, err)
+		}
+	}
+
+	if config.TargetRate < 0 {
+		return fmt.Errorf("invalid config file %s: invalid target rate %v: must not be negative", filename, config.TargetRate)
+	}
+
+	for _, host := range config.Hosts {
+		if host.TargetRate < 0 {
+			return fmt.Errorf("invalid config file %s: host %s: invalid target rate %v: must not be negative", filename, host.Name, host.TargetRate)
+		}
+	}
+
+	err = ValidateScenarios(*config)
+
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+
+	err = ValidateTotalExpandedFlows(*config)
+
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+
+	err = ValidateHostInterfaces(*config)
+
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+
+	err = ValidateAddrFamilies(*config)
+
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", filename, err)
+	}
+
+	for _, host := range config.Hosts {
+		err = ValidateHostSourceId(*config, host.Name)
+
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: host %s: %v", filename, host.Name, err)
+		}
+	}
+
 	return nil
 }
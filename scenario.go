@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	SCENARIO_PORT_SCAN    = "port_scan"
+	SCENARIO_DDOS         = "ddos"
+	SCENARIO_EXFILTRATION = "exfiltration"
+	SCENARIO_BEACON       = "beacon"
+)
+
+// Anomaly injected on top of the flows of the config file, start and
+// duration are seconds from the start of sending:
+//
+//	{"name": "scan1", "type": "port_scan", "start": 60, "src_addr": "10.9.9.9", "dst_addr": "10.2.0.1", "dst_port": "1-1024", "rate": 50, "hops": ["gw1"]}
+type ConfigScenario struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Start    int             `json:"start"`
+	Duration int             `json:"duration"`
+	SrcAddr  string          `json:"src_addr"`
+	SrcPort  string          `json:"src_port"`
+	DstAddr  string          `json:"dst_addr"`
+	DstPort  string          `json:"dst_port"`
+	Proto    string          `json:"proto"`
+	Hops     []ConfigHopUser `json:"hops"`
+
+	// Bytes of every record, a value or a range
+	Bytes string `json:"bytes"`
+
+	// Probes per second of a port scan
+	Rate int `json:"rate"`
+
+	// Seconds between the connections of a beacon
+	Interval int `json:"interval"`
+}
+
+// Schedule of a scenario flow in absolute ticks, the flow fires every
+// Interval ticks from FirstTick until EndTick, or once for Interval 0
+type FlowScenario struct {
+	Name      string
+	Type      string
+	StartTick int
+	EndTick   int
+	FirstTick int
+	Interval  int
+
+	// State of the current tick
+	Firing bool
+	Ended  bool
+}
+
+// Default values of a scenario type
+type scenarioDefaults struct {
+	DstPort  string
+	Proto    string
+	Bytes    string
+	TcpFlags string
+}
+
+var SCENARIO_DEFAULTS = map[string]scenarioDefaults{
+	SCENARIO_PORT_SCAN:    {DstPort: "1-1024", Proto: "6", Bytes: "44", TcpFlags: "SYN"},
+	SCENARIO_DDOS:         {DstPort: "80", Proto: "17", Bytes: "100000-200000"},
+	SCENARIO_EXFILTRATION: {DstPort: "443", Proto: "6", Bytes: "10000000-20000000"},
+	SCENARIO_BEACON:       {DstPort: "443", Proto: "6", Bytes: "300"},
+}
+
+const (
+	DEFAULT_SCAN_RATE       = 100
+	DEFAULT_BEACON_INTERVAL = 60
+
+	// Added to the seed of the config file for the scenario generator
+	SCENARIO_SEED_OFFSET = 1
+)
+
+func SecondsToTicks(seconds int) int {
+	return seconds * 1000 / TICK_INTERVAL_MS
+}
+
+func (s ConfigScenario) flowUser() ConfigFlowUser {
+	defaults := SCENARIO_DEFAULTS[s.Type]
+
+	flow := ConfigFlowUser{
+		SrcAddr:  s.SrcAddr,
+		SrcPort:  s.SrcPort,
+		DstAddr:  s.DstAddr,
+		DstPort:  s.DstPort,
+		Proto:    s.Proto,
+		Hops:     s.Hops,
+		TcpFlags: defaults.TcpFlags,
+	}
+
+	if flow.DstPort == "" {
+		flow.DstPort = defaults.DstPort
+	}
+
+	if flow.Proto == "" {
+		flow.Proto = defaults.Proto
+	}
+
+	return flow
+}
+
+// Check the settings of a scenario, returns the setting of the first
+// problem. Addresses are checked with the flows
+func ValidateScenarioSettings(scenario ConfigScenario) (string, error) {
+	if _, ok := SCENARIO_DEFAULTS[scenario.Type]; !ok {
+		return "type", fmt.Errorf("unknown type %q", scenario.Type)
+	}
+
+	if len(scenario.Hops) == 0 {
+		return "hops", fmt.Errorf("hops not provided")
+	}
+
+	if scenario.Start < 0 {
+		return "start", fmt.Errorf("invalid start %d: must not be negative", scenario.Start)
+	}
+
+	if scenario.Duration < 0 {
+		return "duration", fmt.Errorf("invalid duration %d: must not be negative", scenario.Duration)
+	}
+
+	if scenario.Duration == 0 && scenario.Type != SCENARIO_PORT_SCAN {
+		return "duration", fmt.Errorf("duration not provided")
+	}
+
+	if scenario.Rate < 0 {
+		return "rate", fmt.Errorf("invalid rate %d: must not be negative", scenario.Rate)
+	}
+
+	if scenario.Rate > 0 && scenario.Type != SCENARIO_PORT_SCAN {
+		return "rate", fmt.Errorf("rate is only used by %s scenarios", SCENARIO_PORT_SCAN)
+	}
+
+	if scenario.Interval < 0 {
+		return "interval", fmt.Errorf("invalid interval %d: must not be negative", scenario.Interval)
+	}
+
+	if scenario.Interval > 0 && scenario.Type != SCENARIO_BEACON {
+		return "interval", fmt.Errorf("interval is only used by %s scenarios", SCENARIO_BEACON)
+	}
+
+	// A beacon with a longer interval would connect only once
+	if scenario.Interval > scenario.Duration && scenario.Type == SCENARIO_BEACON {
+		return "interval", fmt.Errorf("invalid interval %d: must not be longer than the duration %d", scenario.Interval, scenario.Duration)
+	}
+
+	_, err := scenario.bytesDistribution()
+
+	if err != nil {
+		return "bytes", err
+	}
+
+	return "", nil
+}
+
+// Check the fields of every scenario, addresses are checked with the flows
+func ValidateScenarios(config ConfigFile) error {
+	names := map[string]bool{}
+
+	for i, scenario := range config.Scenarios {
+		if scenario.Name != "" && names[scenario.Name] {
+			return fmt.Errorf("scenario %d: duplicate name %s", i, scenario.Name)
+		}
+		names[scenario.Name] = true
+
+		_, err := ValidateScenarioSettings(scenario)
+
+		if err != nil {
+			return fmt.Errorf("scenario %d: %v", i, err)
+		}
+
+		err = ValidateExpandedFlows(config, scenario.flowUser())
+
+		if err != nil {
+			return fmt.Errorf("scenario %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Bytes of every record of a scenario, the default of its type if not set.
+// The panic of the range parser is returned as an error
+func (s ConfigScenario) bytesDistribution() (dist *ConfigBytesDistribution, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	input := s.Bytes
+	if input == "" {
+		input = SCENARIO_DEFAULTS[s.Type].Bytes
+	}
+
+	bytes := ParseUserRangeInput("bytes", input, 1, math.MaxInt32)
+
+	if bytes.Min == bytes.Max {
+		return &ConfigBytesDistribution{Type: BYTES_DIST_CONSTANT, Value: bytes.Min}, nil
+	}
+
+	return &ConfigBytesDistribution{Type: BYTES_DIST_UNIFORM, Min: bytes.Min, Max: bytes.Max}, nil
+}
+
+// Expand the scenarios of the config file into flows, which are sent on
+// their own schedule instead of once per flow_timeout
+func ParseUserScenarios(config *ConfigFile) []ConfigFlow {
+	var flowConfigs []ConfigFlow
+
+	for i, scenario := range config.Scenarios {
+		if scenario.Name == "" {
+			scenario.Name = fmt.Sprintf("%s-%d", scenario.Type, i)
+		}
+
+		bytesDistribution, err := scenario.bytesDistribution()
+
+		if err != nil {
+			panic(fmt.Errorf("scenario %d: %v", i, err))
+		}
+
+		flow := scenario.flowUser()
+		flow.BytesDistribution = bytesDistribution
+
+		// Scenario flows do not follow the traffic profile of the config file
+		scenarioConfig := *config
+		scenarioConfig.Flows = []ConfigFlowUser{flow}
+		scenarioConfig.Profile = ""
+
+		flows := ExpandMultiFlows(ParseUserFlows(&scenarioConfig))
+
+		schedule := FlowScenario{
+			Name:      scenario.Name,
+			Type:      scenario.Type,
+			StartTick: SecondsToTicks(scenario.Start),
+			FirstTick: SecondsToTicks(scenario.Start),
+			Interval:  1,
+		}
+
+		rate := scenario.Rate
+		if rate == 0 {
+			rate = DEFAULT_SCAN_RATE
+		}
+
+		duration := scenario.Duration
+		if duration == 0 {
+			// Port scans last until every port has been probed
+			duration = (len(flows) + rate - 1) / rate
+		}
+
+		schedule.EndTick = schedule.StartTick + SecondsToTicks(duration)
+
+		if scenario.Type == SCENARIO_BEACON {
+			schedule.Interval = scenario.Interval
+			if schedule.Interval == 0 {
+				schedule.Interval = DEFAULT_BEACON_INTERVAL
+			}
+			schedule.Interval = SecondsToTicks(schedule.Interval)
+		}
+
+		for j := range flows {
+			flowScenario := schedule
+
+			// Every probe of a port scan is a single flow, rate probes per second
+			if scenario.Type == SCENARIO_PORT_SCAN {
+				flowScenario.FirstTick += SecondsToTicks(j / rate)
+				flowScenario.Interval = 0
+			}
+
+			flows[j].Scenario = &flowScenario
+			flowConfigs = append(flowConfigs, flows[j])
+		}
+	}
+
+	return flowConfigs
+}
+
+// Scenario flows draw from their own generator, so adding scenarios does
+// not change the values of the flows of the config file
+func InitScenarioRandGen(config ConfigFile) *rand.Rand {
+	if config.Seed == 0 {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return rand.New(rand.NewSource(int64(config.Seed) + SCENARIO_SEED_OFFSET))
+}
+
+// Advance a scenario flow to the absolute tick, the values of the flow are
+// only drawn in the ticks it is sent
+func (f *ConfigFlow) AdvanceScenario(absTick int, randGen *rand.Rand) {
+	f.Scenario.Advance(absTick)
+
+	if !f.Scenario.Firing {
+		return
+	}
+
+	f.Bytes = GenBytesValue(f.BytesDistribution, randGen)
+	f.FieldValues = GenFlowFieldValues(f.Fields, randGen)
+	f.GenHopVolumes(randGen)
+}
+
+// Advance the schedule of a scenario flow to the absolute tick
+func (s *FlowScenario) Advance(absTick int) {
+	s.Ended = absTick >= s.EndTick || (s.Interval == 0 && absTick > s.FirstTick)
+
+	s.Firing = !s.Ended && absTick >= s.FirstTick
+	if s.Firing && s.Interval == 0 {
+		s.Firing = absTick == s.FirstTick
+	} else if s.Firing {
+		s.Firing = (absTick-s.FirstTick)%s.Interval == 0
+	}
+}
+
+// Ground truth of a scenario in the stats file
+type OutStatsScenario struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	StartMs int64  `json:"start_ms"`
+	EndMs   int64  `json:"end_ms"`
+	Flows   int    `json:"flows"`
+}
+
+// Time window and number of flows of every scenario
+func ScenarioStats(flowConfigs []ConfigFlow, sendStart time.Time) []OutStatsScenario {
+	var scenarios []OutStatsScenario
+
+	indexes := map[string]int{}
+
+	for _, flowConfig := range flowConfigs {
+		if flowConfig.Scenario == nil {
+			continue
+		}
+
+		i, ok := indexes[flowConfig.Scenario.Name]
+
+		if !ok {
+			i = len(scenarios)
+			indexes[flowConfig.Scenario.Name] = i
+
+			scenarios = append(scenarios, OutStatsScenario{
+				Name:    flowConfig.Scenario.Name,
+				Type:    flowConfig.Scenario.Type,
+				StartMs: TickUnixMillis(sendStart, flowConfig.Scenario.StartTick),
+				EndMs:   TickUnixMillis(sendStart, flowConfig.Scenario.EndTick),
+			})
+		}
+
+		scenarios[i].Flows++
+	}
+
+	return scenarios
+}
@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+func TestFlowScenarioAdvance(t *testing.T) {
+	continuous := FlowScenario{StartTick: 10, FirstTick: 10, EndTick: 20, Interval: 1}
+	beacon := FlowScenario{StartTick: 0, FirstTick: 0, EndTick: 100, Interval: 30}
+	probe := FlowScenario{StartTick: 0, FirstTick: 5, EndTick: 50, Interval: 0}
+
+	tests := []struct {
+		name       string
+		scenario   FlowScenario
+		tick       int
+		wantFiring bool
+		wantEnded  bool
+	}{
+		{"before the start", continuous, 9, false, false},
+		{"at the start", continuous, 10, true, false},
+		{"last tick", continuous, 19, true, false},
+		{"at the end", continuous, 20, false, true},
+		{"after the end", continuous, 25, false, true},
+		{"beacon first tick", beacon, 0, true, false},
+		{"beacon between intervals", beacon, 15, false, false},
+		{"beacon interval", beacon, 30, true, false},
+		{"beacon last interval", beacon, 90, true, false},
+		{"beacon end", beacon, 100, false, true},
+		{"probe before its tick", probe, 4, false, false},
+		{"probe tick", probe, 5, true, false},
+		{"probe sent", probe, 6, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scenario := test.scenario
+			scenario.Advance(test.tick)
+
+			if scenario.Firing != test.wantFiring || scenario.Ended != test.wantEnded {
+				t.Errorf("tick %d: got firing %v ended %v, want firing %v ended %v", test.tick, scenario.Firing, scenario.Ended, test.wantFiring, test.wantEnded)
+			}
+		})
+	}
+}
+
+func TestParseUserScenariosPortScan(t *testing.T) {
+	config := ConfigFile{
+		Seed:        1,
+		FlowTimeout: 60,
+		Hosts:       []ConfigHost{{Name: "gw1", Ip: "10.0.0.3"}},
+		Scenarios: []ConfigScenario{{
+			Type:    SCENARIO_PORT_SCAN,
+			Start:   10,
+			SrcAddr: "10.9.9.9",
+			DstAddr: "10.2.0.1",
+			DstPort: "1-10",
+			Rate:    4,
+			Hops:    []ConfigHopUser{{Host: "gw1"}},
+		}},
+	}
+
+	flows := ParseUserScenarios(&config)
+
+	if len(flows) != 10 {
+		t.Fatalf("got %d flows, want a probe per port", len(flows))
+	}
+
+	// Rate probes per second, the scan lasts until every port is probed
+	for j, flow := range flows {
+		wantTick := SecondsToTicks(10 + j/4)
+
+		if flow.Scenario.FirstTick != wantTick || flow.Scenario.Interval != 0 {
+			t.Errorf("probe %d: got first tick %d interval %d, want first tick %d interval 0", j, flow.Scenario.FirstTick, flow.Scenario.Interval, wantTick)
+		}
+
+		if flow.Scenario.EndTick != SecondsToTicks(13) {
+			t.Errorf("probe %d: got end tick %d, want %d", j, flow.Scenario.EndTick, SecondsToTicks(13))
+		}
+
+		if flow.Scenario.Name != "port_scan-0" {
+			t.Errorf("probe %d: got name %s, want port_scan-0", j, flow.Scenario.Name)
+		}
+	}
+}
+
+func TestValidateScenarioSettings(t *testing.T) {
+	hops := []ConfigHopUser{{Host: "gw1"}}
+
+	tests := []struct {
+		name        string
+		scenario    ConfigScenario
+		wantSetting string
+	}{
+		{"valid ddos", ConfigScenario{Type: SCENARIO_DDOS, Duration: 10, Bytes: "100-200", Hops: hops}, ""},
+		{"valid port scan", ConfigScenario{Type: SCENARIO_PORT_SCAN, Rate: 10, Hops: hops}, ""},
+		{"unknown type", ConfigScenario{Type: "worm", Duration: 10, Hops: hops}, "type"},
+		{"no hops", ConfigScenario{Type: SCENARIO_DDOS, Duration: 10}, "hops"},
+		{"no duration", ConfigScenario{Type: SCENARIO_DDOS, Hops: hops}, "duration"},
+		{"invalid bytes", ConfigScenario{Type: SCENARIO_DDOS, Duration: 10, Bytes: "zzz", Hops: hops}, "bytes"},
+		{"bytes out of range", ConfigScenario{Type: SCENARIO_DDOS, Duration: 10, Bytes: "0", Hops: hops}, "bytes"},
+		{"negative rate", ConfigScenario{Type: SCENARIO_PORT_SCAN, Rate: -1, Hops: hops}, "rate"},
+		{"rate of a beacon", ConfigScenario{Type: SCENARIO_BEACON, Duration: 60, Rate: 5, Hops: hops}, "rate"},
+		{"interval of a ddos", ConfigScenario{Type: SCENARIO_DDOS, Duration: 60, Interval: 5, Hops: hops}, "interval"},
+		{"interval longer than the duration", ConfigScenario{Type: SCENARIO_BEACON, Duration: 60, Interval: 120, Hops: hops}, "interval"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setting, err := ValidateScenarioSettings(test.scenario)
+
+			if setting != test.wantSetting || (err == nil) != (test.wantSetting == "") {
+				t.Errorf("got setting %q error %v, want setting %q", setting, err, test.wantSetting)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// sFlow v5 data formats (sflow_version_5.txt)
+const (
+	SFLOW_VERSION              = 5
+	SFLOW_ADDRESS_TYPE_IPV4    = 1
+	SFLOW_ADDRESS_TYPE_IPV6    = 2
+	SFLOW_FLOW_SAMPLE          = 1
+	SFLOW_COUNTER_SAMPLE       = 2
+	SFLOW_RAW_PACKET_HEADER    = 1
+	SFLOW_GENERIC_COUNTERS     = 1
+	SFLOW_HEADER_PROTO_ETH     = 1
+	SFLOW_FCS_LEN              = 4
+	SFLOW_IF_TYPE_ETHERNET     = 6
+	SFLOW_IF_DIRECTION_FULL    = 1
+	SFLOW_IF_STATUS_UP         = 3
+	SFLOW_DEFAULT_IF_SPEED_BPS = 10000000000
+)
+
+// Datagrams are kept below the MTU like the datagrams of agents, and large
+// flows are sampled at most this many times per record
+const (
+	SFLOW_MAX_DATAGRAM_LEN       = 1400
+	SFLOW_MAX_SAMPLES_PER_RECORD = 10
+)
+
+type SflowFlowSampleHeader struct {
+	SequenceNumber uint32
+	SourceId       uint32
+	SamplingRate   uint32
+	SamplePool     uint32
+	Drops          uint32
+	Input          uint32
+	Output         uint32
+	NumRecords     uint32
+}
+
+type SflowRawPacketHeader struct {
+	HeaderProtocol uint32
+	FrameLength    uint32
+	Stripped       uint32
+	HeaderLength   uint32
+}
+
+type SflowCounterSampleHeader struct {
+	SequenceNumber uint32
+	SourceId       uint32
+	NumRecords     uint32
+}
+
+type SflowGenericCounters struct {
+	IfIndex            uint32
+	IfType             uint32
+	IfSpeed            uint64
+	IfDirection        uint32
+	IfStatus           uint32
+	IfInOctets         uint64
+	IfInUcastPkts      uint32
+	IfInMulticastPkts  uint32
+	IfInBroadcastPkts  uint32
+	IfInDiscards       uint32
+	IfInErrors         uint32
+	IfInUnknownProtos  uint32
+	IfOutOctets        uint64
+	IfOutUcastPkts     uint32
+	IfOutMulticastPkts uint32
+	IfOutBroadcastPkts uint32
+	IfOutDiscards      uint32
+	IfOutErrors        uint32
+	IfPromiscuousMode  uint32
+}
+
+// Running interface counters reported in counter samples
+type SflowInterfaceState struct {
+	FlowSequence    uint32
+	CounterSequence uint32
+	SamplePool      uint32
+	Counters        SflowGenericCounters
+}
+
+// sFlow exporter state, one per simulated host
+type SflowExporter struct {
+	Clock           *HostClock
+	AgentAddr       netip.Addr
+	SubAgentId      uint32
+	SamplingRate    int
+	CounterInterval time.Duration
+
+	// Configured interface speeds, other interfaces use the default speed
+	InterfaceSpeeds map[uint32]uint64
+
+	sequenceNumber uint32
+	lastCounters   time.Time
+	interfaces     map[uint32]*SflowInterfaceState
+}
+
+func NewSflowExporter(clock *HostClock, agentIp string, subAgentId uint32, samplingRate int, counterInterval time.Duration) *SflowExporter {
+	return &SflowExporter{
+		Clock:           clock,
+		AgentAddr:       netip.MustParseAddr(agentIp),
+		SubAgentId:      subAgentId,
+		SamplingRate:    samplingRate,
+		CounterInterval: counterInterval,
+		interfaces:      map[uint32]*SflowInterfaceState{},
+	}
+}
+
+func (e *SflowExporter) getInterface(ifIndex uint32) *SflowInterfaceState {
+	state, ok := e.interfaces[ifIndex]
+
+	if !ok {
+		speed, ok := e.InterfaceSpeeds[ifIndex]
+		if !ok {
+			speed = SFLOW_DEFAULT_IF_SPEED_BPS
+		}
+
+		state = new(SflowInterfaceState)
+		state.Counters = SflowGenericCounters{
+			IfIndex:     ifIndex,
+			IfType:      SFLOW_IF_TYPE_ETHERNET,
+			IfSpeed:     speed,
+			IfDirection: SFLOW_IF_DIRECTION_FULL,
+			IfStatus:    SFLOW_IF_STATUS_UP,
+		}
+		e.interfaces[ifIndex] = state
+	}
+
+	return state
+}
+
+func (e *SflowExporter) BuildPackets(records []FlowRecord) [][]byte {
+	uptime := e.Clock.CreateCalcUptime()
+	now := time.Unix(int64(uptime.UnixSec), int64(uptime.UnixMsec))
+
+	var samples [][]byte
+
+	for _, record := range records {
+		samples = append(samples, e.flowSamples(record)...)
+	}
+
+	if e.lastCounters.IsZero() || now.Sub(e.lastCounters) >= e.CounterInterval {
+		samples = append(samples, e.counterSamples()...)
+		e.lastCounters = now
+	}
+
+	// Samples are packed into datagrams of at most SFLOW_MAX_DATAGRAM_LEN
+	//  bytes, like agents do
+	var packets [][]byte
+	var batch [][]byte
+
+	size := e.datagramHeaderLen()
+
+	for _, sample := range samples {
+		if len(batch) > 0 && size+len(sample) > SFLOW_MAX_DATAGRAM_LEN {
+			packets = append(packets, e.buildDatagram(batch))
+			batch = nil
+			size = e.datagramHeaderLen()
+		}
+
+		batch = append(batch, sample)
+		size += len(sample)
+	}
+
+	if len(batch) > 0 || len(packets) == 0 {
+		packets = append(packets, e.buildDatagram(batch))
+	}
+
+	return packets
+}
+
+func (e *SflowExporter) datagramHeaderLen() int {
+	if e.AgentAddr.Is4() {
+		return 28
+	}
+
+	return 40
+}
+
+func (e *SflowExporter) buildDatagram(samples [][]byte) []byte {
+	e.sequenceNumber++
+
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, uint32(SFLOW_VERSION))
+
+	if e.AgentAddr.Is4() {
+		agentAddr := e.AgentAddr.As4()
+		binary.Write(buffer, binary.BigEndian, uint32(SFLOW_ADDRESS_TYPE_IPV4))
+		buffer.Write(agentAddr[:])
+	} else {
+		agentAddr := e.AgentAddr.As16()
+		binary.Write(buffer, binary.BigEndian, uint32(SFLOW_ADDRESS_TYPE_IPV6))
+		buffer.Write(agentAddr[:])
+	}
+
+	binary.Write(buffer, binary.BigEndian, e.SubAgentId)
+	binary.Write(buffer, binary.BigEndian, e.sequenceNumber)
+	binary.Write(buffer, binary.BigEndian, e.Clock.SysUptime)
+	binary.Write(buffer, binary.BigEndian, uint32(len(samples)))
+
+	for _, sample := range samples {
+		buffer.Write(sample)
+	}
+
+	return buffer.Bytes()
+}
+
+// Flow samples for a record, one sample stands for SamplingRate packets of
+// the flow, so a record always produces at least one sample. Large flows
+// are capped at SFLOW_MAX_SAMPLES_PER_RECORD samples with a higher
+// sampling rate, so the collector still scales them to all packets
+func (e *SflowExporter) flowSamples(record FlowRecord) [][]byte {
+	numPackets := int(record.NumPackets)
+	if numPackets == 0 {
+		numPackets = 1
+	}
+
+	samplingRate := e.SamplingRate
+
+	numSamples := numPackets / samplingRate
+	if numSamples == 0 {
+		numSamples = 1
+	} else if numSamples > SFLOW_MAX_SAMPLES_PER_RECORD {
+		numSamples = SFLOW_MAX_SAMPLES_PER_RECORD
+		samplingRate = numPackets / numSamples
+	}
+
+	headerLen := SampledPacketHeaderLen(record)
+
+	frameLength := int(record.NumOctets)/numPackets + ETHERNET_HEADER_LEN
+	if frameLength < headerLen {
+		frameLength = headerLen
+	}
+
+	header := BuildSampledPacketHeader(record, frameLength)
+	headerPadding := (4 - len(header)%4) % 4
+
+	input := e.getInterface(uint32(record.SnmpInIndex))
+	output := e.getInterface(uint32(record.SnmpOutIndex))
+
+	input.Counters.IfInOctets += uint64(record.NumOctets)
+	input.Counters.IfInUcastPkts += uint32(numPackets)
+	output.Counters.IfOutOctets += uint64(record.NumOctets)
+	output.Counters.IfOutUcastPkts += uint32(numPackets)
+
+	// Flow record: raw packet header + header bytes
+	recordLen := 16 + len(header) + headerPadding
+
+	var samples [][]byte
+
+	for i := 0; i < numSamples; i++ {
+		input.FlowSequence++
+		input.SamplePool += uint32(samplingRate)
+
+		buffer := new(bytes.Buffer)
+
+		binary.Write(buffer, binary.BigEndian, uint32(SFLOW_FLOW_SAMPLE))
+		binary.Write(buffer, binary.BigEndian, uint32(32+8+recordLen))
+		binary.Write(buffer, binary.BigEndian, SflowFlowSampleHeader{
+			SequenceNumber: input.FlowSequence,
+			SourceId:       uint32(record.SnmpInIndex),
+			SamplingRate:   uint32(samplingRate),
+			SamplePool:     input.SamplePool,
+			Drops:          0,
+			Input:          uint32(record.SnmpInIndex),
+			Output:         uint32(record.SnmpOutIndex),
+			NumRecords:     1,
+		})
+
+		binary.Write(buffer, binary.BigEndian, uint32(SFLOW_RAW_PACKET_HEADER))
+		binary.Write(buffer, binary.BigEndian, uint32(recordLen))
+		binary.Write(buffer, binary.BigEndian, SflowRawPacketHeader{
+			HeaderProtocol: SFLOW_HEADER_PROTO_ETH,
+			FrameLength:    uint32(frameLength + SFLOW_FCS_LEN),
+			Stripped:       SFLOW_FCS_LEN,
+			HeaderLength:   uint32(len(header)),
+		})
+		buffer.Write(header)
+		buffer.Write(make([]byte, headerPadding))
+
+		samples = append(samples, buffer.Bytes())
+	}
+
+	return samples
+}
+
+// Counter samples for every interface that has seen traffic
+func (e *SflowExporter) counterSamples() [][]byte {
+	var ifIndexes []int
+	for ifIndex := range e.interfaces {
+		ifIndexes = append(ifIndexes, int(ifIndex))
+	}
+	sort.Ints(ifIndexes)
+
+	var samples [][]byte
+
+	for _, ifIndex := range ifIndexes {
+		state := e.interfaces[uint32(ifIndex)]
+		state.CounterSequence++
+
+		buffer := new(bytes.Buffer)
+
+		// Counter sample header + counter record header + generic counters
+		binary.Write(buffer, binary.BigEndian, uint32(SFLOW_COUNTER_SAMPLE))
+		binary.Write(buffer, binary.BigEndian, uint32(12+8+88))
+		binary.Write(buffer, binary.BigEndian, SflowCounterSampleHeader{
+			SequenceNumber: state.CounterSequence,
+			SourceId:       uint32(ifIndex),
+			NumRecords:     1,
+		})
+		binary.Write(buffer, binary.BigEndian, uint32(SFLOW_GENERIC_COUNTERS))
+		binary.Write(buffer, binary.BigEndian, uint32(88))
+		binary.Write(buffer, binary.BigEndian, state.Counters)
+
+		samples = append(samples, buffer.Bytes())
+	}
+
+	return samples
+}
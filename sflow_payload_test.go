@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSflowRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		record    FlowRecord
+		wantCount int
+		wantBytes int
+	}{
+		{"sampled packets", testFlowRecord("10.1.0.1", "10.2.0.1", 40000, 443, PROTO_TCP, 10, 15000), 2, 15000},
+		{"below the sampling rate", testFlowRecord("fd00::1", "fd00::2", 53000, 53, PROTO_UDP, 1, 80), 1, 400},
+		{"capped samples", testFlowRecord("10.1.0.2", "10.2.0.1", 40000, 80, PROTO_TCP, 1000000, 1500000000), SFLOW_MAX_SAMPLES_PER_RECORD, 1500000000},
+		{"no ports", testFlowRecord("10.1.0.3", "10.2.0.1", 0, 0, 1, 5, 420), 1, 420},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := NewSflowExporter(testClock(), "10.0.0.3", 5, 5, 20*time.Second)
+
+			collector := collectPackets(t, exporter.BuildPackets([]FlowRecord{test.record}))
+			state := collectedExporter(t, collector, 5)
+
+			key := CollectorFlowKey{
+				SrcAddr: test.record.SrcAddrString(),
+				SrcPort: test.record.SrcPort,
+				DstAddr: test.record.DstAddrString(),
+				DstPort: test.record.DstPort,
+				Proto:   int(test.record.IpProtocol),
+			}
+
+			total, ok := state.Flows[key]
+
+			if !ok || len(state.Flows) != 1 {
+				t.Fatalf("got flows %v, want only %+v", state.Flows, key)
+			}
+
+			if total.Count != test.wantCount || total.Bytes != test.wantBytes {
+				t.Errorf("got %d samples %d bytes, want %d samples %d bytes", total.Count, total.Bytes, test.wantCount, test.wantBytes)
+			}
+		})
+	}
+}
+
+func TestSflowDatagramSplit(t *testing.T) {
+	exporter := NewSflowExporter(testClock(), "10.0.0.3", 1, 1, 20*time.Second)
+
+	var records []FlowRecord
+
+	for i := 0; i < 30; i++ {
+		records = append(records, testFlowRecord("10.1.0.1", "10.2.0.1", 40000, uint16(i), PROTO_TCP, 2, 3000))
+	}
+
+	packets := exporter.BuildPackets(records)
+
+	if len(packets) < 2 {
+		t.Fatalf("got %d datagrams, want the samples split", len(packets))
+	}
+
+	for i, packet := range packets {
+		if len(packet) > SFLOW_MAX_DATAGRAM_LEN {
+			t.Errorf("datagram %d: got %d bytes, want at most %d", i, len(packet), SFLOW_MAX_DATAGRAM_LEN)
+		}
+	}
+
+	// The sequence number counts datagrams, a lost datagram is one gap
+	collector := collectPackets(t, append(packets[:1:1], packets[2:]...))
+	state := collectedExporter(t, collector, 1)
+
+	if state.LostRecords != 1 || state.OutOfOrder != 0 {
+		t.Errorf("got %d lost %d out of order datagrams, want 1 lost", state.LostRecords, state.OutOfOrder)
+	}
+
+	collector = collectPackets(t, packets)
+	state = collectedExporter(t, collector, 1)
+
+	if state.Records != 60 || len(state.Flows) != 30 {
+		t.Errorf("got %d samples of %d flows, want 60 samples of 30 flows", state.Records, len(state.Flows))
+	}
+}
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SNMP_VERSION_2C = 1
+
+	// Cap of the repetitions of a GETBULK request, so responses fit a datagram
+	SNMP_MAX_REPETITIONS = 64
+	SNMP_SYS_DESCR       = "manflow simulated flow exporter"
+
+	SNMP_IF_STATUS_UP = 1
+)
+
+// BER tags used by SNMP
+const (
+	BER_INTEGER      = 0x02
+	BER_OCTET_STRING = 0x04
+	BER_NULL         = 0x05
+	BER_OID          = 0x06
+	BER_SEQUENCE     = 0x30
+	BER_COUNTER32    = 0x41
+	BER_GAUGE32      = 0x42
+	BER_TIMETICKS    = 0x43
+
+	BER_NO_SUCH_OBJECT   = 0x80
+	BER_NO_SUCH_INSTANCE = 0x81
+	BER_END_OF_MIB_VIEW  = 0x82
+
+	SNMP_PDU_GET      = 0xa0
+	SNMP_PDU_GETNEXT  = 0xa1
+	SNMP_PDU_RESPONSE = 0xa2
+	SNMP_PDU_GETBULK  = 0xa5
+)
+
+// Columns of ifEntry and ifXEntry
+const (
+	SNMP_IF_INDEX        = 1
+	SNMP_IF_DESCR        = 2
+	SNMP_IF_TYPE         = 3
+	SNMP_IF_SPEED        = 5
+	SNMP_IF_ADMIN_STATUS = 7
+	SNMP_IF_OPER_STATUS  = 8
+
+	SNMP_IF_NAME       = 1
+	SNMP_IF_HIGH_SPEED = 15
+	SNMP_IF_ALIAS      = 18
+)
+
+var (
+	SNMP_OID_SYS_DESCR  = []uint32{1, 3, 6, 1, 2, 1, 1, 1, 0}
+	SNMP_OID_SYS_UPTIME = []uint32{1, 3, 6, 1, 2, 1, 1, 3, 0}
+	SNMP_OID_SYS_NAME   = []uint32{1, 3, 6, 1, 2, 1, 1, 5, 0}
+	SNMP_OID_IF_NUMBER  = []uint32{1, 3, 6, 1, 2, 1, 2, 1, 0}
+	SNMP_OID_IF_ENTRY   = []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1}
+	SNMP_OID_IF_X_ENTRY = []uint32{1, 3, 6, 1, 2, 1, 31, 1, 1, 1}
+)
+
+type SnmpValue struct {
+	Tag   byte
+	Int   int64
+	Bytes []byte
+}
+
+type SnmpVarBind struct {
+	Oid   []uint32
+	Value SnmpValue
+}
+
+type SnmpPdu struct {
+	Type        byte
+	RequestId   int64
+	ErrorStatus int64
+	ErrorIndex  int64
+	VarBinds    []SnmpVarBind
+}
+
+// Column of an interface table and its value for an interface
+type snmpColumn struct {
+	column uint32
+	value  func(iface ConfigInterface) SnmpValue
+}
+
+type SnmpMessage struct {
+	Version   int64
+	Community string
+	Pdu       SnmpPdu
+}
+
+// Host answered by the agent, the uptime follows the clock of the host
+type SnmpHost struct {
+	Host  ConfigHost
+	Clock *HostClock
+}
+
+// SNMPv2c agent answering for the interfaces of the simulated hosts, a
+// host other than the first is selected with the community "<community>@<host>"
+type SnmpAgent struct {
+	Conn      *net.UDPConn
+	Community string
+	Hosts     []SnmpHost
+}
+
+func NewSnmpAgent(listenAddr string, community string, hosts []SnmpHost) (*SnmpAgent, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve udp addr %s: %v", listenAddr, err)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on udp addr %s: %v", listenAddr, err)
+	}
+
+	return &SnmpAgent{
+		Conn:      conn,
+		Community: community,
+		Hosts:     hosts,
+	}, nil
+}
+
+func (a *SnmpAgent) Serve() {
+	buffer := make([]byte, 65535)
+
+	for {
+		n, addr, err := a.Conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			if !opts.DisableLogging {
+				fmt.Printf("failed to read snmp request: %v\n", err)
+			}
+			return
+		}
+
+		response, err := a.HandleRequest(buffer[:n])
+
+		if err != nil {
+			if !opts.DisableLogging {
+				fmt.Printf("failed to handle snmp request from %s: %v\n", addr, err)
+			}
+			continue
+		}
+
+		_, err = a.Conn.WriteToUDP(response, addr)
+
+		if err != nil && !opts.DisableLogging {
+			fmt.Printf("failed to send snmp response to %s: %v\n", addr, err)
+		}
+	}
+}
+
+// Host selected by the community of a request
+func (a *SnmpAgent) findHost(community string) (SnmpHost, error) {
+	hostName := ""
+	if i := strings.LastIndex(community, "@"); i != -1 {
+		community, hostName = community[:i], community[i+1:]
+	}
+
+	if community != a.Community {
+		return SnmpHost{}, fmt.Errorf("invalid community %s", community)
+	}
+
+	if hostName == "" {
+		return a.Hosts[0], nil
+	}
+
+	for _, host := range a.Hosts {
+		if host.Host.Name == hostName {
+			return host, nil
+		}
+	}
+
+	return SnmpHost{}, fmt.Errorf("host %s not simulated by this process", hostName)
+}
+
+func (a *SnmpAgent) HandleRequest(packet []byte) ([]byte, error) {
+	request, err := DecodeSnmpMessage(packet)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Version != SNMP_VERSION_2C {
+		return nil, fmt.Errorf("unsupported snmp version %d", request.Version)
+	}
+
+	host, err := a.findHost(request.Community)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mib := BuildSnmpMib(host)
+
+	response := SnmpMessage{
+		Version:   request.Version,
+		Community: request.Community,
+		Pdu: SnmpPdu{
+			Type:      SNMP_PDU_RESPONSE,
+			RequestId: request.Pdu.RequestId,
+		},
+	}
+
+	varBinds := request.Pdu.VarBinds
+
+	switch request.Pdu.Type {
+	case SNMP_PDU_GET:
+		for _, varBind := range varBinds {
+			response.Pdu.VarBinds = append(response.Pdu.VarBinds, mibGet(mib, varBind.Oid))
+		}
+	case SNMP_PDU_GETNEXT:
+		for _, varBind := range varBinds {
+			response.Pdu.VarBinds = append(response.Pdu.VarBinds, mibGetNext(mib, varBind.Oid))
+		}
+	case SNMP_PDU_GETBULK:
+		// Error status and index carry non-repeaters and max-repetitions
+		nonRepeaters := int(request.Pdu.ErrorStatus)
+		if nonRepeaters < 0 {
+			nonRepeaters = 0
+		} else if nonRepeaters > len(varBinds) {
+			nonRepeaters = len(varBinds)
+		}
+
+		maxRepetitions := int(request.Pdu.ErrorIndex)
+		if maxRepetitions > SNMP_MAX_REPETITIONS {
+			maxRepetitions = SNMP_MAX_REPETITIONS
+		}
+
+		for _, varBind := range varBinds[:nonRepeaters] {
+			response.Pdu.VarBinds = append(response.Pdu.VarBinds, mibGetNext(mib, varBind.Oid))
+		}
+
+		repeaters := varBinds[nonRepeaters:]
+		for r := 0; r < maxRepetitions && len(repeaters) > 0; r++ {
+			next := make([]SnmpVarBind, len(repeaters))
+			done := true
+
+			for i, varBind := range repeaters {
+				next[i] = mibGetNext(mib, varBind.Oid)
+				done = done && next[i].Value.Tag == BER_END_OF_MIB_VIEW
+			}
+
+			response.Pdu.VarBinds = append(response.Pdu.VarBinds, next...)
+			repeaters = next
+
+			if done {
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported snmp pdu type 0x%x", request.Pdu.Type)
+	}
+
+	return EncodeSnmpMessage(response), nil
+}
+
+// Interfaces reported for a host, hosts without interfaces report the two
+// interfaces of the legacy 1 / 2 indexes
+func SnmpInterfaces(host ConfigHost) []ConfigInterface {
+	interfaces := host.Interfaces
+
+	if len(interfaces) == 0 {
+		interfaces = []ConfigInterface{{Index: 1}, {Index: 2}}
+	}
+
+	sorted := make([]ConfigInterface, len(interfaces))
+	copy(sorted, interfaces)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Index < sorted[j].Index
+	})
+
+	for i := range sorted {
+		if sorted[i].Name == "" {
+			sorted[i].Name = fmt.Sprintf("if%d", sorted[i].Index)
+		}
+
+		// Same default speed as the sflow counter samples
+		if sorted[i].Speed == 0 {
+			sorted[i].Speed = SFLOW_DEFAULT_IF_SPEED_BPS
+		}
+	}
+
+	return sorted
+}
+
+// System group, ifTable and ifXTable of a host, sorted by oid
+func BuildSnmpMib(host SnmpHost) []SnmpVarBind {
+	interfaces := SnmpInterfaces(host.Host)
+
+	// The uptime follows the simulated time of the host in backfill mode
+	uptimeMillis := (host.Clock.Now()-host.Clock.StartTime)/int64(time.Millisecond) + 1000
+
+	mib := []SnmpVarBind{
+		{SNMP_OID_SYS_DESCR, snmpString(SNMP_SYS_DESCR)},
+		{SNMP_OID_SYS_UPTIME, SnmpValue{Tag: BER_TIMETICKS, Int: uptimeMillis / 10 % (math.MaxUint32 + 1)}},
+		{SNMP_OID_SYS_NAME, snmpString(host.Host.Name)},
+		{SNMP_OID_IF_NUMBER, SnmpValue{Tag: BER_INTEGER, Int: int64(len(interfaces))}},
+	}
+
+	ifColumns := []snmpColumn{
+		{SNMP_IF_INDEX, func(iface ConfigInterface) SnmpValue {
+			return SnmpValue{Tag: BER_INTEGER, Int: int64(iface.Index)}
+		}},
+		{SNMP_IF_DESCR, func(iface ConfigInterface) SnmpValue { return snmpString(iface.Name) }},
+		{SNMP_IF_TYPE, func(iface ConfigInterface) SnmpValue {
+			return SnmpValue{Tag: BER_INTEGER, Int: SFLOW_IF_TYPE_ETHERNET}
+		}},
+		{SNMP_IF_SPEED, func(iface ConfigInterface) SnmpValue {
+			// ifSpeed saturates, faster interfaces are reported by ifHighSpeed
+			speed := int64(math.MaxUint32)
+			if iface.Speed < math.MaxUint32 {
+				speed = int64(iface.Speed)
+			}
+			return SnmpValue{Tag: BER_GAUGE32, Int: speed}
+		}},
+		{SNMP_IF_ADMIN_STATUS, func(iface ConfigInterface) SnmpValue {
+			return SnmpValue{Tag: BER_INTEGER, Int: SNMP_IF_STATUS_UP}
+		}},
+		{SNMP_IF_OPER_STATUS, func(iface ConfigInterface) SnmpValue {
+			return SnmpValue{Tag: BER_INTEGER, Int: SNMP_IF_STATUS_UP}
+		}},
+	}
+
+	ifXColumns := []snmpColumn{
+		{SNMP_IF_NAME, func(iface ConfigInterface) SnmpValue { return snmpString(iface.Name) }},
+		{SNMP_IF_HIGH_SPEED, func(iface ConfigInterface) SnmpValue {
+			return SnmpValue{Tag: BER_GAUGE32, Int: int64(iface.Speed / 1000000)}
+		}},
+		{SNMP_IF_ALIAS, func(iface ConfigInterface) SnmpValue { return snmpString(iface.Peer) }},
+	}
+
+	tables := []struct {
+		entry   []uint32
+		columns []snmpColumn
+	}{
+		{SNMP_OID_IF_ENTRY, ifColumns},
+		{SNMP_OID_IF_X_ENTRY, ifXColumns},
+	}
+
+	for _, table := range tables {
+		for _, column := range table.columns {
+			for _, iface := range interfaces {
+				mib = append(mib, SnmpVarBind{
+					Oid:   snmpOid(table.entry, column.column, iface.Index),
+					Value: column.value(iface),
+				})
+			}
+		}
+	}
+
+	sort.Slice(mib, func(i, j int) bool {
+		return CompareOids(mib[i].Oid, mib[j].Oid) < 0
+	})
+
+	return mib
+}
+
+func snmpString(value string) SnmpValue {
+	return SnmpValue{Tag: BER_OCTET_STRING, Bytes: []byte(value)}
+}
+
+func snmpOid(prefix []uint32, subIds ...uint32) []uint32 {
+	oid := make([]uint32, 0, len(prefix)+len(subIds))
+	oid = append(oid, prefix...)
+	return append(oid, subIds...)
+}
+
+func CompareOids(a []uint32, b []uint32) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+func mibGet(mib []SnmpVarBind, oid []uint32) SnmpVarBind {
+	for _, entry := range mib {
+		if CompareOids(entry.Oid, oid) == 0 {
+			return entry
+		}
+	}
+
+	// Objects that exist with other instances are missing an instance
+	tag := byte(BER_NO_SUCH_OBJECT)
+	if len(oid) > 0 {
+		for _, entry := range mib {
+			if len(entry.Oid) == len(oid) && CompareOids(entry.Oid[:len(oid)-1], oid[:len(oid)-1]) == 0 {
+				tag = BER_NO_SUCH_INSTANCE
+				break
+			}
+		}
+	}
+
+	return SnmpVarBind{Oid: oid, Value: SnmpValue{Tag: tag}}
+}
+
+func mibGetNext(mib []SnmpVarBind, oid []uint32) SnmpVarBind {
+	for _, entry := range mib {
+		if CompareOids(entry.Oid, oid) > 0 {
+			return entry
+		}
+	}
+
+	return SnmpVarBind{Oid: oid, Value: SnmpValue{Tag: BER_END_OF_MIB_VIEW}}
+}
+
+// Read a BER tag, length and value, returning the rest of the input
+func readBer(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errors.New("truncated ber element")
+	}
+
+	tag := data[0]
+	length := int(data[1])
+	offset := 2
+
+	// Long form, the low bits are the number of length bytes
+	if length&0x80 != 0 {
+		numBytes := length & 0x7f
+
+		if numBytes == 0 || numBytes > 4 || len(data) < offset+numBytes {
+			return 0, nil, nil, errors.New("invalid ber length")
+		}
+
+		length = 0
+		for _, b := range data[offset : offset+numBytes] {
+			length = length<<8 | int(b)
+		}
+		offset += numBytes
+	}
+
+	if length < 0 || len(data) < offset+length {
+		return 0, nil, nil, errors.New("truncated ber element")
+	}
+
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+func readBerExpect(data []byte, expected byte) ([]byte, []byte, error) {
+	tag, value, rest, err := readBer(data)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tag != expected {
+		return nil, nil, fmt.Errorf("unexpected ber tag 0x%x, expected 0x%x", tag, expected)
+	}
+
+	return value, rest, nil
+}
+
+func readBerInteger(data []byte) (int64, []byte, error) {
+	value, rest, err := readBerExpect(data, BER_INTEGER)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, err := decodeBerInteger(value)
+
+	return n, rest, err
+}
+
+func decodeBerInteger(value []byte) (int64, error) {
+	if len(value) == 0 || len(value) > 8 {
+		return 0, fmt.Errorf("invalid ber integer length %d", len(value))
+	}
+
+	// Sign extend from the first byte
+	n := int64(int8(value[0]))
+	for _, b := range value[1:] {
+		n = n<<8 | int64(b)
+	}
+
+	return n, nil
+}
+
+// The first subidentifier combines the first two arcs as 40 * X + Y, only
+// arc 2 can have a second arc of 40 or more
+func decodeOid(value []byte) ([]uint32, error) {
+	if len(value) == 0 {
+		return nil, errors.New("empty oid")
+	}
+
+	var subIds []uint32
+
+	subId := uint64(0)
+	for i, b := range value {
+		subId = subId<<7 | uint64(b&0x7f)
+
+		if subId > math.MaxUint32 {
+			return nil, errors.New("oid subidentifier too large")
+		}
+
+		if b&0x80 == 0 {
+			subIds = append(subIds, uint32(subId))
+			subId = 0
+		} else if i == len(value)-1 {
+			return nil, errors.New("truncated oid")
+		}
+	}
+
+	first := subIds[0]
+	oid := []uint32{2, first - 80}
+
+	if first < 80 {
+		oid = []uint32{first / 40, first % 40}
+	}
+
+	return append(oid, subIds[1:]...), nil
+}
+
+// Value of a varbind, unsigned application types are read as integers
+func decodeSnmpValue(data []byte) (SnmpValue, error) {
+	tag, value, _, err := readBer(data)
+
+	if err != nil {
+		return SnmpValue{}, err
+	}
+
+	switch tag {
+	case BER_INTEGER, BER_COUNTER32, BER_GAUGE32, BER_TIMETICKS:
+		n, err := decodeBerInteger(value)
+
+		return SnmpValue{Tag: tag, Int: n}, err
+	case BER_OCTET_STRING:
+		return SnmpValue{Tag: tag, Bytes: value}, nil
+	}
+
+	return SnmpValue{Tag: tag}, nil
+}
+
+func DecodeSnmpMessage(packet []byte) (SnmpMessage, error) {
+	var message SnmpMessage
+
+	body, _, err := readBerExpect(packet, BER_SEQUENCE)
+
+	if err != nil {
+		return message, fmt.Errorf("failed to decode snmp message: %v", err)
+	}
+
+	message.Version, body, err = readBerInteger(body)
+
+	if err != nil {
+		return message, fmt.Errorf("failed to decode snmp version: %v", err)
+	}
+
+	community, body, err := readBerExpect(body, BER_OCTET_STRING)
+
+	if err != nil {
+		return message, fmt.Errorf("failed to decode snmp community: %v", err)
+	}
+
+	message.Community = string(community)
+
+	pduType, pdu, _, err := readBer(body)
+
+	if err != nil {
+		return message, fmt.Errorf("failed to decode snmp pdu: %v", err)
+	}
+
+	message.Pdu.Type = pduType
+
+	for _, field := range []*int64{&message.Pdu.RequestId, &message.Pdu.ErrorStatus, &message.Pdu.ErrorIndex} {
+		*field, pdu, err = readBerInteger(pdu)
+
+		if err != nil {
+			return message, fmt.Errorf("failed to decode snmp pdu header: %v", err)
+		}
+	}
+
+	varBinds, _, err := readBerExpect(pdu, BER_SEQUENCE)
+
+	if err != nil {
+		return message, fmt.Errorf("failed to decode snmp varbinds: %v", err)
+	}
+
+	for len(varBinds) > 0 {
+		var varBind []byte
+
+		varBind, varBinds, err = readBerExpect(varBinds, BER_SEQUENCE)
+
+		if err != nil {
+			return message, fmt.Errorf("failed to decode snmp varbind: %v", err)
+		}
+
+		oidBytes, valueBytes, err := readBerExpect(varBind, BER_OID)
+
+		if err != nil {
+			return message, fmt.Errorf("failed to decode snmp varbind oid: %v", err)
+		}
+
+		oid, err := decodeOid(oidBytes)
+
+		if err != nil {
+			return message, fmt.Errorf("failed to decode snmp varbind oid: %v", err)
+		}
+
+		// The values of requests are null and ignored by the agent
+		value, err := decodeSnmpValue(valueBytes)
+
+		if err != nil {
+			return message, fmt.Errorf("failed to decode snmp varbind value: %v", err)
+		}
+
+		message.Pdu.VarBinds = append(message.Pdu.VarBinds, SnmpVarBind{Oid: oid, Value: value})
+	}
+
+	return message, nil
+}
+
+func writeBer(buf *bytes.Buffer, tag byte, value []byte) {
+	buf.WriteByte(tag)
+
+	length := len(value)
+
+	if length < 0x80 {
+		buf.WriteByte(byte(length))
+	} else {
+		var lengthBytes []byte
+		for ; length > 0; length >>= 8 {
+			lengthBytes = append([]byte{byte(length)}, lengthBytes...)
+		}
+		buf.WriteByte(0x80 | byte(len(lengthBytes)))
+		buf.Write(lengthBytes)
+	}
+
+	buf.Write(value)
+}
+
+// Minimal two's complement encoding, unsigned application types are
+// encoded the same way so values with the high bit set get a leading zero
+func encodeBerInteger(n int64) []byte {
+	var value []byte
+
+	for {
+		value = append([]byte{byte(n)}, value...)
+		n >>= 8
+
+		if (n == 0 && value[0]&0x80 == 0) || (n == -1 && value[0]&0x80 != 0) {
+			return value
+		}
+	}
+}
+
+func encodeOid(oid []uint32) []byte {
+	var buf bytes.Buffer
+
+	if len(oid) < 2 {
+		buf.WriteByte(0)
+		return buf.Bytes()
+	}
+
+	subIds := append([]uint32{oid[0]*40 + oid[1]}, oid[2:]...)
+
+	for _, subId := range subIds {
+		var subIdBytes []byte
+		for {
+			subIdBytes = append([]byte{byte(subId & 0x7f)}, subIdBytes...)
+			subId >>= 7
+
+			if subId == 0 {
+				break
+			}
+		}
+
+		for i := 0; i < len(subIdBytes)-1; i++ {
+			subIdBytes[i] |= 0x80
+		}
+
+		buf.Write(subIdBytes)
+	}
+
+	return buf.Bytes()
+}
+
+func encodeSnmpValue(buf *bytes.Buffer, value SnmpValue) {
+	switch value.Tag {
+	case BER_INTEGER, BER_COUNTER32, BER_GAUGE32, BER_TIMETICKS:
+		writeBer(buf, value.Tag, encodeBerInteger(value.Int))
+	case BER_OCTET_STRING:
+		writeBer(buf, value.Tag, value.Bytes)
+	default:
+		writeBer(buf, value.Tag, nil)
+	}
+}
+
+func EncodeSnmpMessage(message SnmpMessage) []byte {
+	var varBinds bytes.Buffer
+
+	for _, varBind := range message.Pdu.VarBinds {
+		var entry bytes.Buffer
+		writeBer(&entry, BER_OID, encodeOid(varBind.Oid))
+		encodeSnmpValue(&entry, varBind.Value)
+
+		writeBer(&varBinds, BER_SEQUENCE, entry.Bytes())
+	}
+
+	var pdu bytes.Buffer
+	writeBer(&pdu, BER_INTEGER, encodeBerInteger(message.Pdu.RequestId))
+	writeBer(&pdu, BER_INTEGER, encodeBerInteger(message.Pdu.ErrorStatus))
+	writeBer(&pdu, BER_INTEGER, encodeBerInteger(message.Pdu.ErrorIndex))
+	writeBer(&pdu, BER_SEQUENCE, varBinds.Bytes())
+
+	var body bytes.Buffer
+	writeBer(&body, BER_INTEGER, encodeBerInteger(message.Version))
+	writeBer(&body, BER_OCTET_STRING, []byte(message.Community))
+	writeBer(&body, message.Pdu.Type, pdu.Bytes())
+
+	var buf bytes.Buffer
+	writeBer(&buf, BER_SEQUENCE, body.Bytes())
+
+	return buf.Bytes()
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeOid(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   []byte
+		want    []uint32
+		wantErr bool
+	}{
+		{"iso org", []byte{0x2b}, []uint32{1, 3}, false},
+		{"multi byte subid", []byte{0x2b, 0x86, 0x48}, []uint32{1, 3, 840}, false},
+		{"arc 2", []byte{0x50}, []uint32{2, 0}, false},
+		{"arc 2 second arc of 40", []byte{0x78}, []uint32{2, 40}, false},
+		{"multi byte first subid", []byte{0x88, 0x37, 0x03}, []uint32{2, 999, 3}, false},
+		{"largest subid", []byte{0x2b, 0x8f, 0xff, 0xff, 0xff, 0x7f}, []uint32{1, 3, 4294967295}, false},
+		{"subid too large", []byte{0x2b, 0x90, 0x80, 0x80, 0x80, 0x00}, nil, true},
+		{"truncated", []byte{0x2b, 0x86}, nil, true},
+		{"empty", nil, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oid, err := decodeOid(test.value)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+
+			if !test.wantErr && !reflect.DeepEqual(oid, test.want) {
+				t.Errorf("got oid %v, want %v", oid, test.want)
+			}
+
+			if !test.wantErr && !reflect.DeepEqual(encodeOid(oid), test.value) {
+				t.Errorf("got encoding %x, want %x", encodeOid(oid), test.value)
+			}
+		})
+	}
+}
+
+func TestSnmpMessageRoundTrip(t *testing.T) {
+	var manyVarBinds []SnmpVarBind
+	for i := uint32(1); i <= 20; i++ {
+		manyVarBinds = append(manyVarBinds, SnmpVarBind{Oid: snmpOid(SNMP_OID_IF_ENTRY, SNMP_IF_DESCR, i), Value: SnmpValue{Tag: BER_NULL}})
+	}
+
+	tests := []struct {
+		name    string
+		message SnmpMessage
+	}{
+		{"get request", SnmpMessage{SNMP_VERSION_2C, "public", SnmpPdu{
+			Type:      SNMP_PDU_GET,
+			RequestId: 1,
+			VarBinds:  []SnmpVarBind{{Oid: SNMP_OID_SYS_NAME, Value: SnmpValue{Tag: BER_NULL}}},
+		}}},
+		{"negative request id", SnmpMessage{SNMP_VERSION_2C, "public", SnmpPdu{
+			Type:      SNMP_PDU_GETNEXT,
+			RequestId: -1234567,
+			VarBinds:  []SnmpVarBind{{Oid: SNMP_OID_SYS_DESCR, Value: SnmpValue{Tag: BER_NULL}}},
+		}}},
+		{"large subids", SnmpMessage{SNMP_VERSION_2C, "public", SnmpPdu{
+			Type:      SNMP_PDU_GET,
+			RequestId: 2147483647,
+			VarBinds: []SnmpVarBind{
+				{Oid: []uint32{1, 3, 6, 1, 4, 1, 4294967295, 128}, Value: SnmpValue{Tag: BER_NULL}},
+				{Oid: []uint32{2, 999, 16384}, Value: SnmpValue{Tag: BER_NULL}},
+			},
+		}}},
+		{"long form lengths", SnmpMessage{SNMP_VERSION_2C, strings.Repeat("c", 200), SnmpPdu{
+			Type:        SNMP_PDU_GETBULK,
+			RequestId:   7,
+			ErrorStatus: 1,
+			ErrorIndex:  10,
+			VarBinds:    manyVarBinds,
+		}}},
+		{"response values", SnmpMessage{SNMP_VERSION_2C, "public", SnmpPdu{
+			Type:      SNMP_PDU_RESPONSE,
+			RequestId: 3,
+			VarBinds: []SnmpVarBind{
+				{Oid: SNMP_OID_SYS_DESCR, Value: snmpString(strings.Repeat("d", 300))},
+				{Oid: SNMP_OID_SYS_UPTIME, Value: SnmpValue{Tag: BER_TIMETICKS, Int: 4294967295}},
+				{Oid: SNMP_OID_IF_NUMBER, Value: SnmpValue{Tag: BER_INTEGER, Int: -1}},
+				{Oid: snmpOid(SNMP_OID_IF_ENTRY, SNMP_IF_SPEED, 1), Value: SnmpValue{Tag: BER_GAUGE32, Int: 2147483648}},
+				{Oid: snmpOid(SNMP_OID_IF_ENTRY, SNMP_IF_DESCR, 9), Value: SnmpValue{Tag: BER_NO_SUCH_INSTANCE}},
+				{Oid: []uint32{1, 3, 6, 1, 2, 1, 99}, Value: SnmpValue{Tag: BER_END_OF_MIB_VIEW}},
+			},
+		}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := DecodeSnmpMessage(EncodeSnmpMessage(test.message))
+
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if !reflect.DeepEqual(message, test.message) {
+				t.Errorf("got %+v, want %+v", message, test.message)
+			}
+		})
+	}
+}
+
+func TestDecodeSnmpMessageMalformed(t *testing.T) {
+	packet := EncodeSnmpMessage(SnmpMessage{SNMP_VERSION_2C, "public", SnmpPdu{
+		Type:     SNMP_PDU_GET,
+		VarBinds: []SnmpVarBind{{Oid: SNMP_OID_SYS_NAME, Value: SnmpValue{Tag: BER_NULL}}},
+	}})
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"truncated", packet[:len(packet)-3]},
+		{"not a sequence", append([]byte{BER_INTEGER}, packet[1:]...)},
+		{"length too long", []byte{BER_SEQUENCE, 0x85, 1, 2, 3, 4, 5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeSnmpMessage(test.packet)
+
+			if err == nil {
+				t.Errorf("got no error, want an error")
+			}
+		})
+	}
+}
+
+func testSnmpAgent() *SnmpAgent {
+	clock := NewHostClock(0)
+
+	return &SnmpAgent{
+		Community: "public",
+		Hosts: []SnmpHost{
+			{Host: ConfigHost{Name: "gw1"}, Clock: clock},
+			{Host: ConfigHost{Name: "gw2", Interfaces: []ConfigInterface{{Index: 3, Name: "eth3"}}}, Clock: clock},
+		},
+	}
+}
+
+// Send a request to the agent and decode its response
+func snmpRequest(t *testing.T, agent *SnmpAgent, community string, pdu SnmpPdu) SnmpPdu {
+	t.Helper()
+
+	for i := range pdu.VarBinds {
+		pdu.VarBinds[i].Value = SnmpValue{Tag: BER_NULL}
+	}
+
+	packet, err := agent.HandleRequest(EncodeSnmpMessage(SnmpMessage{SNMP_VERSION_2C, community, pdu}))
+
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	response, err := DecodeSnmpMessage(packet)
+
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if response.Pdu.Type != SNMP_PDU_RESPONSE || response.Pdu.RequestId != pdu.RequestId {
+		t.Fatalf("got pdu type 0x%x request id %d, want a response to %d", response.Pdu.Type, response.Pdu.RequestId, pdu.RequestId)
+	}
+
+	return response.Pdu
+}
+
+func TestSnmpAgentGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		oid     []uint32
+		wantTag byte
+	}{
+		{"sysName", SNMP_OID_SYS_NAME, BER_OCTET_STRING},
+		{"ifDescr", snmpOid(SNMP_OID_IF_ENTRY, SNMP_IF_DESCR, 2), BER_OCTET_STRING},
+		{"missing interface", snmpOid(SNMP_OID_IF_ENTRY, SNMP_IF_DESCR, 9), BER_NO_SUCH_INSTANCE},
+		{"missing sysName instance", []uint32{1, 3, 6, 1, 2, 1, 1, 5, 1}, BER_NO_SUCH_INSTANCE},
+		{"unknown object", []uint32{1, 3, 6, 1, 2, 1, 99, 0}, BER_NO_SUCH_OBJECT},
+		{"unknown column", snmpOid(SNMP_OID_IF_ENTRY, 4, 1), BER_NO_SUCH_OBJECT},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pdu := snmpRequest(t, testSnmpAgent(), "public", SnmpPdu{
+				Type:      SNMP_PDU_GET,
+				RequestId: 42,
+				VarBinds:  []SnmpVarBind{{Oid: test.oid}},
+			})
+
+			if len(pdu.VarBinds) != 1 || !reflect.DeepEqual(pdu.VarBinds[0].Oid, test.oid) || pdu.VarBinds[0].Value.Tag != test.wantTag {
+				t.Errorf("got %+v, want %v with tag 0x%x", pdu.VarBinds, test.oid, test.wantTag)
+			}
+		})
+	}
+}
+
+func TestSnmpAgentWalk(t *testing.T) {
+	agent := testSnmpAgent()
+	mib := BuildSnmpMib(agent.Hosts[0])
+
+	var walked [][]uint32
+
+	oid := []uint32{1, 3, 6, 1, 2, 1}
+
+	for len(walked) <= len(mib) {
+		pdu := snmpRequest(t, agent, "public", SnmpPdu{
+			Type:      SNMP_PDU_GETNEXT,
+			RequestId: int64(len(walked)),
+			VarBinds:  []SnmpVarBind{{Oid: oid}},
+		})
+
+		varBind := pdu.VarBinds[0]
+
+		if varBind.Value.Tag == BER_END_OF_MIB_VIEW {
+			if !reflect.DeepEqual(varBind.Oid, oid) {
+				t.Errorf("got end of mib view at %v, want it at %v", varBind.Oid, oid)
+			}
+			break
+		}
+
+		if CompareOids(varBind.Oid, oid) <= 0 {
+			t.Fatalf("got oid %v after %v, want increasing oids", varBind.Oid, oid)
+		}
+
+		oid = varBind.Oid
+		walked = append(walked, oid)
+	}
+
+	if len(walked) != len(mib) {
+		t.Errorf("got %d oids, want the %d oids of the mib", len(walked), len(mib))
+	}
+}
+
+func TestSnmpAgentGetBulk(t *testing.T) {
+	sysDescr := []uint32{1, 3, 6, 1, 2, 1, 1, 1}
+	ifDescr := snmpOid(SNMP_OID_IF_ENTRY, SNMP_IF_DESCR)
+	ifAlias := snmpOid(SNMP_OID_IF_X_ENTRY, SNMP_IF_ALIAS)
+
+	tests := []struct {
+		name           string
+		nonRepeaters   int64
+		maxRepetitions int64
+		oids           [][]uint32
+		want           [][]uint32
+	}{
+		{
+			"non repeater and repetitions",
+			1, 3,
+			[][]uint32{sysDescr, ifDescr},
+			[][]uint32{
+				SNMP_OID_SYS_DESCR,
+				snmpOid(ifDescr, 1),
+				snmpOid(ifDescr, 2),
+				snmpOid(SNMP_OID_IF_ENTRY, SNMP_IF_TYPE, 1),
+			},
+		},
+		{
+			"repetitions of two varbinds",
+			0, 2,
+			[][]uint32{sysDescr, ifDescr},
+			[][]uint32{
+				SNMP_OID_SYS_DESCR, snmpOid(ifDescr, 1),
+				SNMP_OID_SYS_UPTIME, snmpOid(ifDescr, 2),
+			},
+		},
+		{
+			"non repeaters above the varbinds",
+			5, 3,
+			[][]uint32{sysDescr},
+			[][]uint32{SNMP_OID_SYS_DESCR},
+		},
+		{
+			"no repetitions",
+			0, 0,
+			[][]uint32{sysDescr},
+			nil,
+		},
+		{
+			"stops at the end of the mib",
+			0, 10,
+			[][]uint32{ifAlias},
+			[][]uint32{snmpOid(ifAlias, 1), snmpOid(ifAlias, 2), snmpOid(ifAlias, 2)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var varBinds []SnmpVarBind
+			for _, oid := range test.oids {
+				varBinds = append(varBinds, SnmpVarBind{Oid: oid})
+			}
+
+			pdu := snmpRequest(t, testSnmpAgent(), "public", SnmpPdu{
+				Type:        SNMP_PDU_GETBULK,
+				RequestId:   1,
+				ErrorStatus: test.nonRepeaters,
+				ErrorIndex:  test.maxRepetitions,
+				VarBinds:    varBinds,
+			})
+
+			var oids [][]uint32
+			for _, varBind := range pdu.VarBinds {
+				oids = append(oids, varBind.Oid)
+			}
+
+			if !reflect.DeepEqual(oids, test.want) {
+				t.Errorf("got oids %v, want %v", oids, test.want)
+			}
+		})
+	}
+}
+
+func TestSnmpAgentRepetitionsCap(t *testing.T) {
+	pdu := snmpRequest(t, testSnmpAgent(), "public", SnmpPdu{
+		Type:       SNMP_PDU_GETBULK,
+		RequestId:  1,
+		ErrorIndex: 1000,
+		VarBinds:   []SnmpVarBind{{Oid: []uint32{1, 3}}},
+	})
+
+	// The mib of a host with two interfaces is shorter than the cap, the
+	//  walk ends with endOfMibView
+	last := pdu.VarBinds[len(pdu.VarBinds)-1]
+
+	if len(pdu.VarBinds) > SNMP_MAX_REPETITIONS || last.Value.Tag != BER_END_OF_MIB_VIEW {
+		t.Errorf("got %d varbinds ending with tag 0x%x, want at most %d ending with endOfMibView", len(pdu.VarBinds), last.Value.Tag, SNMP_MAX_REPETITIONS)
+	}
+}
+
+func TestSnmpAgentCommunity(t *testing.T) {
+	tests := []struct {
+		name      string
+		community string
+		wantHost  string
+		wantErr   bool
+	}{
+		{"first host", "public", "gw1", false},
+		{"selected host", "public@gw2", "gw2", false},
+		{"wrong community", "private@gw2", "", true},
+		{"unknown host", "public@gw9", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := testSnmpAgent()
+			request := EncodeSnmpMessage(SnmpMessage{SNMP_VERSION_2C, test.community, SnmpPdu{
+				Type:     SNMP_PDU_GET,
+				VarBinds: []SnmpVarBind{{Oid: SNMP_OID_SYS_NAME, Value: SnmpValue{Tag: BER_NULL}}},
+			}})
+
+			packet, err := agent.HandleRequest(request)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+
+			if test.wantErr {
+				return
+			}
+
+			response, err := DecodeSnmpMessage(packet)
+
+			if err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+
+			if name := string(response.Pdu.VarBinds[0].Value.Bytes); name != test.wantHost || response.Community != test.community {
+				t.Errorf("got sysName %s community %s, want %s %s", name, response.Community, test.wantHost, test.community)
+			}
+		})
+	}
+}
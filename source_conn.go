@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	SOURCE_MODE_NONE = ""
+	SOURCE_MODE_BIND = "bind"
+	SOURCE_MODE_RAW  = "raw"
+)
+
+// Open the connection a host uses to reach the collector
+// In bind mode the socket is bound to the ip of the host, which has to be
+// configured as a local address alias, in raw mode the ip and udp headers
+// are written by manflow so any source address can be used
+func InitSourceConn(config ConfigFile, host ConfigHost, sourceMode string) (io.Writer, error) {
+	switch sourceMode {
+	case SOURCE_MODE_NONE:
+		return InitCollectorConn(config, host.Name, "")
+	case SOURCE_MODE_BIND:
+		return InitCollectorConn(config, host.Name, host.Ip)
+	case SOURCE_MODE_RAW:
+		if config.CollectorTransport != TRANSPORT_UDP {
+			return nil, fmt.Errorf("raw source mode only supports udp transport")
+		}
+
+		return InitRawUdpConn(config, host)
+	default:
+		return nil, fmt.Errorf("unknown source mode %s", sourceMode)
+	}
+}
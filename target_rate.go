@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Ticks over which the achieved rate of a host is measured
+	RATE_WINDOW_TICKS = 10
+
+	// Ticks between the achieved rate reports of the hosts
+	RATE_REPORT_TICKS = 10
+
+	// Part of a tick the last packet of the tick can be late
+	RATE_LATE_FRACTION = 0.1
+)
+
+// Records per second of each host with a target rate. The target rate of
+// the config file is the total of the hosts without their own, split in
+// proportion to their flows
+func HostTargetRates(config ConfigFile, targetRate float64, hostFlows map[string]float64) map[string]float64 {
+	rates := map[string]float64{}
+	total := 0.0
+
+	for _, hostName := range configHostNames(config) {
+		host, _ := FindHost(config.Hosts, hostName)
+
+		if host.TargetRate > 0 {
+			rates[hostName] = host.TargetRate
+			continue
+		}
+
+		total += hostFlows[hostName]
+	}
+
+	if targetRate <= 0 || total == 0 {
+		return rates
+	}
+
+	for _, hostName := range configHostNames(config) {
+		if _, ok := rates[hostName]; !ok && hostFlows[hostName] > 0 {
+			rates[hostName] = targetRate * hostFlows[hostName] / total
+		}
+	}
+
+	return rates
+}
+
+// Flows of each host that are sent every flow_timeout, the flows paced to
+// the target rate
+func HostPeriodicFlows(config ConfigFile, flowConfigs []ConfigFlow) map[string]float64 {
+	hostFlows := map[string]float64{}
+
+	for _, hostName := range configHostNames(config) {
+		for _, enabledFlow := range FilterEnabledFlows(flowConfigs, hostName) {
+			if flowConfigs[enabledFlow.ConfigIndex].Periodic() {
+				hostFlows[hostName]++
+			}
+		}
+	}
+
+	return hostFlows
+}
+
+// Sends the records of a host at its target rate: every tick has a quota
+// of records, the fraction of a record left over is carried to the next
+// tick. The packets of a tick are spread over TickDuration, 0 sends them
+// at once
+type RatePacer struct {
+	Rate         float64
+	TickDuration time.Duration
+
+	carry float64
+
+	// Next enabled flow to send, flows are sent in turn
+	cursor int
+
+	quota     int
+	sent      int
+	tickStart time.Time
+
+	// Records sent by the host before each tick and the host time the tick
+	// started at
+	total   int
+	samples []rateSample
+
+	// Whether the host fell behind since the last report
+	behind bool
+}
+
+type rateSample struct {
+	time    int64
+	records int
+}
+
+func NewRatePacer(rate float64) *RatePacer {
+	return &RatePacer{Rate: rate}
+}
+
+// Start a tick at the time now of the host clock, returns the records to
+// send in the tick
+func (p *RatePacer) BeginTick(now int64) int {
+	p.carry += p.Rate * TICK_INTERVAL_MS / 1000
+	p.quota = int(p.carry)
+	p.carry -= float64(p.quota)
+
+	p.sent = 0
+	p.tickStart = time.Now()
+
+	p.samples = append(p.samples, rateSample{time: now, records: p.total})
+
+	if len(p.samples) > RATE_WINDOW_TICKS+1 {
+		p.samples = p.samples[1:]
+	}
+
+	return p.quota
+}
+
+// Records of the quota that are not sent yet
+func (p *RatePacer) Remaining() int {
+	if p.sent > p.quota {
+		return 0
+	}
+
+	return p.quota - p.sent
+}
+
+// Pick the flows for the next round of the tick, at most one record per
+// flow. The enabled flows that can not be sent are skipped
+func (p *RatePacer) PickFlows(numFlows int, sendable func(i int) bool) []bool {
+	picked := make([]bool, numFlows)
+	remaining := p.Remaining()
+
+	for n := 0; n < numFlows && remaining > 0; n++ {
+		i := (p.cursor + n) % numFlows
+
+		if !sendable(i) {
+			continue
+		}
+
+		picked[i] = true
+		remaining--
+
+		if remaining == 0 {
+			p.cursor = (i + 1) % numFlows
+		}
+	}
+
+	return picked
+}
+
+// Wait until the next packet of the tick is due. A packet that is late by
+// more than RATE_LATE_FRACTION of a tick means the host can not keep up
+// with the target rate, returns true the first time this happens since
+// the last report
+func (p *RatePacer) Wait() bool {
+	if p.TickDuration == 0 || p.quota == 0 {
+		return false
+	}
+
+	due := p.tickStart.Add(p.TickDuration * time.Duration(p.sent) / time.Duration(p.quota))
+	late := time.Since(due)
+
+	if late > time.Duration(float64(p.TickDuration)*RATE_LATE_FRACTION) && !p.behind {
+		p.behind = true
+		return true
+	}
+
+	time.Sleep(-late)
+
+	return false
+}
+
+func (p *RatePacer) Sent(records int) {
+	p.sent += records
+	p.total += records
+}
+
+// Records per second over the last RATE_WINDOW_TICKS ticks
+func (p *RatePacer) AchievedRate() float64 {
+	if len(p.samples) < 2 {
+		return 0
+	}
+
+	first := p.samples[0]
+	last := p.samples[len(p.samples)-1]
+
+	if last.time <= first.time {
+		return 0
+	}
+
+	return float64(last.records-first.records) / (float64(last.time-first.time) / float64(time.Second))
+}
+
+// Print the achieved rate of the host
+func (p *RatePacer) Report(hostName string) {
+	fmt.Printf("Achieved rate of %s: %.1f records/s (target %.1f)\n", hostName, p.AchievedRate(), p.Rate)
+
+	p.behind = false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRatePacerQuota(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64
+		want []int
+	}{
+		{"whole rate", 3, []int{3, 3, 3}},
+		{"fraction carried", 2.5, []int{2, 3, 2, 3}},
+		{"below a record per tick", 0.4, []int{0, 0, 1, 0, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pacer := NewRatePacer(test.rate)
+
+			var quotas []int
+			for i := range test.want {
+				quotas = append(quotas, pacer.BeginTick(int64(i)*int64(time.Second)))
+			}
+
+			if !reflect.DeepEqual(quotas, test.want) {
+				t.Errorf("got quotas %v, want %v", quotas, test.want)
+			}
+		})
+	}
+}
+
+func TestRatePacerPickFlows(t *testing.T) {
+	tests := []struct {
+		name       string
+		rate       float64
+		numFlows   int
+		unsendable []int
+		ticks      int
+		want       [][]int
+	}{
+		{"in turn across ticks", 3, 5, []int{1}, 2, [][]int{{0, 2, 3}, {0, 2, 4}}},
+		{"quota above the flows", 7, 3, nil, 1, [][]int{{0, 1, 2}, {0, 1, 2}, {0}}},
+		{"no sendable flows", 2, 2, []int{0, 1}, 1, [][]int{{}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pacer := NewRatePacer(test.rate)
+
+			sendable := func(i int) bool {
+				for _, j := range test.unsendable {
+					if i == j {
+						return false
+					}
+				}
+
+				return true
+			}
+
+			// Rounds of picked flows until the quota of each tick is sent
+			var rounds [][]int
+
+			for tick := 0; tick < test.ticks; tick++ {
+				pacer.BeginTick(int64(tick) * int64(time.Second))
+
+				for pacer.Remaining() > 0 {
+					round := []int{}
+
+					for i, picked := range pacer.PickFlows(test.numFlows, sendable) {
+						if picked {
+							round = append(round, i)
+						}
+					}
+
+					rounds = append(rounds, round)
+
+					if len(round) == 0 {
+						break
+					}
+
+					pacer.Sent(len(round))
+				}
+			}
+
+			if !reflect.DeepEqual(rounds, test.want) {
+				t.Errorf("got rounds %v, want %v", rounds, test.want)
+			}
+		})
+	}
+}
+
+func TestRatePacerAchievedRate(t *testing.T) {
+	var window []int
+	for i := 0; i < 5; i++ {
+		window = append(window, 100)
+	}
+	for i := 0; i < RATE_WINDOW_TICKS; i++ {
+		window = append(window, 10)
+	}
+
+	tests := []struct {
+		name string
+		sent []int
+		want float64
+	}{
+		{"no ticks", nil, 0},
+		{"two ticks", []int{10, 20}, 15},
+		{"only the last ticks", window, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pacer := NewRatePacer(1)
+
+			for i, records := range test.sent {
+				pacer.BeginTick(int64(i) * int64(time.Second))
+				pacer.Sent(records)
+			}
+			pacer.BeginTick(int64(len(test.sent)) * int64(time.Second))
+
+			if rate := pacer.AchievedRate(); math.Abs(rate-test.want) > 1e-9 {
+				t.Errorf("got rate %v, want %v", rate, test.want)
+			}
+		})
+	}
+}
+
+func TestHostTargetRates(t *testing.T) {
+	config := ConfigFile{
+		Hosts: []ConfigHost{
+			{Name: "gw1", TargetRate: 50},
+			{Name: "gw2"},
+			{Name: "gw3"},
+			{Name: "gw4"},
+		},
+	}
+	hostFlows := map[string]float64{"gw1": 10, "gw2": 3, "gw3": 1}
+
+	tests := []struct {
+		name       string
+		targetRate float64
+		want       map[string]float64
+	}{
+		{"split by flows", 100, map[string]float64{"gw1": 50, "gw2": 75, "gw3": 25}},
+		{"only host rates", 0, map[string]float64{"gw1": 50}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rates := HostTargetRates(config, test.targetRate, hostFlows)
+
+			if !reflect.DeepEqual(rates, test.want) {
+				t.Errorf("got rates %v, want %v", rates, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+func InitTcpConn(config ConfigFile, localIp string) (*net.TCPConn, error) {
+	collector := net.JoinHostPort(config.CollectorIp, strconv.Itoa(config.CollectorPort))
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", collector)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve tcp addr %s: %v", collector, err)
+	}
+
+	// Bind to the local ip if one is given
+	var localAddr *net.TCPAddr
+	if localIp != "" {
+		localAddr = &net.TCPAddr{IP: net.ParseIP(localIp)}
+	}
+
+	conn, err := net.DialTCP("tcp", localAddr, tcpAddr)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial tcp addr %s: %v", collector, err)
+	}
+
+	return conn, nil
+}
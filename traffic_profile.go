@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PROFILE_SINE           = "sine"
+	PROFILE_BUSINESS_HOURS = "business_hours"
+	PROFILE_STEPS          = "steps"
+	PROFILE_RAMP           = "ramp"
+	PROFILE_CSV            = "csv"
+)
+
+const SECONDS_PER_DAY = 24 * 60 * 60
+
+var PROFILE_WEEKDAYS = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Multiplier of a profile from a time of day on
+type ProfilePoint struct {
+	At    string  `json:"at"`
+	Value float64 `json:"value"`
+
+	second float64
+}
+
+// Time-based multiplier of the traffic of flows, which fields are used
+// depends on the type. Times of day are HH:MM or HH:MM:SS in Timezone
+type ConfigTrafficProfile struct {
+	Type     string         `json:"type"`
+	Timezone string         `json:"timezone"`
+	Min      float64        `json:"min"`
+	Max      float64        `json:"max"`
+	Peak     string         `json:"peak"`
+	Start    string         `json:"start"`
+	End      string         `json:"end"`
+	Days     []string       `json:"days"`
+	Steps    []ProfilePoint `json:"steps"`
+	From     float64        `json:"from"`
+	To       float64        `json:"to"`
+	Duration string         `json:"duration"`
+	File     string         `json:"file"`
+
+	location    *time.Location
+	peakSecond  float64
+	startSecond float64
+	endSecond   float64
+	weekdays    map[time.Weekday]bool
+	rampSeconds float64
+}
+
+// Seconds since midnight of a time of day
+func ParseTimeOfDay(input string) (float64, error) {
+	parts := strings.Split(input, ":")
+
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time of day %s: must be HH:MM or HH:MM:SS", input)
+	}
+
+	seconds := 0
+	for i, limit := range []int{24, 59, 59}[:len(parts)] {
+		value, err := strconv.Atoi(parts[i])
+
+		if err != nil || value < 0 || value > limit {
+			return 0, fmt.Errorf("invalid time of day %s: must be HH:MM or HH:MM:SS", input)
+		}
+
+		seconds += value * []int{3600, 60, 1}[i]
+	}
+
+	if seconds > SECONDS_PER_DAY {
+		return 0, fmt.Errorf("invalid time of day %s: must not be after 24:00", input)
+	}
+
+	return float64(seconds), nil
+}
+
+// Validate the profile and read the curve file, relative file names are
+// resolved from the directory of the config file
+func (p *ConfigTrafficProfile) Init(configDir string) error {
+	var err error
+
+	p.location, err = time.LoadLocation(p.Timezone)
+
+	if err != nil {
+		return fmt.Errorf("invalid %s profile: failed to load timezone %s: %v", p.Type, p.Timezone, err)
+	}
+
+	if p.Min == 0 && p.Max == 0 {
+		p.Max = 1
+	}
+
+	if p.Min < 0 || p.Min > p.Max {
+		return fmt.Errorf("invalid %s profile: invalid min %v / max %v", p.Type, p.Min, p.Max)
+	}
+
+	switch p.Type {
+	case PROFILE_SINE:
+		p.peakSecond, err = ParseTimeOfDay(p.Peak)
+
+		if err != nil {
+			return fmt.Errorf("invalid sine profile: peak: %v", err)
+		}
+	case PROFILE_BUSINESS_HOURS:
+		p.startSecond, err = ParseTimeOfDay(p.Start)
+
+		if err == nil {
+			p.endSecond, err = ParseTimeOfDay(p.End)
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid business_hours profile: %v", err)
+		}
+
+		days := p.Days
+		if len(days) == 0 {
+			days = []string{"mon", "tue", "wed", "thu", "fri"}
+		}
+
+		p.weekdays = map[time.Weekday]bool{}
+		for _, day := range days {
+			weekday, ok := PROFILE_WEEKDAYS[strings.ToLower(day)]
+
+			if !ok {
+				return fmt.Errorf("invalid business_hours profile: unknown day %s", day)
+			}
+
+			p.weekdays[weekday] = true
+		}
+	case PROFILE_STEPS:
+		if len(p.Steps) == 0 {
+			return fmt.Errorf("invalid steps profile: steps not provided")
+		}
+
+		for i := range p.Steps {
+			p.Steps[i].second, err = ParseTimeOfDay(p.Steps[i].At)
+
+			if err != nil {
+				return fmt.Errorf("invalid steps profile: %v", err)
+			}
+
+			if p.Steps[i].Value < 0 {
+				return fmt.Errorf("invalid steps profile: value %v at %s must not be negative", p.Steps[i].Value, p.Steps[i].At)
+			}
+		}
+
+		sortProfilePoints(p.Steps)
+	case PROFILE_RAMP:
+		duration, err := time.ParseDuration(p.Duration)
+
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid ramp profile: invalid duration %s", p.Duration)
+		}
+
+		if p.From < 0 || p.To < 0 {
+			return fmt.Errorf("invalid ramp profile: from and to must not be negative")
+		}
+
+		p.rampSeconds = duration.Seconds()
+	case PROFILE_CSV:
+		if p.File == "" {
+			return fmt.Errorf("invalid csv profile: file not provided")
+		}
+
+		filename := p.File
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(configDir, filename)
+		}
+
+		p.Steps, err = ReadProfileFile(filename)
+
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown profile %s", p.Type)
+	}
+
+	return nil
+}
+
+func sortProfilePoints(points []ProfilePoint) {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].second < points[j].second
+	})
+}
+
+// Read a rate curve, each line has a time of day and a multiplier, the
+// multiplier is interpolated between the points:
+//
+//	# time,multiplier
+//	00:00,0.2
+//	09:30,1
+//	18:00,0.6
+func ReadProfileFile(filename string) ([]ProfilePoint, error) {
+	file, err := os.Open(filename)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open profile file %s: %v", filename, err)
+	}
+
+	defer file.Close()
+
+	var points []ProfilePoint
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' })
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("failed to parse profile file %s line %d: expected time and multiplier", filename, lineNumber)
+		}
+
+		point := ProfilePoint{At: fields[0]}
+
+		point.second, err = ParseTimeOfDay(fields[0])
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse profile file %s line %d: %v", filename, lineNumber, err)
+		}
+
+		point.Value, err = strconv.ParseFloat(fields[1], 64)
+
+		if err != nil || point.Value < 0 {
+			return nil, fmt.Errorf("failed to parse profile file %s line %d: invalid multiplier %s", filename, lineNumber, fields[1])
+		}
+
+		points = append(points, point)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profile file %s: %v", filename, err)
+	}
+
+	if len(points) == 0 {
+		return nil, fmt.Errorf("profile file %s has no points", filename)
+	}
+
+	sortProfilePoints(points)
+
+	return points, nil
+}
+
+// Multiplier of the profile at a time, ramps start at startMs
+func (p *ConfigTrafficProfile) Value(tickMs int64, startMs int64) float64 {
+	t := time.Unix(0, tickMs*int64(time.Millisecond)).In(p.location)
+	second := float64(t.Hour()*3600+t.Minute()*60+t.Second()) + float64(t.Nanosecond())/1e9
+
+	switch p.Type {
+	case PROFILE_SINE:
+		phase := 2 * math.Pi * (second - p.peakSecond) / SECONDS_PER_DAY
+		return p.Min + (p.Max-p.Min)*(1+math.Cos(phase))/2
+	case PROFILE_BUSINESS_HOURS:
+		open := second >= p.startSecond && second < p.endSecond
+
+		// Business hours past midnight
+		if p.endSecond < p.startSecond {
+			open = second >= p.startSecond || second < p.endSecond
+		}
+
+		if open && p.weekdays[t.Weekday()] {
+			return p.Max
+		}
+		return p.Min
+	case PROFILE_STEPS:
+		// Before the first step the last step of the previous day holds
+		value := p.Steps[len(p.Steps)-1].Value
+		for _, step := range p.Steps {
+			if step.second > second {
+				break
+			}
+			value = step.Value
+		}
+		return value
+	case PROFILE_RAMP:
+		elapsed := float64(tickMs-startMs) / 1000
+		if elapsed >= p.rampSeconds {
+			return p.To
+		}
+		return p.From + (p.To-p.From)*elapsed/p.rampSeconds
+	case PROFILE_CSV:
+		return interpolateProfilePoints(p.Steps, second)
+	}
+
+	return 1
+}
+
+// Linear interpolation between the points of a daily curve, wrapping
+// around midnight
+func interpolateProfilePoints(points []ProfilePoint, second float64) float64 {
+	i := sort.Search(len(points), func(i int) bool { return points[i].second > second })
+
+	var prev, next ProfilePoint
+
+	if i == 0 {
+		prev = points[len(points)-1]
+		prev.second -= SECONDS_PER_DAY
+	} else {
+		prev = points[i-1]
+	}
+
+	if i == len(points) {
+		next = points[0]
+		next.second += SECONDS_PER_DAY
+	} else {
+		next = points[i]
+	}
+
+	return prev.Value + (next.Value-prev.Value)*(second-prev.second)/(next.second-prev.second)
+}
+
+// Apply the profile of the flow for this tick, the bytes have to be
+// generated for this tick already. Below 1 the multiplier is the chance
+// that the flow fires, above 1 it scales the bytes. The seeded random
+// generator is only used for flows with a profile
+func (f *ConfigFlow) ApplyProfile(tick int, tickMs int64, startMs int64, randGen *rand.Rand) {
+	f.ProfileSkip = false
+
+	if f.Profile == nil {
+		return
+	}
+
+	value := f.Profile.Value(tickMs, startMs)
+
+	if value > 1 {
+		// The bytes of a record are 32 bits
+		f.Bytes = int(math.Min(math.Round(float64(f.Bytes)*value), math.MaxUint32))
+		return
+	}
+
+	if tick == f.Tick && randGen.Float64() >= value {
+		f.ProfileSkip = true
+	}
+}
@@ -6,8 +6,8 @@ import (
 	"strconv"
 )
 
-func InitUdpConn(config ConfigFile) (*net.UDPConn, error) {
-	collector := config.CollectorIp + ":" + strconv.Itoa(config.CollectorPort)
+func InitUdpConn(config ConfigFile, localIp string) (*net.UDPConn, error) {
+	collector := net.JoinHostPort(config.CollectorIp, strconv.Itoa(config.CollectorPort))
 
 	udpAddr, err := net.ResolveUDPAddr("udp", collector)
 
@@ -15,7 +15,13 @@ func InitUdpConn(config ConfigFile) (*net.UDPConn, error) {
 		return nil, fmt.Errorf("failed to resolve udp addr %s: %v", collector, err)
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	// Bind to the local ip if one is given
+	var localAddr *net.UDPAddr
+	if localIp != "" {
+		localAddr = &net.UDPAddr{IP: net.ParseIP(localIp)}
+	}
+
+	conn, err := net.DialUDP("udp", localAddr, udpAddr)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial udp addr %s: %v", collector, err)
@@ -2,10 +2,9 @@ package main
 
 import (
 	"encoding/binary"
-	"fmt"
 	"math/rand"
 	"net"
-	"net/netip"
+	"time"
 )
 
 func FindIndex(a string, list []string) int {
@@ -34,31 +33,22 @@ func ConvertPortRangeToSlice(start, end int) []uint16 {
 	return result
 }
 
-func GetCidrHosts(cidr string) ([]string, error) {
-	prefix, err := netip.ParsePrefix(cidr)
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse cidr %s: %v", cidr, err)
-	}
-
-	var ips []string
-	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
-		ips = append(ips, addr.String())
-	}
-
-	if len(ips) < 2 {
-		return ips, nil
-	}
-
-	return ips[1 : len(ips)-1], nil
-}
-
 func ConvertIntToIp(nn uint32) net.IP {
 	ip := make(net.IP, 4)
 	binary.BigEndian.PutUint32(ip, nn)
 	return ip
 }
 
+func FindHost(hosts []ConfigHost, name string) (ConfigHost, bool) {
+	for _, host := range hosts {
+		if host.Name == name {
+			return host, true
+		}
+	}
+
+	return ConfigHost{}, false
+}
+
 func FindHostIp(hosts []ConfigHost, name string) string {
 	if name == "" {
 		return ""
@@ -72,6 +62,39 @@ func FindHostIp(hosts []ConfigHost, name string) string {
 	panic("host not found: " + name)
 }
 
+// Source id used by template based exporters, defaults to the
+// position of the host in the config file
+func FindHostSourceId(hosts []ConfigHost, name string) uint32 {
+	for i, host := range hosts {
+		if host.Name == name {
+			if host.SourceId != 0 {
+				return host.SourceId
+			}
+
+			return uint32(i + 1)
+		}
+	}
+	panic("host not found: " + name)
+}
+
+// Packet sampling rate of a host, 1 if the host does not sample
+func FindHostSamplingRate(hosts []ConfigHost, name string) int {
+	for _, host := range hosts {
+		if host.Name == name {
+			if host.SamplingRate > 1 {
+				return host.SamplingRate
+			}
+
+			return 1
+		}
+	}
+	panic("host not found: " + name)
+}
+
 func randomNum(min, max int) int {
 	return rand.Intn(max-min) + min
 }
+
+func unixMillisToTime(millis uint64) time.Time {
+	return time.Unix(0, int64(millis)*int64(time.Millisecond)).UTC()
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const COMMAND_VALIDATE = "validate"
+
+// Problem of a config file, the path is the JSON path of the setting in
+// the config file after includes and templates are resolved
+type ConfigProblem struct {
+	Path    string
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+
+	return p.Path + ": " + p.Message
+}
+
+type configValidator struct {
+	config   ConfigFile
+	hosts    map[string]bool
+	problems []ConfigProblem
+
+	// Whether an entry is over max_expanded_flows on its own
+	overExpanded bool
+}
+
+func (v *configValidator) add(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check the config file for the mistakes that would make the generators
+// panic or send nothing, all problems are reported instead of the first
+func ValidateConfig(config ConfigFile) []ConfigProblem {
+	v := &configValidator{config: config, hosts: map[string]bool{}}
+
+	v.checkHosts()
+
+	if config.FlowTimeout < 0 {
+		v.add("flow_timeout", "invalid flow timeout %d: must not be negative", config.FlowTimeout)
+	}
+
+	if config.TargetRate < 0 {
+		v.add("target_rate", "invalid target rate %v: must not be negative", config.TargetRate)
+	}
+
+	for i, flow := range config.Flows {
+		v.checkFlow(fmt.Sprintf("flows[%d]", i), flow)
+	}
+
+	names := map[string]bool{}
+
+	for i, scenario := range config.Scenarios {
+		path := fmt.Sprintf("scenarios[%d]", i)
+
+		if scenario.Name != "" && names[scenario.Name] {
+			v.add(path+".name", "duplicate scenario name %s", scenario.Name)
+		}
+		names[scenario.Name] = true
+
+		v.checkScenario(path, scenario)
+	}
+
+	// The total is only reported if no entry is over the cap on its own
+	err := ValidateTotalExpandedFlows(config)
+
+	if err != nil && !v.overExpanded {
+		v.add("max_expanded_flows", "%v", err)
+	}
+
+	v.checkUnusedHosts()
+
+	return v.problems
+}
+
+func (v *configValidator) checkHosts() {
+	ips := map[string]bool{}
+
+	for i, host := range v.config.Hosts {
+		path := fmt.Sprintf("hosts[%d]", i)
+
+		if host.Name == "" {
+			v.add(path+".name", "host name not provided")
+		} else if v.hosts[host.Name] {
+			v.add(path+".name", "duplicate host name %s", host.Name)
+		}
+		v.hosts[host.Name] = true
+
+		addr, err := netip.ParseAddr(host.Ip)
+
+		if err != nil {
+			v.add(path+".ip", "invalid ip %q", host.Ip)
+			continue
+		}
+
+		if host.TargetRate < 0 {
+			v.add(path+".target_rate", "invalid target rate %v: must not be negative", host.TargetRate)
+		}
+
+		err = ValidateHostSourceId(v.config, host.Name)
+
+		if err != nil {
+			v.add(path+".source_id", "%v", err)
+		}
+
+		if ips[addr.String()] {
+			v.add(path+".ip", "duplicate host ip %s", host.Ip)
+		}
+		ips[addr.String()] = true
+	}
+}
+
+func (v *configValidator) checkFlow(path string, flow ConfigFlowUser) {
+	numProblems := len(v.problems)
+
+	v.checkAddr(path+".src_addr", flow.SrcAddr)
+	v.checkAddr(path+".dst_addr", flow.DstAddr)
+	v.checkPorts(path+".src_port", flow.SrcPort, UINT16_MAX)
+	v.checkPorts(path+".dst_port", flow.DstPort, UINT16_MAX)
+	v.checkPorts(path+".proto", flow.Proto, math.MaxUint8)
+	v.checkHops(path+".hops", flow.Hops)
+
+	if len(flow.ReturnHops) > 0 {
+		v.checkHops(path+".return_hops", flow.ReturnHops)
+	}
+
+	if len(v.problems) > numProblems {
+		return
+	}
+
+	err := ValidateFlowWeights(flow)
+
+	if err != nil {
+		v.add(path, "%v", err)
+		return
+	}
+
+	err = validateFlowAddrFamilies(v.config, flow)
+
+	if err != nil {
+		v.add(path, "%v", err)
+		return
+	}
+
+	err = ValidateExpandedFlows(v.config, flow)
+
+	if err != nil {
+		v.add(path, "%v", err)
+		v.overExpanded = true
+		return
+	}
+
+	// Settings without a specific check still panic while parsing the flow
+	err = recoverParseFlow(v.config, flow)
+
+	if err != nil {
+		v.add(path, "%v", err)
+	}
+}
+
+func (v *configValidator) checkScenario(path string, scenario ConfigScenario) {
+	numProblems := len(v.problems)
+
+	v.checkAddr(path+".src_addr", scenario.SrcAddr)
+	v.checkAddr(path+".dst_addr", scenario.DstAddr)
+	v.checkPorts(path+".src_port", scenario.SrcPort, UINT16_MAX)
+	v.checkPorts(path+".dst_port", scenario.DstPort, UINT16_MAX)
+	v.checkPorts(path+".proto", scenario.Proto, math.MaxUint8)
+	v.checkHops(path+".hops", scenario.Hops)
+
+	if len(v.problems) > numProblems {
+		return
+	}
+
+	setting, err := ValidateScenarioSettings(scenario)
+
+	if err != nil {
+		v.add(path+"."+setting, "%v", err)
+		return
+	}
+
+	err = ValidateExpandedFlows(v.config, scenario.flowUser())
+
+	if err != nil {
+		v.add(path, "%v", err)
+		v.overExpanded = true
+		return
+	}
+
+	err = recoverParseFlow(v.config, scenario.flowUser())
+
+	if err != nil {
+		v.add(path, "%v", err)
+	}
+}
+
+// Parse a single flow like the generators do, returning the panic of the
+// parse functions as an error
+func recoverParseFlow(config ConfigFile, flow ConfigFlowUser) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	config.Flows = []ConfigFlowUser{flow}
+	ParseUserFlows(&config)
+
+	return nil
+}
+
+// An address, a cidr or empty for a random address
+func (v *configValidator) checkAddr(path string, input string) {
+	if input == "" {
+		return
+	}
+
+	if strings.Contains(input, "/") {
+		_, err := netip.ParsePrefix(input)
+
+		if err != nil {
+			v.add(path, "invalid cidr %q", input)
+		}
+
+		return
+	}
+
+	_, err := netip.ParseAddr(input)
+
+	if err != nil {
+		v.add(path, "invalid address %q", input)
+	}
+}
+
+// A port or protocol, a list (80,443) or a range (1000-2000), like
+// ParseUserProtoInput
+func (v *configValidator) checkPorts(path string, input string, max int) {
+	if input == "" {
+		return
+	}
+
+	parts := strings.Split(input, ",")
+
+	if !strings.Contains(input, ",") && strings.Contains(input, "-") {
+		parts = strings.SplitN(input, "-", 2)
+	}
+
+	var values []int
+
+	for _, part := range parts {
+		value, err := strconv.Atoi(part)
+
+		if err != nil {
+			v.add(path, "invalid value %q", part)
+			return
+		}
+
+		if value < 0 || value > max {
+			v.add(path, "value %d out of range 0-%d", value, max)
+			return
+		}
+
+		values = append(values, value)
+	}
+
+	if len(parts) == 2 && !strings.Contains(input, ",") && values[0] > values[1] {
+		v.add(path, "inverted range %s", input)
+	}
+}
+
+func (v *configValidator) checkHops(path string, hops []ConfigHopUser) {
+	if len(hops) == 0 {
+		v.add(path, "hops not provided")
+		return
+	}
+
+	for j, hop := range hops {
+		if !v.hosts[hop.Host] {
+			v.add(fmt.Sprintf("%s[%d]", path, j), "unknown host %q", hop.Host)
+		}
+	}
+}
+
+// Hosts that are not a hop of any flow or scenario would not send anything
+func (v *configValidator) checkUnusedHosts() {
+	used := map[string]bool{}
+
+	for _, flow := range v.config.Flows {
+		for _, hops := range [][]ConfigHopUser{flow.Hops, flow.ReturnHops} {
+			for _, hop := range hops {
+				used[hop.Host] = true
+			}
+		}
+	}
+
+	for _, scenario := range v.config.Scenarios {
+		for _, hop := range scenario.Hops {
+			used[hop.Host] = true
+		}
+	}
+
+	for i, host := range v.config.Hosts {
+		if host.Name != "" && !used[host.Name] {
+			v.add(fmt.Sprintf("hosts[%d]", i), "host %s has no flows", host.Name)
+		}
+	}
+}
+
+// Number of flows a flow entry expands into, without expanding it.
+// Invalid settings count as a single value
+func EstimateExpandedFlows(flow ConfigFlowUser) float64 {
+	flows := estimateTuples(flow)
+
+	if flow.Bidirectional {
+		flows *= 2
+	}
+
+	return flows
+}
+
+// Tuples a flow entry expands into, replies not included
+func estimateTuples(flow ConfigFlowUser) float64 {
+	flows := estimateAddrs(flow.SrcAddr) * estimateAddrs(flow.DstAddr)
+	flows *= estimateValues(flow.SrcPort) * estimateValues(flow.DstPort) * estimateValues(flow.Proto)
+
+	if flow.Sample > 0 && float64(flow.Sample) < flows {
+		flows = float64(flow.Sample)
+	} else if flow.MaxFlows > 0 && float64(flow.MaxFlows) < flows {
+		flows = float64(flow.MaxFlows)
+	}
+
+	return flows
+}
+
+func estimateAddrs(input string) float64 {
+	space, err := NewAddrSpace(input)
+
+	if err != nil {
+		return 1
+	}
+
+	return float64(space.Size())
+}
+
+func estimateValues(input string) float64 {
+	if strings.Contains(input, ",") {
+		return float64(len(strings.Split(input, ",")))
+	}
+
+	parts := strings.SplitN(input, "-", 2)
+
+	if len(parts) == 2 {
+		start, err1 := strconv.Atoi(parts[0])
+		end, err2 := strconv.Atoi(parts[1])
+
+		if err1 == nil && err2 == nil {
+			return math.Max(float64(end-start+1), 0)
+		}
+	}
+
+	return 1
+}
+
+// Expanded flows passing through each host, replies pass the return hops
+// or the hops of the request
+func EstimateHostFlows(config ConfigFile) map[string]float64 {
+	hostFlows := map[string]float64{}
+
+	for _, flow := range config.Flows {
+		flows := EstimateExpandedFlows(flow)
+
+		if flow.Bidirectional {
+			flows /= 2
+
+			returnHops := flow.ReturnHops
+			if len(returnHops) == 0 {
+				returnHops = flow.Hops
+			}
+
+			for _, hop := range returnHops {
+				hostFlows[hop.Host] += flows
+			}
+		}
+
+		for _, hop := range flow.Hops {
+			hostFlows[hop.Host] += flows
+		}
+	}
+
+	return hostFlows
+}
+
+// Validate a config file and print its problems and the expected rates,
+// returns an error if there are problems
+func RunValidate(filename string) error {
+	var config ConfigFile
+
+	byteValue, err := LoadConfigDocument(filename)
+
+	if err == nil {
+		err = json.Unmarshal(byteValue, &config)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("FAIL")
+		return fmt.Errorf("config file %s is invalid", filename)
+	}
+
+	problems := ValidateConfig(config)
+
+	// The checks of the generators only report the first problem, so they
+	//  are run once the problems with a path are fixed
+	if len(problems) == 0 {
+		var loaded ConfigFile
+
+		err = ReadFlowConfigFile(&loaded, filename)
+
+		if err != nil {
+			problems = append(problems, ConfigProblem{Message: err.Error()})
+		}
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	flowTimeout := config.FlowTimeout
+	if flowTimeout <= 0 {
+		flowTimeout = 60
+	}
+
+	total := 0.0
+	for _, flow := range config.Flows {
+		total += EstimateExpandedFlows(flow)
+	}
+
+	fmt.Printf("Expanded flows: %.0f\n", total)
+
+	hostFlows := EstimateHostFlows(config)
+	targetRates := HostTargetRates(config, config.TargetRate, hostFlows)
+
+	// Every flow sends one record per flow_timeout at each of its hops,
+	//  unless the host is paced to a target rate
+	for _, hostName := range configHostNames(config) {
+		if rate, ok := targetRates[hostName]; ok {
+			fmt.Printf("%15s = %.0f flows, %.1f records/s (target rate)\n", hostName, hostFlows[hostName], rate)
+			continue
+		}
+
+		fmt.Printf("%15s = %.0f flows, %.1f records/s\n", hostName, hostFlows[hostName], hostFlows[hostName]/float64(flowTimeout))
+	}
+
+	if len(problems) > 0 {
+		fmt.Println("FAIL")
+		return fmt.Errorf("config file %s has %d problems", filename, len(problems))
+	}
+
+	fmt.Println("PASS")
+
+	return nil
+}
+
+// Names of the hosts in the order of the config file, without duplicates
+func configHostNames(config ConfigFile) []string {
+	var hostNames []string
+
+	for _, host := range config.Hosts {
+		if FindIndex(host.Name, hostNames) == -1 {
+			hostNames = append(hostNames, host.Name)
+		}
+	}
+
+	return hostNames
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testValidConfig() ConfigFile {
+	return ConfigFile{
+		FlowTimeout: 60,
+		Hosts: []ConfigHost{
+			{Name: "gw1", Ip: "10.0.0.3"},
+			{Name: "gw2", Ip: "10.0.0.4"},
+		},
+		Flows: []ConfigFlowUser{{
+			SrcAddr: "10.1.0.0/24",
+			DstAddr: "10.2.0.1",
+			DstPort: "443",
+			Proto:   "6",
+			Hops:    []ConfigHopUser{{Host: "gw1"}, {Host: "gw2"}},
+		}},
+		Scenarios: []ConfigScenario{{
+			Type:     SCENARIO_DDOS,
+			Duration: 10,
+			SrcAddr:  "10.9.9.0/30",
+			DstAddr:  "10.2.0.1",
+			Hops:     []ConfigHopUser{{Host: "gw1"}},
+		}},
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    func(config *ConfigFile)
+		wantPaths []string
+	}{
+		{"valid config", func(config *ConfigFile) {}, nil},
+		{"unknown hop host", func(config *ConfigFile) {
+			config.Flows[0].Hops[1].Host = "gw9"
+		}, []string{"flows[0].hops[1]", "hosts[1]"}},
+		{"no hops", func(config *ConfigFile) {
+			config.Flows[0].Hops = nil
+		}, []string{"flows[0].hops", "hosts[1]"}},
+		{"invalid address and cidr", func(config *ConfigFile) {
+			config.Flows[0].SrcAddr = "10.1.0.0/33"
+			config.Flows[0].DstAddr = "10.2.0.300"
+		}, []string{"flows[0].src_addr", "flows[0].dst_addr"}},
+		{"port and protocol out of range", func(config *ConfigFile) {
+			config.Flows[0].DstPort = "70000"
+			config.Flows[0].Proto = "256"
+		}, []string{"flows[0].dst_port", "flows[0].proto"}},
+		{"inverted range", func(config *ConfigFile) {
+			config.Flows[0].SrcPort = "2000-1000"
+		}, []string{"flows[0].src_port"}},
+		{"duplicate host name and ip", func(config *ConfigFile) {
+			config.Hosts = append(config.Hosts, ConfigHost{Name: "gw1", Ip: "10.0.0.4"})
+		}, []string{"hosts[2].name", "hosts[2].ip"}},
+		{"invalid host ip", func(config *ConfigFile) {
+			config.Hosts[1].Ip = "gw2"
+		}, []string{"hosts[1].ip"}},
+		{"host without flows", func(config *ConfigFile) {
+			config.Hosts = append(config.Hosts, ConfigHost{Name: "gw3", Ip: "10.0.0.5"})
+		}, []string{"hosts[2]"}},
+		{"netflow5 source id", func(config *ConfigFile) {
+			config.Hosts[0].SourceId = 256
+		}, []string{"hosts[0].source_id"}},
+		{"source id of another format", func(config *ConfigFile) {
+			config.Hosts[0].SourceId = 256
+			config.Hosts[0].ExportFormat = EXPORT_FORMAT_NETFLOW9
+		}, nil},
+		{"negative flow timeout and target rate", func(config *ConfigFile) {
+			config.FlowTimeout = -1
+			config.TargetRate = -5
+		}, []string{"flow_timeout", "target_rate"}},
+		{"setting that fails to parse", func(config *ConfigFile) {
+			config.Flows[0].Packets = "many"
+		}, []string{"flows[0]"}},
+		{"ipv4 mask", func(config *ConfigFile) {
+			config.Flows[0].SrcMask = "33"
+		}, []string{"flows[0]"}},
+		{"ipv6 mask", func(config *ConfigFile) {
+			config.Hosts[0].ExportFormat = EXPORT_FORMAT_IPFIX
+			config.Hosts[1].ExportFormat = EXPORT_FORMAT_IPFIX
+			config.Flows[0].SrcAddr = "fd00::/120"
+			config.Flows[0].DstAddr = "fd01::1"
+			config.Flows[0].SrcMask = "64"
+		}, nil},
+		{"too many expanded flows", func(config *ConfigFile) {
+			config.Flows[0].SrcAddr = "10.0.0.0/8"
+			config.Flows[0].DstAddr = "11.0.0.0/8"
+		}, []string{"flows[0]"}},
+		{"too many expanded flows in total", func(config *ConfigFile) {
+			config.MaxExpandedFlows = 300
+			config.Flows = append(config.Flows, config.Flows[0])
+		}, []string{"max_expanded_flows"}},
+		{"scenarios count towards the total", func(config *ConfigFile) {
+			config.MaxExpandedFlows = 255
+		}, []string{"max_expanded_flows"}},
+		{"scenario bytes", func(config *ConfigFile) {
+			config.Scenarios[0].Bytes = "zzz"
+		}, []string{"scenarios[0].bytes"}},
+		{"scenario type", func(config *ConfigFile) {
+			config.Scenarios[0].Type = "worm"
+		}, []string{"scenarios[0].type"}},
+		{"scenario interval", func(config *ConfigFile) {
+			config.Scenarios[0].Interval = 5
+		}, []string{"scenarios[0].interval"}},
+		{"scenario address and hop", func(config *ConfigFile) {
+			config.Scenarios[0].DstAddr = "example.com"
+			config.Scenarios[0].Hops[0].Host = "gw9"
+		}, []string{"scenarios[0].dst_addr", "scenarios[0].hops[0]"}},
+		{"duplicate scenario name", func(config *ConfigFile) {
+			config.Scenarios[0].Name = "flood"
+			config.Scenarios = append(config.Scenarios, config.Scenarios[0])
+		}, []string{"scenarios[1].name"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testValidConfig()
+			test.change(&config)
+
+			var paths []string
+			for _, problem := range ValidateConfig(config) {
+				paths = append(paths, problem.Path)
+			}
+
+			if !reflect.DeepEqual(paths, test.wantPaths) {
+				t.Errorf("got problems %v, want problems at %v", ValidateConfig(config), test.wantPaths)
+			}
+		})
+	}
+}